@@ -0,0 +1,143 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Outcome describes the result of a request made
+// with tokens from an AdaptiveLimiter.
+type Outcome struct {
+	// Latency holds how long the request took.
+	Latency time.Duration
+
+	// Failed reports whether the request failed in a way
+	// that indicates the downstream is overloaded, such as
+	// a timeout or a rejection.
+	Failed bool
+}
+
+// AdaptiveParams holds the parameters for NewAdaptiveLimiter.
+type AdaptiveParams struct {
+	// MinRate and MaxRate bound the fill rate, in tokens
+	// per second. Both must be positive.
+	MinRate, MaxRate float64
+
+	// Increase holds the rate, in tokens per second, added
+	// after each successful outcome. If it is zero, 1% of
+	// MinRate is used.
+	Increase float64
+
+	// Backoff holds the factor by which the rate is multiplied
+	// after a failed outcome. If it is zero, 0.9 is used.
+	Backoff float64
+}
+
+// AdaptiveLimiter adjusts the fill rate of a bucket according to
+// the outcomes of the requests it limits, using a latency gradient:
+// it compares a short-term average of the reported latencies with
+// a long-term average and reduces the rate in proportion when the
+// short-term latency rises, which happens as the downstream starts
+// to queue. While latency is stable, the rate grows additively.
+// Failures reduce the rate multiplicatively.
+type AdaptiveLimiter struct {
+	tb     *Bucket
+	params AdaptiveParams
+
+	// mu guards the fields below it.
+	mu sync.Mutex
+
+	// rate holds the rate most recently computed.
+	rate float64
+
+	// applied holds the rate last set on the bucket. The bucket's
+	// rate is only changed when rate differs from it significantly
+	// or reaches one of the bounds.
+	applied float64
+
+	// shortLatency and longLatency hold the short- and long-term
+	// exponentially weighted averages of the reported latencies,
+	// in nanoseconds. They are zero until the first report.
+	shortLatency float64
+	longLatency  float64
+}
+
+// Weights given to each new latency in the short- and
+// long-term averages.
+const (
+	shortLatencyWeight = 0.5
+	longLatencyWeight  = 0.05
+)
+
+// NewAdaptiveLimiter returns a limiter that adjusts the rate of tb
+// within the bounds given by p. The bucket's rate is first limited
+// to those bounds.
+func NewAdaptiveLimiter(tb *Bucket, p AdaptiveParams) *AdaptiveLimiter {
+	if !(p.MinRate > 0) || p.MaxRate < p.MinRate {
+		panic("adaptive limiter rate bounds are invalid")
+	}
+	if p.Increase == 0 {
+		p.Increase = p.MinRate / 100
+	}
+	if p.Backoff == 0 {
+		p.Backoff = 0.9
+	}
+	l := &AdaptiveLimiter{
+		tb:     tb,
+		params: p,
+		rate:   math.Min(math.Max(tb.Rate(), p.MinRate), p.MaxRate),
+	}
+	l.applied = l.rate
+	tb.SetRate(l.rate)
+	return l
+}
+
+// Bucket returns the bucket whose rate is adjusted.
+func (l *AdaptiveLimiter) Bucket() *Bucket {
+	return l.tb
+}
+
+// Report records the outcome of a request and adjusts
+// the rate accordingly.
+func (l *AdaptiveLimiter) Report(o Outcome) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rate := l.rate
+	if o.Failed {
+		rate *= l.params.Backoff
+	} else {
+		latency := float64(o.Latency)
+		if l.longLatency == 0 {
+			l.shortLatency = latency
+			l.longLatency = latency
+		} else {
+			l.shortLatency += shortLatencyWeight * (latency - l.shortLatency)
+			l.longLatency += longLatencyWeight * (latency - l.longLatency)
+		}
+		gradient := 1.0
+		if l.shortLatency > 0 {
+			gradient = math.Max(0.5, math.Min(1, l.longLatency/l.shortLatency))
+		}
+		rate = rate*gradient + l.params.Increase
+	}
+	rate = math.Min(math.Max(rate, l.params.MinRate), l.params.MaxRate)
+	l.rate = rate
+	atBound := rate == l.params.MinRate || rate == l.params.MaxRate
+	if math.Abs(rate-l.applied)/l.applied > rateMargin || atBound && rate != l.applied {
+		l.tb.SetRate(rate)
+		l.applied = rate
+	}
+}
+
+// Rate returns the rate most recently computed, which may differ
+// from the bucket's rate by up to 1%.
+func (l *AdaptiveLimiter) Rate() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
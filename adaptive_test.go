@@ -0,0 +1,58 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type adaptiveSuite struct{}
+
+var _ = gc.Suite(adaptiveSuite{})
+
+func (adaptiveSuite) TestAdaptiveLimiter(c *gc.C) {
+	c.Assert(func() { NewAdaptiveLimiter(NewBucketWithRate(10, 1), AdaptiveParams{MaxRate: 10}) },
+		gc.PanicMatches, "adaptive limiter rate bounds are invalid")
+
+	l := NewAdaptiveLimiter(NewBucketWithRate(1000, 1), AdaptiveParams{
+		MinRate:  10,
+		MaxRate:  100,
+		Increase: 1,
+	})
+	// The initial rate is brought within bounds.
+	c.Assert(l.Rate(), gc.Equals, 100.0)
+	c.Assert(isCloseTo(l.Bucket().Rate(), 100, rateMargin), gc.Equals, true)
+
+	// Rising latency reduces the rate.
+	for i := 0; i < 10; i++ {
+		l.Report(Outcome{Latency: 10 * time.Millisecond})
+	}
+	for i := 0; i < 2; i++ {
+		l.Report(Outcome{Latency: 50 * time.Millisecond})
+	}
+	reduced := l.Rate()
+	if reduced > 50 || reduced < 20 {
+		c.Fatalf("rate after latency increase is %v, want between 20 and 50", reduced)
+	}
+	c.Assert(isCloseTo(l.Bucket().Rate(), reduced, 2*rateMargin), gc.Equals, true)
+
+	// Failures reduce it multiplicatively, down to the minimum.
+	l.Report(Outcome{Failed: true})
+	c.Assert(isCloseTo(l.Rate(), reduced*0.9, 1e-9), gc.Equals, true)
+	for i := 0; i < 100; i++ {
+		l.Report(Outcome{Failed: true})
+	}
+	c.Assert(l.Rate(), gc.Equals, 10.0)
+	c.Assert(isCloseTo(l.Bucket().Rate(), 10, rateMargin), gc.Equals, true)
+
+	// Stable latency lets the rate recover, up to the maximum.
+	for i := 0; i < 1000; i++ {
+		l.Report(Outcome{Latency: 50 * time.Millisecond})
+	}
+	c.Assert(l.Rate(), gc.Equals, 100.0)
+	c.Assert(isCloseTo(l.Bucket().Rate(), 100, rateMargin), gc.Equals, true)
+}
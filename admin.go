@@ -0,0 +1,252 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// BucketState describes the state of a bucket, as reported
+// by the admin handler.
+type BucketState struct {
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Rate      float64           `json:"rate"`
+	Capacity  int64             `json:"capacity"`
+	Available int64             `json:"available"`
+	Paused    bool              `json:"paused,omitempty"`
+	Disabled  bool              `json:"disabled,omitempty"`
+	DryRun    bool              `json:"dryRun,omitempty"`
+}
+
+// State returns the state of the bucket.
+func (tb *Bucket) State() BucketState {
+	now := tb.clock.Now()
+	tb.mu.Lock()
+	defer tb.unlock()
+	tb.adjust(now)
+	return BucketState{
+		Name:      tb.name,
+		Labels:    copyLabels(tb.labels),
+		Rate:      tickRate(tb.fillInterval, tb.quantum),
+		Capacity:  tb.capacity,
+		Available: tb.availableTokens,
+		Paused:    tb.paused,
+		Disabled:  tb.disabled,
+		DryRun:    tb.dryRun != nil,
+	}
+}
+
+// BucketUpdate describes a change to a bucket made through the
+// admin handler. Fields left as zero are not changed.
+type BucketUpdate struct {
+	Rate     float64 `json:"rate,omitempty"`
+	Capacity int64   `json:"capacity,omitempty"`
+}
+
+// Admin is an http.Handler that lets operators inspect and change
+// limiters at run time. It serves JSON at the following paths,
+// relative to wherever it is mounted, for instance with
+// http.StripPrefix:
+//
+//	GET    /buckets                  list the buckets
+//	GET    /buckets/{name}           get a bucket's state
+//	POST   /buckets/{name}           change a bucket (a BucketUpdate)
+//	POST   /buckets/{name}/reset     reset a bucket
+//	POST   /buckets/{name}/pause     pause a bucket
+//	POST   /buckets/{name}/resume    resume a bucket
+//	POST   /buckets/{name}/disable   turn off limiting by a bucket
+//	POST   /buckets/{name}/enable    turn limiting by a bucket back on
+//	GET    /managers/{name}          list the buckets of a BudgetManager
+//	DELETE /managers/{name}/{key}    evict a key from a BudgetManager
+//	GET    /dashboard                show the state of the limiters as HTML
+//
+// The handler should only be reachable by operators; use
+// Authorize to check requests.
+type Admin struct {
+	// Authorize is called for each request. If it returns an
+	// error, the request is refused with 403 Forbidden. If it is
+	// nil, only GET and HEAD requests are allowed.
+	Authorize func(r *http.Request) error
+
+	mux *http.ServeMux
+
+	// mu guards the fields below it.
+	mu       sync.Mutex
+	buckets  map[string]*Bucket
+	managers map[string]*BudgetManager
+}
+
+// NewAdmin returns an admin handler with no limiters registered.
+func NewAdmin() *Admin {
+	a := &Admin{
+		mux:      http.NewServeMux(),
+		buckets:  make(map[string]*Bucket),
+		managers: make(map[string]*BudgetManager),
+	}
+	a.mux.HandleFunc("GET /buckets", a.listBuckets)
+	a.mux.HandleFunc("GET /buckets/{name}", a.bucketHandler(func(tb *Bucket, r *http.Request) error {
+		return nil
+	}))
+	a.mux.HandleFunc("POST /buckets/{name}", a.bucketHandler(updateBucket))
+	a.mux.HandleFunc("POST /buckets/{name}/reset", a.bucketHandler(func(tb *Bucket, r *http.Request) error {
+		tb.Reset()
+		return nil
+	}))
+	a.mux.HandleFunc("POST /buckets/{name}/pause", a.bucketHandler(func(tb *Bucket, r *http.Request) error {
+		tb.Pause()
+		return nil
+	}))
+	a.mux.HandleFunc("POST /buckets/{name}/resume", a.bucketHandler(func(tb *Bucket, r *http.Request) error {
+		tb.Resume()
+		return nil
+	}))
+	a.mux.HandleFunc("POST /buckets/{name}/disable", a.bucketHandler(func(tb *Bucket, r *http.Request) error {
+		tb.Disable()
+		return nil
+	}))
+	a.mux.HandleFunc("POST /buckets/{name}/enable", a.bucketHandler(func(tb *Bucket, r *http.Request) error {
+		tb.Enable()
+		return nil
+	}))
+	a.mux.HandleFunc("GET /managers/{name}", a.listManager)
+	a.mux.HandleFunc("DELETE /managers/{name}/{key}", a.evict)
+	a.mux.HandleFunc("GET /dashboard", a.dashboard)
+	return a
+}
+
+// Register registers a bucket under its name, as set by
+// Bucket.SetName, replacing any registered with the same name.
+// From then on the bucket keeps its most recent throttle events
+// for the dashboard.
+func (a *Admin) Register(tb *Bucket) {
+	name := tb.Name()
+	if name == "" {
+		panic("admin bucket has no name")
+	}
+	tb.logThrottles()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.buckets[name] = tb
+}
+
+// RegisterManager registers a budget manager under the given
+// name, replacing any registered with the same name.
+func (a *Admin) RegisterManager(name string, m *BudgetManager) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.managers[name] = m
+}
+
+// errNoAuthorize is returned for requests that change limiters
+// when no Authorize function is set.
+var errNoAuthorize = errors.New("admin changes need an Authorize function")
+
+// ServeHTTP implements http.Handler.
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.Authorize == nil {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, errNoAuthorize.Error(), http.StatusForbidden)
+			return
+		}
+	} else if err := a.Authorize(r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+func (a *Admin) listBuckets(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	states := make([]BucketState, 0, len(a.buckets))
+	for _, tb := range a.buckets {
+		states = append(states, tb.State())
+	}
+	a.mu.Unlock()
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Name < states[j].Name
+	})
+	writeJSON(w, states)
+}
+
+// bucketHandler returns a handler that applies f to the bucket
+// named in the request and then writes the bucket's state.
+func (a *Admin) bucketHandler(f func(tb *Bucket, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a.mu.Lock()
+		tb := a.buckets[r.PathValue("name")]
+		a.mu.Unlock()
+		if tb == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if err := f(tb, r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, tb.State())
+	}
+}
+
+// errInvalidUpdate is returned for updates with
+// out of range values.
+var errInvalidUpdate = errors.New("rate or capacity out of range")
+
+func updateBucket(tb *Bucket, r *http.Request) error {
+	var u BucketUpdate
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		return err
+	}
+	if u.Rate < 0 || u.Rate > 0 && (u.Rate < minRate || u.Rate > maxRate) || u.Capacity < 0 {
+		return errInvalidUpdate
+	}
+	if u.Rate > 0 {
+		tb.SetRate(u.Rate)
+	}
+	if u.Capacity > 0 {
+		tb.SetCapacity(u.Capacity)
+	}
+	return nil
+}
+
+func (a *Admin) manager(r *http.Request) *BudgetManager {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.managers[r.PathValue("name")]
+}
+
+func (a *Admin) listManager(w http.ResponseWriter, r *http.Request) {
+	m := a.manager(r)
+	if m == nil {
+		http.NotFound(w, r)
+		return
+	}
+	keys := m.Keys()
+	states := make([]BucketState, 0, len(keys))
+	for _, key := range keys {
+		if tb := m.Bucket(key); tb != nil {
+			states = append(states, tb.State())
+		}
+	}
+	writeJSON(w, states)
+}
+
+func (a *Admin) evict(w http.ResponseWriter, r *http.Request) {
+	m := a.manager(r)
+	if m == nil || !m.Evict(r.PathValue("key")) {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,152 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type adminSuite struct{}
+
+var _ = gc.Suite(adminSuite{})
+
+func (adminSuite) TestAdmin(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	search := NewBucketWithRateAndClock(10, 5, clock)
+	search.SetName("search")
+	search.SetLabels(map[string]string{"team": "core"})
+	upload := NewBucketWithRateAndClock(1, 1, clock)
+	upload.SetName("upload")
+	m := NewBudgetManagerWithClock(map[string]BudgetPolicy{
+		"api.example.com": {Rate: 1, Capacity: 2},
+	}, clock)
+	m.Bucket("api.example.com")
+
+	a := NewAdmin()
+	a.Register(search)
+	a.Register(upload)
+	a.RegisterManager("upstreams", m)
+	a.Authorize = func(r *http.Request) error {
+		if r.Header.Get("Authorization") != "secret" {
+			return errors.New("not authorized")
+		}
+		return nil
+	}
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "secret")
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, req)
+		return rec
+	}
+	decode := func(rec *httptest.ResponseRecorder, v any) {
+		c.Assert(rec.Code, gc.Equals, http.StatusOK)
+		c.Assert(json.Unmarshal(rec.Body.Bytes(), v), gc.IsNil)
+	}
+
+	var states []BucketState
+	decode(do("GET", "/buckets", ""), &states)
+	c.Assert(states, gc.HasLen, 2)
+	c.Assert(states[0].Name, gc.Equals, "search")
+	c.Assert(states[0].Labels, gc.DeepEquals, map[string]string{"team": "core"})
+	c.Assert(states[0].Capacity, gc.Equals, int64(5))
+
+	var state BucketState
+	decode(do("POST", "/buckets/search", `{"rate": 20, "capacity": 8}`), &state)
+	c.Assert(isCloseTo(state.Rate, 20, rateMargin), gc.Equals, true)
+	c.Assert(state.Capacity, gc.Equals, int64(8))
+
+	search.TakeAvailable(5)
+	decode(do("POST", "/buckets/search/reset", ""), &state)
+	c.Assert(state.Available, gc.Equals, int64(8))
+	decode(do("POST", "/buckets/search/pause", ""), &state)
+	c.Assert(state.Paused, gc.Equals, true)
+	var resumed BucketState
+	decode(do("POST", "/buckets/search/resume", ""), &resumed)
+	c.Assert(resumed.Paused, gc.Equals, false)
+
+	decode(do("POST", "/buckets/search/disable", ""), &state)
+	c.Assert(state.Disabled, gc.Equals, true)
+	c.Assert(search.Disabled(), gc.Equals, true)
+	do("POST", "/buckets/search/enable", "")
+	c.Assert(search.Disabled(), gc.Equals, false)
+
+	c.Assert(do("POST", "/buckets/search", `{"rate": -1}`).Code, gc.Equals, http.StatusBadRequest)
+	c.Assert(do("POST", "/buckets/search", `{"rate": 1e-12}`).Code, gc.Equals, http.StatusBadRequest)
+	c.Assert(do("POST", "/buckets/search", `{"rate": 1e30}`).Code, gc.Equals, http.StatusBadRequest)
+	c.Assert(do("GET", "/buckets/other", "").Code, gc.Equals, http.StatusNotFound)
+
+	decode(do("GET", "/managers/upstreams", ""), &states)
+	c.Assert(states, gc.HasLen, 1)
+	c.Assert(states[0].Name, gc.Equals, "api.example.com")
+	c.Assert(do("DELETE", "/managers/upstreams/api.example.com", "").Code, gc.Equals, http.StatusNoContent)
+	c.Assert(m.Keys(), gc.HasLen, 0)
+	c.Assert(do("DELETE", "/managers/upstreams/api.example.com", "").Code, gc.Equals, http.StatusNotFound)
+
+	m.Bucket("api.example.com").TakeAvailable(1)
+	m.Bucket("other.example.com")
+	_, ok := search.TryTake(100)
+	c.Assert(ok, gc.Equals, false)
+	upload.SetDryRun(true, nil)
+	upload.Take(3)
+	rec := do("GET", "/dashboard", "")
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "text/html; charset=utf-8")
+	body := rec.Body.String()
+	for _, s := range []string{"<td>search</td>", "team=core", "<h2>upstreams</h2>", "<td>api.example.com</td>",
+		"<td>search</td><td>100</td><td>0s</td>\n<td>rejected</td>",
+		"<td>upload</td><td>3</td><td>2s</td>\n<td>delayed (dry run)</td>",
+	} {
+		c.Check(strings.Contains(body, s), gc.Equals, true, gc.Commentf("%q", s))
+	}
+
+	req := httptest.NewRequest("GET", "/buckets", nil)
+	rec = httptest.NewRecorder()
+	a.ServeHTTP(rec, req)
+	c.Assert(rec.Code, gc.Equals, http.StatusForbidden)
+}
+
+func (adminSuite) TestAdminNoAuthorize(c *gc.C) {
+	tb := NewBucketWithRate(10, 5)
+	tb.SetName("search")
+	a := NewAdmin()
+	a.Register(tb)
+	do := func(method, path string) int {
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec.Code
+	}
+	c.Assert(do("GET", "/buckets/search"), gc.Equals, http.StatusOK)
+	c.Assert(do("POST", "/buckets/search/disable"), gc.Equals, http.StatusForbidden)
+	c.Assert(do("DELETE", "/managers/upstreams/api.example.com"), gc.Equals, http.StatusForbidden)
+	c.Assert(tb.Disabled(), gc.Equals, false)
+}
+
+func (adminSuite) TestRecentThrottles(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithRateAndClock(1, 1, clock)
+	tb.SetName("search")
+	tb.TryTake(2)
+	c.Assert(tb.recentThrottles(), gc.HasLen, 0)
+
+	NewAdmin().Register(tb)
+	for i := 1; i <= throttleLogSize+5; i++ {
+		_, ok := tb.TryTake(int64(i + 1))
+		c.Assert(ok, gc.Equals, false)
+	}
+	events := tb.recentThrottles()
+	c.Assert(events, gc.HasLen, throttleLogSize)
+	c.Assert(events[0].Count, gc.Equals, int64(throttleLogSize+6))
+	c.Assert(events[len(events)-1].Count, gc.Equals, int64(7))
+	c.Assert(events[0].Bucket, gc.Equals, "search")
+	c.Assert(events[0].Rejected, gc.Equals, true)
+}
@@ -0,0 +1,188 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// AutoscaleEvent describes an adjustment made by an Autoscaler.
+type AutoscaleEvent struct {
+	// OldRate and NewRate hold the fill rate, in tokens per
+	// second, before and after the adjustment.
+	OldRate, NewRate float64
+
+	// Capacity holds the bucket's new capacity.
+	Capacity int64
+}
+
+// AutoscaleParams holds the parameters for NewAutoscaler.
+type AutoscaleParams struct {
+	// MinRate and MaxRate bound the fill rate, in tokens
+	// per second. Both must be positive.
+	MinRate, MaxRate float64
+
+	// High and Low hold the utilization, between 0 and 1,
+	// above which the rate is raised and below which it is
+	// lowered. If both are zero, 0.9 and 0.25 are used.
+	High, Low float64
+
+	// Step holds the fraction by which the rate is raised,
+	// or divided when it is lowered, in each adjustment.
+	// If it is zero, 0.1 is used.
+	Step float64
+
+	// Sustain holds the number of consecutive samples for which
+	// the utilization must stay above High or below Low before
+	// the rate is adjusted. If it is zero, 3 is used.
+	Sustain int
+
+	// Interval holds how often the utilization is sampled.
+	// It must be positive.
+	Interval time.Duration
+
+	// OnAdjust, if not nil, is called after each adjustment.
+	OnAdjust func(AutoscaleEvent)
+}
+
+// Autoscaler gradually raises or lowers the rate of a bucket to
+// track demand. It samples the bucket's utilization, measured as
+// how close the bucket is to empty: a bucket that is empty or in
+// debt is fully utilized, and one that stays full is not used at
+// all. When the utilization stays high, the rate is raised; when
+// it stays low, the rate is lowered. The capacity is scaled along
+// with the rate, so the bucket allows bursts of the same duration.
+type Autoscaler struct {
+	tb     *Bucket
+	params AutoscaleParams
+
+	// mu guards the fields below it.
+	mu sync.Mutex
+
+	// high and low hold the number of consecutive samples
+	// above High and below Low respectively.
+	high, low int
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewAutoscaler returns an autoscaler that adjusts the rate of
+// tb according to p, sampling its utilization every p.Interval
+// until Stop is called. The bucket's rate is first limited to
+// the bounds in p.
+func NewAutoscaler(tb *Bucket, p AutoscaleParams) *Autoscaler {
+	if !(p.MinRate > 0) || p.MaxRate < p.MinRate {
+		panic("autoscaler rate bounds are invalid")
+	}
+	if p.Interval <= 0 {
+		panic("autoscaler interval is not > 0")
+	}
+	if p.High == 0 && p.Low == 0 {
+		p.High, p.Low = 0.9, 0.25
+	}
+	if !(p.Low >= 0 && p.Low < p.High && p.High <= 1) {
+		panic("autoscaler utilization bounds are invalid")
+	}
+	if p.Step == 0 {
+		p.Step = 0.1
+	}
+	if !(p.Step > 0) {
+		panic("autoscaler step is not > 0")
+	}
+	if p.Sustain == 0 {
+		p.Sustain = 3
+	}
+	a := &Autoscaler{
+		tb:     tb,
+		params: p,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if rate := tb.Rate(); rate < p.MinRate || rate > p.MaxRate {
+		a.setRate(rate, math.Min(math.Max(rate, p.MinRate), p.MaxRate))
+	}
+	go a.run()
+	return a
+}
+
+func (a *Autoscaler) run() {
+	defer close(a.done)
+	ticker := time.NewTicker(a.params.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.Update()
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// Update samples the bucket's utilization and adjusts its
+// rate if called for, without waiting for the next interval.
+func (a *Autoscaler) Update() {
+	capacity := a.tb.Capacity()
+	util := 1 - float64(a.tb.Available())/float64(capacity)
+	util = math.Min(math.Max(util, 0), 1)
+
+	a.mu.Lock()
+	rate := a.tb.Rate()
+	newRate := rate
+	switch {
+	case util > a.params.High:
+		a.high, a.low = a.high+1, 0
+		if a.high >= a.params.Sustain {
+			newRate = math.Min(rate*(1+a.params.Step), a.params.MaxRate)
+		}
+	case util < a.params.Low:
+		a.high, a.low = 0, a.low+1
+		if a.low >= a.params.Sustain {
+			newRate = math.Max(rate/(1+a.params.Step), a.params.MinRate)
+		}
+	default:
+		a.high, a.low = 0, 0
+	}
+	var e AutoscaleEvent
+	if newRate != rate {
+		a.high, a.low = 0, 0
+		e = a.setRate(rate, newRate)
+	}
+	a.mu.Unlock()
+
+	if newRate != rate && a.params.OnAdjust != nil {
+		a.params.OnAdjust(e)
+	}
+}
+
+// setRate changes the bucket's rate from rate to newRate,
+// scaling its capacity to match.
+func (a *Autoscaler) setRate(rate, newRate float64) AutoscaleEvent {
+	capacity := a.tb.Capacity()
+	newCapacity := int64(math.Round(float64(capacity) * newRate / rate))
+	if newCapacity < 1 {
+		newCapacity = 1
+	}
+	a.tb.SetRate(newRate)
+	a.tb.SetCapacity(newCapacity)
+	return AutoscaleEvent{
+		OldRate:  rate,
+		NewRate:  newRate,
+		Capacity: newCapacity,
+	}
+}
+
+// Stop stops the autoscaler. The bucket keeps the
+// rate and capacity last set.
+func (a *Autoscaler) Stop() {
+	a.stopOnce.Do(func() {
+		close(a.stop)
+		<-a.done
+	})
+}
@@ -0,0 +1,64 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type autoscalerSuite struct{}
+
+var _ = gc.Suite(autoscalerSuite{})
+
+func (autoscalerSuite) TestAutoscaler(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithRateAndClock(10, 10, clock)
+	var events []AutoscaleEvent
+	a := NewAutoscaler(tb, AutoscaleParams{
+		MinRate:  5,
+		MaxRate:  12,
+		Step:     0.1,
+		Sustain:  2,
+		Interval: time.Hour,
+		OnAdjust: func(e AutoscaleEvent) {
+			events = append(events, e)
+		},
+	})
+	defer a.Stop()
+
+	// A busy bucket is scaled up, but only once the
+	// utilization has been high for long enough.
+	tb.TakeAvailable(10)
+	a.Update()
+	c.Assert(events, gc.HasLen, 0)
+	a.Update()
+	c.Assert(events, gc.HasLen, 1)
+	c.Assert(isCloseTo(events[0].NewRate, 11, rateMargin), gc.Equals, true)
+	c.Assert(events[0].Capacity, gc.Equals, int64(11))
+	c.Assert(isCloseTo(tb.Rate(), 11, rateMargin), gc.Equals, true)
+	c.Assert(tb.Capacity(), gc.Equals, int64(11))
+
+	// The rate stays within bounds.
+	a.Update()
+	a.Update()
+	c.Assert(events, gc.HasLen, 2)
+	c.Assert(events[1].NewRate, gc.Equals, 12.0)
+
+	// An idle bucket is scaled down.
+	clock.Sleep(time.Minute)
+	a.Update()
+	a.Update()
+	c.Assert(events, gc.HasLen, 3)
+	c.Assert(isCloseTo(tb.Rate(), 12/1.1, rateMargin), gc.Equals, true)
+
+	// Moderate utilization leaves the rate alone.
+	tb.TakeAvailable(tb.Capacity() / 2)
+	for i := 0; i < 5; i++ {
+		a.Update()
+	}
+	c.Assert(events, gc.HasLen, 3)
+}
@@ -0,0 +1,177 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// BackoffParams holds the parameters for NewBackoffLimiter.
+type BackoffParams struct {
+	// Initial holds the interval required after the first
+	// failure. It must be positive.
+	Initial time.Duration
+
+	// Max holds the longest interval required, however many
+	// failures there have been. If it is zero, there is no
+	// upper bound.
+	Max time.Duration
+
+	// Multiplier holds the factor by which the interval grows
+	// with each further failure. If it is zero, 2 is used.
+	Multiplier float64
+
+	// Jitter holds the fraction, between 0 and 1, by which
+	// each interval is shortened at random, so that keys that
+	// failed together do not all retry together.
+	Jitter float64
+
+	// Rand, if not nil, is used instead of math/rand to
+	// return random numbers in [0, 1). It must be safe
+	// to call concurrently.
+	Rand func() float64
+}
+
+// BackoffLimiter limits retries for each of a set of keys, such as
+// user names for logins or endpoints for webhook redelivery, by
+// requiring an interval after each failure that grows exponentially
+// with the number of consecutive failures, and that is cleared by
+// a success.
+type BackoffLimiter struct {
+	params BackoffParams
+	clock  Clock
+
+	// mu guards the fields below it.
+	mu   sync.Mutex
+	keys map[string]*backoffState
+}
+
+// backoffState holds the state of a key with failures.
+type backoffState struct {
+	failures int
+	next     time.Time
+}
+
+// NewBackoffLimiter returns a limiter that
+// backs off according to p.
+func NewBackoffLimiter(p BackoffParams) *BackoffLimiter {
+	return NewBackoffLimiterWithClock(p, nil)
+}
+
+// NewBackoffLimiterWithClock is identical to NewBackoffLimiter
+// but injects a testable clock interface.
+func NewBackoffLimiterWithClock(p BackoffParams, clock Clock) *BackoffLimiter {
+	if p.Initial <= 0 {
+		panic("backoff initial interval is not > 0")
+	}
+	p.setDefaults()
+	if clock == nil {
+		clock = realClock{}
+	}
+	return &BackoffLimiter{
+		params: p,
+		clock:  clock,
+		keys:   make(map[string]*backoffState),
+	}
+}
+
+// Allow reports whether an attempt for the key may be made now.
+// If not, it returns the time remaining until one may be.
+func (l *BackoffLimiter) Allow(key string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.keys[key]
+	if s == nil {
+		return 0, true
+	}
+	if d := s.next.Sub(l.clock.Now()); d > 0 {
+		return d, false
+	}
+	return 0, true
+}
+
+// Failure records a failed attempt for the key, and returns
+// the interval required before the next attempt.
+func (l *BackoffLimiter) Failure(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.keys[key]
+	if s == nil {
+		s = &backoffState{}
+		l.keys[key] = s
+	}
+	s.failures++
+	d := l.params.interval(s.failures)
+	s.next = l.clock.Now().Add(d)
+	return d
+}
+
+// Success records a successful attempt for the key,
+// clearing its failures.
+func (l *BackoffLimiter) Success(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.keys, key)
+}
+
+// Failures returns the number of consecutive failures
+// recorded for the key.
+func (l *BackoffLimiter) Failures(key string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s := l.keys[key]; s != nil {
+		return s.failures
+	}
+	return 0
+}
+
+// setDefaults checks the parameters other than Initial,
+// which may be zero, and fills in their defaults.
+func (p *BackoffParams) setDefaults() {
+	if p.Initial < 0 {
+		panic("backoff initial interval is negative")
+	}
+	if p.Max < 0 || (p.Max > 0 && p.Max < p.Initial) {
+		panic("backoff max interval is less than initial interval")
+	}
+	if p.Multiplier == 0 {
+		p.Multiplier = 2
+	}
+	if !(p.Multiplier >= 1) {
+		panic("backoff multiplier is not >= 1")
+	}
+	if !(p.Jitter >= 0 && p.Jitter <= 1) {
+		panic("backoff jitter is not in [0, 1]")
+	}
+	if p.Rand == nil {
+		p.Rand = rand.Float64
+	}
+}
+
+// interval returns the interval required after the given number
+// of consecutive failures. It must be called after setDefaults.
+func (p *BackoffParams) interval(failures int) time.Duration {
+	limit := float64(infinityDuration)
+	if p.Max > 0 {
+		limit = float64(p.Max)
+	}
+	d := float64(p.Initial)
+	for i := 1; i < failures && d < limit && p.Multiplier > 1; i++ {
+		d *= p.Multiplier
+	}
+	if d > limit {
+		d = limit
+	}
+	if p.Jitter > 0 {
+		d -= d * p.Jitter * p.Rand()
+	}
+	if d >= float64(infinityDuration) {
+		// Converting d would overflow.
+		return infinityDuration
+	}
+	return time.Duration(d)
+}
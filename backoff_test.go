@@ -0,0 +1,71 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type backoffSuite struct{}
+
+var _ = gc.Suite(backoffSuite{})
+
+func (backoffSuite) TestBackoffLimiter(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	l := NewBackoffLimiterWithClock(BackoffParams{
+		Initial: time.Second,
+		Max:     5 * time.Second,
+	}, clock)
+
+	_, ok := l.Allow("alice")
+	c.Assert(ok, gc.Equals, true)
+
+	// The interval doubles with each failure, up to the maximum.
+	var intervals []time.Duration
+	for i := 0; i < 4; i++ {
+		intervals = append(intervals, l.Failure("alice"))
+	}
+	c.Assert(intervals, gc.DeepEquals, []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second,
+	})
+	c.Assert(l.Failures("alice"), gc.Equals, 4)
+
+	// Other keys are not affected.
+	_, ok = l.Allow("bob")
+	c.Assert(ok, gc.Equals, true)
+
+	clock.Sleep(3 * time.Second)
+	d, ok := l.Allow("alice")
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(d, gc.Equals, 2*time.Second)
+	clock.Sleep(2 * time.Second)
+	_, ok = l.Allow("alice")
+	c.Assert(ok, gc.Equals, true)
+
+	// A success starts again from the initial interval.
+	l.Success("alice")
+	c.Assert(l.Failures("alice"), gc.Equals, 0)
+	c.Assert(l.Failure("alice"), gc.Equals, time.Second)
+}
+
+func (backoffSuite) TestBackoffJitter(c *gc.C) {
+	l := NewBackoffLimiter(BackoffParams{
+		Initial: 10 * time.Second,
+		Jitter:  0.5,
+		Rand:    func() float64 { return 0.5 },
+	})
+	c.Assert(l.Failure("x"), gc.Equals, 7500*time.Millisecond)
+	c.Assert(l.Failure("x"), gc.Equals, 15*time.Second)
+
+	// Without a maximum, the interval grows without overflowing.
+	for l.Failures("x") < 100 {
+		l.Failure("x")
+	}
+	c.Assert(l.Failure("x") > 1<<62, gc.Equals, true)
+
+	c.Assert(func() { NewBackoffLimiter(BackoffParams{}) }, gc.PanicMatches, "backoff initial interval is not > 0")
+}
@@ -0,0 +1,215 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState represents the state of a Breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed is the normal state, in which requests
+	// are limited only by the breaker's bucket.
+	BreakerClosed BreakerState = iota
+
+	// BreakerOpen is the state in which all requests
+	// are refused.
+	BreakerOpen
+
+	// BreakerHalfOpen is the state in which requests are let
+	// through at a trickle to probe whether the downstream
+	// has recovered.
+	BreakerHalfOpen
+)
+
+var breakerStateNames = []string{
+	BreakerClosed:   "closed",
+	BreakerOpen:     "open",
+	BreakerHalfOpen: "half-open",
+}
+
+// String returns the name of the state.
+func (s BreakerState) String() string {
+	if s >= 0 && int(s) < len(breakerStateNames) {
+		return breakerStateNames[s]
+	}
+	return "unknown"
+}
+
+// BreakerParams holds the parameters for NewBreaker.
+type BreakerParams struct {
+	// Threshold holds the number of consecutive refusals by the
+	// bucket, or consecutive reported failures, that trips the
+	// breaker open. It must be positive.
+	Threshold int
+
+	// OpenDuration holds how long the breaker stays open
+	// before becoming half-open. It must be positive.
+	OpenDuration time.Duration
+
+	// HalfOpenRate holds the rate, in requests per second, at
+	// which requests are let through while the breaker is
+	// half-open. It must be positive.
+	HalfOpenRate float64
+
+	// OnStateChange, if not nil, is called whenever the
+	// breaker changes state. It is called without any locks
+	// held, but calls may be concurrent.
+	OnStateChange func(from, to BreakerState)
+}
+
+// Breaker couples a bucket with a circuit breaker. While closed, it
+// admits requests that the bucket allows. A sustained run of refusals
+// or reported failures trips it open, when it refuses everything.
+// After a while it becomes half-open and lets requests through at a
+// trickle; a success closes it again and a failure reopens it.
+type Breaker struct {
+	tb     *Bucket
+	params BreakerParams
+
+	// mu guards the fields below it.
+	mu sync.Mutex
+
+	state BreakerState
+
+	// consecutive holds the number of consecutive refusals
+	// or failures while closed.
+	consecutive int
+
+	// openedAt holds when the breaker last opened.
+	openedAt time.Time
+
+	// trickle holds the bucket that limits requests while
+	// the breaker is half-open.
+	trickle *Bucket
+}
+
+// NewBreaker returns a closed breaker that limits
+// requests with the given bucket.
+func NewBreaker(tb *Bucket, p BreakerParams) *Breaker {
+	if p.Threshold <= 0 {
+		panic("breaker threshold is not > 0")
+	}
+	if p.OpenDuration <= 0 {
+		panic("breaker open duration is not > 0")
+	}
+	if !(p.HalfOpenRate > 0) {
+		panic("breaker half-open rate is not > 0")
+	}
+	return &Breaker{
+		tb:     tb,
+		params: p,
+	}
+}
+
+// Bucket returns the bucket that limits requests
+// while the breaker is closed.
+func (b *Breaker) Bucket() *Bucket {
+	return b.tb
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	from := b.state
+	b.update(b.tb.clock.Now())
+	to := b.state
+	b.mu.Unlock()
+	b.notify(from, to)
+	return to
+}
+
+// Allow reports whether a request may proceed now, taking
+// a token for it if so. It implements Allower, charging
+// count tokens from the breaker's bucket.
+func (b *Breaker) Allow(count int64) bool {
+	b.mu.Lock()
+	from := b.state
+	allowed := b.allow(b.tb.clock.Now(), count)
+	to := b.state
+	b.mu.Unlock()
+	b.notify(from, to)
+	return allowed
+}
+
+func (b *Breaker) allow(now time.Time, count int64) bool {
+	b.update(now)
+	switch b.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		return b.trickle.Allow(1) && b.tb.Allow(count)
+	}
+	if b.tb.Allow(count) {
+		b.consecutive = 0
+		return true
+	}
+	b.failed(now)
+	return false
+}
+
+// Report records the outcome of a request that was allowed. A
+// success while half-open closes the breaker; a failure while
+// half-open reopens it.
+func (b *Breaker) Report(failed bool) {
+	b.mu.Lock()
+	from := b.state
+	now := b.tb.clock.Now()
+	b.update(now)
+	switch {
+	case failed:
+		b.failed(now)
+	case b.state == BreakerHalfOpen:
+		b.setState(BreakerClosed)
+	default:
+		b.consecutive = 0
+	}
+	to := b.state
+	b.mu.Unlock()
+	b.notify(from, to)
+}
+
+// failed records a refusal or failure at the given time.
+func (b *Breaker) failed(now time.Time) {
+	switch b.state {
+	case BreakerClosed:
+		b.consecutive++
+		if b.consecutive < b.params.Threshold {
+			return
+		}
+	case BreakerOpen:
+		return
+	}
+	b.setState(BreakerOpen)
+	b.openedAt = now
+}
+
+// update moves an open breaker to half-open once
+// its open duration has passed.
+func (b *Breaker) update(now time.Time) {
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= b.params.OpenDuration {
+		b.setState(BreakerHalfOpen)
+		b.trickle = NewBucketWithRateAndClock(b.params.HalfOpenRate, 1, b.tb.clock)
+	}
+}
+
+func (b *Breaker) setState(state BreakerState) {
+	b.state = state
+	b.consecutive = 0
+	if state != BreakerHalfOpen {
+		b.trickle = nil
+	}
+}
+
+// notify calls the state change callback if the state
+// has changed. It must be called without b.mu held.
+func (b *Breaker) notify(from, to BreakerState) {
+	if from != to && b.params.OnStateChange != nil {
+		b.params.OnStateChange(from, to)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type breakerSuite struct{}
+
+var _ = gc.Suite(breakerSuite{})
+
+func (breakerSuite) TestBreaker(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	var changes []string
+	b := NewBreaker(NewBucketWithClock(time.Second, 2, clock), BreakerParams{
+		Threshold:    3,
+		OpenDuration: time.Minute,
+		HalfOpenRate: 1,
+		OnStateChange: func(from, to BreakerState) {
+			changes = append(changes, from.String()+" -> "+to.String())
+		},
+	})
+	var _ Allower = b
+
+	// Refusals by the bucket trip the breaker once they
+	// reach the threshold.
+	c.Assert(b.Allow(1), gc.Equals, true)
+	c.Assert(b.Allow(1), gc.Equals, true)
+	c.Assert(b.Allow(1), gc.Equals, false)
+	c.Assert(b.Allow(1), gc.Equals, false)
+	c.Assert(b.State(), gc.Equals, BreakerClosed)
+	c.Assert(b.Allow(1), gc.Equals, false)
+	c.Assert(b.State(), gc.Equals, BreakerOpen)
+
+	// While open, everything is refused, even when the
+	// bucket has tokens.
+	clock.Sleep(30 * time.Second)
+	c.Assert(b.Allow(1), gc.Equals, false)
+
+	// After the open duration it lets a trickle through.
+	clock.Sleep(30 * time.Second)
+	c.Assert(b.State(), gc.Equals, BreakerHalfOpen)
+	c.Assert(b.Allow(1), gc.Equals, true)
+	c.Assert(b.Allow(1), gc.Equals, false)
+
+	// A failure reopens it ...
+	b.Report(true)
+	c.Assert(b.State(), gc.Equals, BreakerOpen)
+
+	// ... and a success closes it.
+	clock.Sleep(time.Minute)
+	c.Assert(b.Allow(1), gc.Equals, true)
+	b.Report(false)
+	c.Assert(b.State(), gc.Equals, BreakerClosed)
+
+	// Reported failures trip it too, but only consecutive ones.
+	b.Report(true)
+	b.Report(true)
+	b.Report(false)
+	b.Report(true)
+	b.Report(true)
+	c.Assert(b.State(), gc.Equals, BreakerClosed)
+	b.Report(true)
+	c.Assert(b.State(), gc.Equals, BreakerOpen)
+
+	c.Assert(changes, gc.DeepEquals, []string{
+		"closed -> open",
+		"open -> half-open",
+		"half-open -> open",
+		"open -> half-open",
+		"half-open -> closed",
+		"closed -> open",
+	})
+	c.Assert(BreakerState(99).String(), gc.Equals, "unknown")
+}
@@ -0,0 +1,181 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// BudgetPolicy describes the published limits of an upstream API.
+type BudgetPolicy struct {
+	// Rate holds the number of requests allowed per second.
+	Rate float64
+
+	// Capacity holds the largest burst of requests allowed.
+	Capacity int64
+}
+
+// BudgetManager holds the request budgets of outbound calls to
+// several upstreams, keyed by host name or by any other name the
+// caller chooses for an upstream. The bucket for an upstream is
+// created from its policy when first needed and shared by all
+// callers, so a single manager used by all the clients in a process
+// keeps the process as a whole within each upstream's limits.
+type BudgetManager struct {
+	clock Clock
+
+	// mu guards the fields below it.
+	mu       sync.Mutex
+	policies map[string]BudgetPolicy
+	buckets  map[string]*Bucket
+
+	// def holds the policy for upstreams without
+	// their own, if any. See SetDefaultPolicy.
+	def *BudgetPolicy
+}
+
+// NewBudgetManager returns a manager with the given policies,
+// keyed by upstream. Upstreams without a policy are not limited.
+func NewBudgetManager(policies map[string]BudgetPolicy) *BudgetManager {
+	return NewBudgetManagerWithClock(policies, nil)
+}
+
+// NewBudgetManagerWithClock is identical to NewBudgetManager
+// but injects a testable clock interface into the buckets it
+// creates.
+func NewBudgetManagerWithClock(policies map[string]BudgetPolicy, clock Clock) *BudgetManager {
+	m := &BudgetManager{
+		clock:    clock,
+		policies: make(map[string]BudgetPolicy),
+		buckets:  make(map[string]*Bucket),
+	}
+	for upstream, p := range policies {
+		m.SetPolicy(upstream, p)
+	}
+	return m
+}
+
+// SetPolicy sets the policy for an upstream. If its bucket
+// already exists, the bucket's rate and capacity are changed
+// to match, so callers sharing it see the new limits.
+func (m *BudgetManager) SetPolicy(upstream string, p BudgetPolicy) {
+	if !(p.Rate > 0) || p.Capacity <= 0 {
+		panic("budget policy rate or capacity is not > 0")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.policies[upstream] = p
+	if tb := m.buckets[upstream]; tb != nil {
+		tb.SetRate(p.Rate)
+		tb.SetCapacity(p.Capacity)
+	}
+}
+
+// SetDefaultPolicy sets the policy used for each upstream that has
+// no policy of its own, so that every such upstream gets a bucket
+// of its own with that policy. Buckets already created from the
+// default policy keep their limits.
+func (m *BudgetManager) SetDefaultPolicy(p BudgetPolicy) {
+	if !(p.Rate > 0) || p.Capacity <= 0 {
+		panic("budget policy rate or capacity is not > 0")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.def = &p
+}
+
+// Bucket returns the bucket holding the budget for the given
+// upstream, named after the upstream, or nil if the upstream
+// has no policy and there is no default policy.
+func (m *BudgetManager) Bucket(upstream string) *Bucket {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if tb := m.buckets[upstream]; tb != nil {
+		return tb
+	}
+	p, ok := m.policies[upstream]
+	if !ok {
+		if m.def == nil {
+			return nil
+		}
+		p = *m.def
+	}
+	tb := NewBucketWithRateAndClock(p.Rate, p.Capacity, m.clock)
+	tb.SetName(upstream)
+	m.buckets[upstream] = tb
+	return tb
+}
+
+// Keys returns the upstreams whose buckets have been
+// created, in sorted order.
+func (m *BudgetManager) Keys() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.buckets))
+	for key := range m.buckets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Evict forgets the bucket for the given upstream, so that a new
+// one is created from its policy when next needed, and reports
+// whether there was one. Callers still holding the old bucket
+// are no longer limited together with new callers.
+func (m *BudgetManager) Evict(upstream string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.buckets[upstream]
+	delete(m.buckets, upstream)
+	return ok
+}
+
+// Remaining returns the number of requests that may be made to
+// the given upstream immediately, and whether the upstream is
+// limited at all. The number is negative when callers are waiting.
+func (m *BudgetManager) Remaining(upstream string) (int64, bool) {
+	tb := m.Bucket(upstream)
+	if tb == nil {
+		return 0, false
+	}
+	return tb.Available(), true
+}
+
+// Transport returns an http.RoundTripper that waits for the budget
+// of each request's host, as returned by URL.Hostname, before
+// passing the request to next, or to http.DefaultTransport if next
+// is nil. If the request's context is done first, or its deadline
+// is too soon, the request fails with the error from
+// Bucket.WaitContext without being sent.
+func (m *BudgetManager) Transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &budgetTransport{
+		m:    m,
+		next: next,
+	}
+}
+
+type budgetTransport struct {
+	m    *BudgetManager
+	next http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *budgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if tb := t.m.Bucket(req.URL.Hostname()); tb != nil {
+		if err := tb.WaitContext(req.Context(), 1); err != nil {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, err
+		}
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,70 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type budgetSuite struct{}
+
+var _ = gc.Suite(budgetSuite{})
+
+func (budgetSuite) TestBudgetManager(c *gc.C) {
+	m := NewBudgetManager(map[string]BudgetPolicy{
+		"api.example.com": {Rate: 1, Capacity: 2},
+	})
+	tb := m.Bucket("api.example.com")
+	c.Assert(tb, gc.NotNil)
+	c.Assert(m.Bucket("api.example.com"), gc.Equals, tb)
+	c.Assert(tb.Name(), gc.Equals, "api.example.com")
+	c.Assert(m.Bucket("other.example.com"), gc.IsNil)
+
+	tb.TakeAvailable(1)
+	n, ok := m.Remaining("api.example.com")
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(n, gc.Equals, int64(1))
+	_, ok = m.Remaining("other.example.com")
+	c.Assert(ok, gc.Equals, false)
+
+	// Changing the policy updates the shared bucket.
+	m.SetPolicy("api.example.com", BudgetPolicy{Rate: 10, Capacity: 5})
+	c.Assert(isCloseTo(tb.Rate(), 10, rateMargin), gc.Equals, true)
+	c.Assert(tb.Capacity(), gc.Equals, int64(5))
+}
+
+func (budgetSuite) TestBudgetTransport(c *gc.C) {
+	m := NewBudgetManager(map[string]BudgetPolicy{
+		"api.example.com": {Rate: 0.001, Capacity: 1},
+	})
+	var sent int
+	rt := m.Transport(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		sent++
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, host := range []string{"api.example.com:443", "api.example.com", "other.example.com"} {
+		req, err := http.NewRequestWithContext(ctx, "GET", "https://"+host+"/", nil)
+		c.Assert(err, gc.IsNil)
+		_, err = rt.RoundTrip(req)
+		if host == "api.example.com" {
+			c.Assert(err, gc.Equals, ErrDeadline)
+		} else {
+			c.Assert(err, gc.IsNil)
+		}
+	}
+	c.Assert(sent, gc.Equals, 2)
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
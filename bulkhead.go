@@ -0,0 +1,140 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrBulkheadTimeout is returned by Bulkhead.Acquire when no
+// slot becomes free within the bulkhead's timeout.
+var ErrBulkheadTimeout = errors.New("timed out waiting for bulkhead slot")
+
+// BulkheadParams holds the parameters for NewBulkhead.
+type BulkheadParams struct {
+	// MaxConcurrent holds the number of callers that may hold
+	// a slot at once. It must be positive.
+	MaxConcurrent int
+
+	// MaxWaiting holds the number of callers that may wait for
+	// a slot when all are taken. Further callers are refused
+	// immediately with ErrQueueFull. If it is zero, callers
+	// never wait.
+	MaxWaiting int
+
+	// Timeout, if positive, holds the longest a caller waits
+	// for a slot before being refused with ErrBulkheadTimeout.
+	Timeout time.Duration
+
+	// OnReject, if not nil, is called with the error
+	// whenever Acquire fails.
+	OnReject func(error)
+}
+
+// BulkheadStats holds statistics about a Bulkhead.
+type BulkheadStats struct {
+	// Active holds the number of slots in use.
+	Active int
+
+	// Waiting holds the number of callers waiting for a slot.
+	Waiting int
+
+	// Rejected holds the total number of failed acquisitions.
+	Rejected uint64
+}
+
+// Bulkhead limits the number of callers using a resource at once,
+// so that one group of requests that becomes slow cannot tie up all
+// the goroutines or connections that others need. Unlike a Gate, it
+// bounds how many callers may queue for the resource and how long
+// they wait.
+type Bulkhead struct {
+	params BulkheadParams
+
+	// slots holds one value for each slot in use.
+	slots chan struct{}
+
+	waiting  atomic.Int64
+	rejected atomic.Uint64
+}
+
+// NewBulkhead returns a bulkhead configured by p.
+func NewBulkhead(p BulkheadParams) *Bulkhead {
+	if p.MaxConcurrent <= 0 {
+		panic("bulkhead max concurrent is not > 0")
+	}
+	if p.MaxWaiting < 0 {
+		panic("bulkhead max waiting is not >= 0")
+	}
+	return &Bulkhead{
+		params: p,
+		slots:  make(chan struct{}, p.MaxConcurrent),
+	}
+}
+
+// Acquire takes a slot, waiting for one to become free if
+// necessary. It fails with ErrQueueFull if too many callers are
+// already waiting, with ErrBulkheadTimeout if the bulkhead's
+// timeout expires, or with the context's error if ctx is done
+// first. Every successful call must be matched by a call to
+// Release.
+func (b *Bulkhead) Acquire(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return b.reject(err)
+	}
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if b.waiting.Add(1) > int64(b.params.MaxWaiting) {
+		b.waiting.Add(-1)
+		return b.reject(ErrQueueFull)
+	}
+	defer b.waiting.Add(-1)
+	var timeout <-chan time.Time
+	if b.params.Timeout > 0 {
+		t := time.NewTimer(b.params.Timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		return b.reject(ErrBulkheadTimeout)
+	case <-ctx.Done():
+		return b.reject(ctx.Err())
+	}
+}
+
+func (b *Bulkhead) reject(err error) error {
+	b.rejected.Add(1)
+	if b.params.OnReject != nil {
+		b.params.OnReject(err)
+	}
+	return err
+}
+
+// Release frees a slot taken by Acquire.
+func (b *Bulkhead) Release() {
+	select {
+	case <-b.slots:
+	default:
+		panic("bulkhead released without acquire")
+	}
+}
+
+// Stats returns statistics about the bulkhead.
+func (b *Bulkhead) Stats() BulkheadStats {
+	return BulkheadStats{
+		Active:   len(b.slots),
+		Waiting:  int(b.waiting.Load()),
+		Rejected: b.rejected.Load(),
+	}
+}
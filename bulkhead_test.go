@@ -0,0 +1,55 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type bulkheadSuite struct{}
+
+var _ = gc.Suite(bulkheadSuite{})
+
+func (bulkheadSuite) TestBulkhead(c *gc.C) {
+	var rejections []error
+	b := NewBulkhead(BulkheadParams{
+		MaxConcurrent: 1,
+		MaxWaiting:    1,
+		Timeout:       20 * time.Millisecond,
+		OnReject: func(err error) {
+			rejections = append(rejections, err)
+		},
+	})
+	ctx := context.Background()
+	c.Assert(b.Acquire(ctx), gc.IsNil)
+
+	// One caller may wait, and is admitted when the
+	// slot is released.
+	done := make(chan error)
+	go func() {
+		done <- b.Acquire(ctx)
+	}()
+	for b.Stats().Waiting == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(b.Acquire(ctx), gc.Equals, ErrQueueFull)
+	b.Release()
+	c.Assert(<-done, gc.IsNil)
+
+	// Waiting callers give up after the timeout.
+	c.Assert(b.Acquire(ctx), gc.Equals, ErrBulkheadTimeout)
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	c.Assert(b.Acquire(cctx), gc.Equals, context.Canceled)
+
+	c.Assert(b.Stats(), gc.Equals, BulkheadStats{Active: 1, Rejected: 3})
+	c.Assert(rejections, gc.DeepEquals, []error{ErrQueueFull, ErrBulkheadTimeout, context.Canceled})
+	b.Release()
+	c.Assert(func() { b.Release() }, gc.PanicMatches, "bulkhead released without acquire")
+}
@@ -0,0 +1,272 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+// The ratelimit command checks rate limits. It has two subcommands:
+//
+//	ratelimit check [flags]
+//
+// hammers a bucket with the given rate and capacity from several
+// goroutines for a while and reports whether the rate it granted
+// conforms to its configuration, and
+//
+//	ratelimit probe [flags] url
+//
+// sends requests to an HTTP endpoint and infers its effective limit
+// from the responses refused with 429 Too Many Requests and from the
+// rate limit headers it returns.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "check":
+		err = check(os.Args[2:])
+	case "probe":
+		err = probe(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ratelimit: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: ratelimit check [flags]\n       ratelimit probe [flags] url\n")
+	os.Exit(2)
+}
+
+// check runs the check subcommand.
+func check(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	rate := fs.Float64("rate", 100, "fill rate in tokens per second")
+	capacity := fs.Int64("capacity", 10, "bucket capacity")
+	workers := fs.Int("workers", 8, "number of goroutines taking tokens")
+	duration := fs.Duration("duration", 5*time.Second, "how long to run")
+	tolerance := fs.Float64("tolerance", 0.02, "allowed relative error in the granted rate")
+	fs.Parse(args)
+
+	tb := ratelimit.NewBucketWithRate(*rate, *capacity)
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	var granted atomic.Int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tb.WaitContext(ctx, 1) == nil {
+				granted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// The bucket starts full, so it may grant its capacity
+	// on top of the fill rate.
+	want := *rate*elapsed.Seconds() + float64(*capacity)
+	got := float64(granted.Load())
+	fmt.Printf("granted %d tokens in %v (%.1f/s), expected at most %.0f\n", granted.Load(), elapsed.Round(time.Millisecond), got/elapsed.Seconds(), want)
+	switch {
+	case got > want*(1+*tolerance):
+		return fmt.Errorf("granted too many tokens")
+	case got < want*(1-*tolerance):
+		return fmt.Errorf("granted too few tokens")
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+// rateLimitHeaders holds the response headers that describe
+// rate limits, in the IETF draft and common legacy forms.
+var rateLimitHeaders = []string{
+	"RateLimit",
+	"RateLimit-Policy",
+	"RateLimit-Limit",
+	"RateLimit-Remaining",
+	"RateLimit-Reset",
+	"X-RateLimit-Limit",
+	"X-RateLimit-Remaining",
+	"X-RateLimit-Reset",
+	"Retry-After",
+}
+
+// probe runs the probe subcommand.
+func probe(args []string) error {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	rate := fs.Float64("rate", 50, "rate at which to send requests, per second")
+	duration := fs.Duration("duration", 10*time.Second, "how long to send requests")
+	method := fs.String("method", "GET", "request method")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	r := sendProbes(ctx, http.DefaultClient, *method, fs.Arg(0), *rate)
+	return r.report(os.Stdout, *rate)
+}
+
+// probeResult holds what the probe subcommand learnt from the
+// requests it sent.
+type probeResult struct {
+	// mu guards the fields below it.
+	mu sync.Mutex
+
+	// statuses holds the number of responses with each
+	// status code.
+	statuses map[int]int
+
+	// failed holds the number of requests that got no response,
+	// and err the error of the most recent of them.
+	failed int
+	err    error
+
+	// unfinished holds the number of requests still waiting
+	// for a response when the probe ended.
+	unfinished int
+
+	// headers holds the rate limit headers received, and
+	// headerSeq, for each of them, the number of the request
+	// whose response it came from, so that responses arriving
+	// out of order do not hide the latest values.
+	headers   map[string]string
+	headerSeq map[string]int
+
+	firstLimit time.Duration
+	elapsed    time.Duration
+}
+
+// sendProbes sends requests to url with the given client and
+// method at the given rate until ctx is done.
+func sendProbes(ctx context.Context, client *http.Client, method, url string, rate float64) *probeResult {
+	r := &probeResult{
+		statuses:  make(map[int]int),
+		headers:   make(map[string]string),
+		headerSeq: make(map[string]int),
+	}
+	tb := ratelimit.NewBucketWithRate(rate, 1)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for seq := 1; tb.WaitContext(ctx, 1) == nil; seq++ {
+		wg.Add(1)
+		go func(seq int) {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, method, url, nil)
+			if err != nil {
+				r.fail(ctx, err)
+				return
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				r.fail(ctx, err)
+				return
+			}
+			resp.Body.Close()
+			r.record(seq, resp, time.Since(start))
+		}(seq)
+	}
+	wg.Wait()
+	r.elapsed = time.Since(start)
+	return r
+}
+
+// fail records a request that got no response because of err.
+func (r *probeResult) fail(ctx context.Context, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ctx.Err() != nil {
+		// The probe ended before the response came.
+		r.unfinished++
+		return
+	}
+	r.failed++
+	r.err = err
+}
+
+// record records the response to the request with the given
+// sequence number, received at the given time since the
+// probe started.
+func (r *probeResult) record(seq int, resp *http.Response, at time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statuses[resp.StatusCode]++
+	if resp.StatusCode == http.StatusTooManyRequests && (r.firstLimit == 0 || at < r.firstLimit) {
+		r.firstLimit = at
+	}
+	for _, h := range rateLimitHeaders {
+		if v := resp.Header.Get(h); v != "" && seq > r.headerSeq[h] {
+			r.headers[h] = v
+			r.headerSeq[h] = seq
+		}
+	}
+}
+
+// report writes a summary of the probe, sent at the given rate,
+// to w. It returns an error if no request got a response.
+func (r *probeResult) report(w io.Writer, rate float64) error {
+	var codes []int
+	responses := 0
+	for code, n := range r.statuses {
+		codes = append(codes, code)
+		responses += n
+	}
+	sort.Ints(codes)
+	total := responses + r.failed + r.unfinished
+	fmt.Fprintf(w, "sent %d requests in %v\n", total, r.elapsed.Round(time.Millisecond))
+	for _, code := range codes {
+		fmt.Fprintf(w, "  %d %s: %d\n", code, http.StatusText(code), r.statuses[code])
+	}
+	if r.failed > 0 {
+		fmt.Fprintf(w, "  no response: %d (last error: %v)\n", r.failed, r.err)
+	}
+	if r.unfinished > 0 {
+		fmt.Fprintf(w, "  unfinished when the probe ended: %d\n", r.unfinished)
+	}
+	if responses == 0 {
+		if r.err != nil {
+			return fmt.Errorf("no responses: %v", r.err)
+		}
+		return fmt.Errorf("no responses")
+	}
+	limited := r.statuses[http.StatusTooManyRequests]
+	if limited == 0 {
+		fmt.Fprintf(w, "no requests were limited; the limit is above %.1f/s or is not enforced\n", rate)
+	} else {
+		accepted := responses - limited
+		fmt.Fprintf(w, "first limited after %v\n", r.firstLimit.Round(time.Millisecond))
+		fmt.Fprintf(w, "inferred limit: about %.1f requests/s\n", float64(accepted)/r.elapsed.Seconds())
+	}
+	if len(r.headers) > 0 {
+		fmt.Fprintln(w, "rate limit headers (latest values by send order):")
+		for _, h := range rateLimitHeaders {
+			if v, ok := r.headers[h]; ok {
+				fmt.Fprintf(w, "  %s: %s\n", h, strings.TrimSpace(v))
+			}
+		}
+	}
+	return nil
+}
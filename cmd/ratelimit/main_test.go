@@ -0,0 +1,88 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+func TestPackage(t *testing.T) {
+	gc.TestingT(t)
+}
+
+type probeSuite struct{}
+
+var _ = gc.Suite(probeSuite{})
+
+func (probeSuite) TestProbe(c *gc.C) {
+	var n atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := n.Add(1)
+		w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(max(3-i, 0), 10))
+		if i > 3 {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	r := sendProbes(ctx, srv.Client(), "GET", srv.URL, 100)
+	c.Assert(r.statuses[http.StatusOK], gc.Equals, 3)
+	if limited := r.statuses[http.StatusTooManyRequests]; limited < 5 {
+		c.Errorf("got %d limited responses, want at least 5", limited)
+	}
+	c.Assert(r.failed, gc.Equals, 0)
+	c.Assert(r.headers["X-RateLimit-Remaining"], gc.Equals, "0")
+
+	var out bytes.Buffer
+	c.Assert(r.report(&out, 100), gc.IsNil)
+	c.Assert(out.String(), gc.Matches, `(?s)sent \d+ requests in .*\n  200 OK: 3\n  429 Too Many Requests: \d+\n.*first limited after .*`)
+}
+
+func (probeSuite) TestProbeHeaderOrder(c *gc.C) {
+	r := &probeResult{
+		statuses:  make(map[int]int),
+		headers:   make(map[string]string),
+		headerSeq: make(map[string]int),
+	}
+	resp := func(remaining string) *http.Response {
+		h := make(http.Header)
+		h.Set("RateLimit-Remaining", remaining)
+		return &http.Response{StatusCode: http.StatusOK, Header: h}
+	}
+	// The response to the later request arrives first.
+	r.record(2, resp("8"), time.Second)
+	r.record(1, resp("9"), 2*time.Second)
+	c.Assert(r.headers["RateLimit-Remaining"], gc.Equals, "8")
+}
+
+func (probeSuite) TestProbeUnreachable(c *gc.C) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r := sendProbes(ctx, http.DefaultClient, "GET", url, 100)
+	if r.failed == 0 {
+		c.Fatalf("no failed requests recorded")
+	}
+	var out bytes.Buffer
+	err := r.report(&out, 100)
+	c.Assert(err, gc.ErrorMatches, "no responses: .*")
+	c.Assert(strings.Contains(out.String(), "no response: "), gc.Equals, true)
+	c.Assert(strings.Contains(out.String(), "no requests were limited"), gc.Equals, false)
+}
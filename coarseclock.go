@@ -0,0 +1,83 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CoarseClock is a Clock whose Now method returns a cached time
+// that is refreshed by a background goroutine at a fixed
+// resolution. Reading it is much cheaper than calling time.Now,
+// at the cost of the returned time lagging the real time by up
+// to the resolution. A single CoarseClock may be shared by
+// any number of buckets.
+type CoarseClock struct {
+	// base holds the time the clock was created. Times returned
+	// by Now are offsets from base, so they keep its monotonic
+	// clock reading.
+	base time.Time
+
+	// offset holds the time elapsed since base as of the
+	// latest refresh.
+	offset atomic.Int64
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewCoarseClock returns a clock that refreshes its notion of
+// the current time every resolution. The resolution must be
+// positive. Call Stop to release the clock's goroutine when the
+// clock is no longer needed.
+func NewCoarseClock(resolution time.Duration) *CoarseClock {
+	if resolution <= 0 {
+		panic("coarse clock resolution is not > 0")
+	}
+	c := &CoarseClock{
+		base: time.Now(),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go c.run(resolution)
+	return c
+}
+
+func (c *CoarseClock) run(resolution time.Duration) {
+	defer close(c.done)
+	ticker := time.NewTicker(resolution)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.offset.Store(int64(time.Since(c.base)))
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Now implements Clock.Now by returning the time as of
+// the latest refresh.
+func (c *CoarseClock) Now() time.Time {
+	return c.base.Add(time.Duration(c.offset.Load()))
+}
+
+// Sleep implements Clock.Sleep by calling time.Sleep.
+func (c *CoarseClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// Stop stops the clock from being refreshed. After Stop,
+// Now always returns the same time.
+func (c *CoarseClock) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+	<-c.done
+}
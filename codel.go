@@ -0,0 +1,67 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrQueueDelay is returned when a caller is refused because
+// waits for tokens have stayed above the target set by
+// SetDelayTarget for too long.
+var ErrQueueDelay = errors.New("wait for tokens above target delay")
+
+// delayControl holds the state of a bucket's delay target.
+type delayControl struct {
+	target   time.Duration
+	interval time.Duration
+
+	// firstAbove holds the time at which waits will have been
+	// above target for interval, or the zero time if the most
+	// recent wait was below target.
+	firstAbove time.Time
+}
+
+// SetDelayTarget manages the wait queue in the manner of controlled
+// delay (CoDel): once every wait for tokens in WaitContext,
+// WaitMaxDuration and RateLimiter.WaitN has been at least target for
+// the given interval, further callers that would wait at least target
+// are refused without taking any tokens, until a wait falls below
+// target again. WaitContext and RateLimiter.WaitN return ErrQueueDelay
+// and WaitMaxDuration returns false. This keeps the latency of a
+// persistently overloaded bucket bounded, while still absorbing
+// bursts that clear within the interval.
+//
+// A target of zero, the default, turns off delay management.
+func (tb *Bucket) SetDelayTarget(target, interval time.Duration) {
+	if target < 0 || (target > 0 && interval <= 0) {
+		panic("token bucket delay target or interval is invalid")
+	}
+	tb.mu.Lock()
+	defer tb.unlock()
+	if target == 0 {
+		tb.delay = nil
+		return
+	}
+	tb.delay = &delayControl{
+		target:   target,
+		interval: interval,
+	}
+}
+
+// admit records a wait of d at the given time and reports
+// whether the caller may wait that long.
+func (c *delayControl) admit(now time.Time, d time.Duration) bool {
+	if d < c.target {
+		c.firstAbove = time.Time{}
+		return true
+	}
+	if c.firstAbove.IsZero() {
+		c.firstAbove = now.Add(c.interval)
+		return true
+	}
+	return now.Before(c.firstAbove)
+}
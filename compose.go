@@ -0,0 +1,91 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// Chain returns an Allower that allows a request only if every one
+// of the given buckets allows it, such as a per-user, a per-endpoint
+// and a global bucket. The buckets are evaluated atomically, as by
+// MultiTake: either every bucket has the tokens and they are taken
+// from all of them, or none are taken. A bucket given more than once
+// is charged once for each time it is given.
+func Chain(buckets ...*Bucket) Allower {
+	takes := make([]BucketCount, len(buckets))
+	for i, tb := range buckets {
+		takes[i] = BucketCount{Bucket: tb, Count: 1}
+	}
+	// Keep the buckets in order of id, so that they
+	// can be locked without deadlock.
+	return chain(mergeTakes(takes))
+}
+
+// chainInline holds the number of buckets for which chain.Allow
+// keeps its bookkeeping on the stack.
+const chainInline = 8
+
+// chain holds the buckets of a Chain, each with the number of
+// times it was given.
+type chain []BucketCount
+
+// Allow implements Allower.
+func (c chain) Allow(count int64) bool {
+	for _, t := range c {
+		t.Bucket.mu.Lock()
+	}
+	defer func() {
+		for i := len(c) - 1; i >= 0; i-- {
+			c[i].Bucket.unlock()
+		}
+	}()
+	var nowsBuf [chainInline]time.Time
+	var takenBuf [chainInline]int64
+	nows, taken := nowsBuf[:0], takenBuf[:0]
+	for i, t := range c {
+		n := count
+		if t.Count > 1 {
+			if count > math.MaxInt64/t.Count {
+				n = math.MaxInt64
+			} else {
+				n *= t.Count
+			}
+		}
+		now := t.Bucket.clock.Now()
+		_, got, ok := t.Bucket.tryCharge(now, n)
+		if !ok {
+			// Tokens returned straight after they were
+			// taken restore the bucket exactly.
+			for j, t := range c[:i] {
+				t.Bucket.refund(nows[j], taken[j])
+			}
+			return false
+		}
+		nows, taken = append(nows, now), append(taken, got)
+	}
+	return true
+}
+
+// Any returns an Allower that allows a request if any one of the
+// given limiters allows it, such as a premium bypass bucket and then
+// the standard bucket. The limiters are tried in order and only the
+// first one to allow the request is charged for it.
+func Any(limiters ...Allower) Allower {
+	return anyOf(limiters)
+}
+
+type anyOf []Allower
+
+// Allow implements Allower.
+func (a anyOf) Allow(count int64) bool {
+	for _, l := range a {
+		if l.Allow(count) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type composeSuite struct{}
+
+var _ = gc.Suite(composeSuite{})
+
+func (composeSuite) TestChain(c *gc.C) {
+	user := NewBucket(time.Hour, 5)
+	endpoint := NewBucket(time.Hour, 3)
+	global := NewBucket(time.Hour, 10)
+	l := Chain(user, endpoint, global)
+
+	c.Assert(l.Allow(2), gc.Equals, true)
+	c.Assert(l.Allow(2), gc.Equals, false)
+	c.Assert(user.Available(), gc.Equals, int64(3))
+	c.Assert(endpoint.Available(), gc.Equals, int64(1))
+	c.Assert(global.Available(), gc.Equals, int64(8))
+
+	c.Assert(l.Allow(1), gc.Equals, true)
+	c.Assert(user.Available(), gc.Equals, int64(2))
+	c.Assert(endpoint.Available(), gc.Equals, int64(0))
+	c.Assert(global.Available(), gc.Equals, int64(7))
+
+	c.Assert(Chain().Allow(1), gc.Equals, true)
+}
+
+func (composeSuite) TestChainAtomic(c *gc.C) {
+	// Callers refused by the second bucket never hold tokens
+	// of the first that other callers could have used.
+	a := NewBucket(time.Hour, 100)
+	b := NewBucket(time.Hour, 100)
+	l := Chain(b, a)
+	var wg sync.WaitGroup
+	var allowed atomic.Int64
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if l.Allow(1) {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	c.Assert(allowed.Load(), gc.Equals, int64(100))
+	c.Assert(a.Available(), gc.Equals, int64(0))
+	c.Assert(b.Available(), gc.Equals, int64(0))
+}
+
+func (composeSuite) TestChainRepeated(c *gc.C) {
+	tb := NewBucket(time.Hour, 5)
+	l := Chain(tb, tb)
+	c.Assert(l.Allow(2), gc.Equals, true)
+	c.Assert(tb.Available(), gc.Equals, int64(1))
+	c.Assert(l.Allow(1), gc.Equals, false)
+	c.Assert(Chain(tb, tb).Allow(1<<62), gc.Equals, false)
+	c.Assert(tb.Available(), gc.Equals, int64(1))
+}
+
+func (composeSuite) TestChainNoAllocations(c *gc.C) {
+	if debugInvariants {
+		c.Skip("invariant checks allocate")
+	}
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	a := NewBucketWithClock(time.Millisecond, 1e6, clock)
+	b := NewBucketWithClock(time.Millisecond, 1, clock)
+	l := Chain(a, b)
+	if n := testing.AllocsPerRun(100, func() { l.Allow(1) }); n != 0 {
+		c.Errorf("got %v allocations, want 0", n)
+	}
+}
+
+func (composeSuite) TestChainDisabled(c *gc.C) {
+	user := NewBucket(time.Hour, 5)
+	endpoint := NewBucket(time.Hour, 1)
+	l := Chain(user, endpoint)
+	c.Assert(user.TakeAvailable(4), gc.Equals, int64(4))
+	user.Disable()
+
+	// The disabled bucket takes nothing, so when the next
+	// bucket refuses, nothing is returned to it.
+	c.Assert(l.Allow(1), gc.Equals, true)
+	c.Assert(l.Allow(1), gc.Equals, false)
+	c.Assert(user.Available(), gc.Equals, int64(1))
+	c.Assert(endpoint.Available(), gc.Equals, int64(0))
+}
+
+func (composeSuite) TestAny(c *gc.C) {
+	premium := NewBucket(time.Hour, 2)
+	standard := NewBucket(time.Hour, 3)
+	l := Any(premium, standard)
+
+	c.Assert(l.Allow(2), gc.Equals, true)
+	c.Assert(premium.Available(), gc.Equals, int64(0))
+	c.Assert(standard.Available(), gc.Equals, int64(3))
+
+	c.Assert(l.Allow(2), gc.Equals, true)
+	c.Assert(standard.Available(), gc.Equals, int64(1))
+
+	c.Assert(l.Allow(2), gc.Equals, false)
+	c.Assert(premium.Available(), gc.Equals, int64(0))
+	c.Assert(standard.Available(), gc.Equals, int64(1))
+
+	// Combinators compose.
+	other := NewBucket(time.Hour, 1)
+	c.Assert(Any(Chain(standard, other)).Allow(1), gc.Equals, true)
+	c.Assert(Any().Allow(1), gc.Equals, false)
+}
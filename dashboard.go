@@ -0,0 +1,203 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// dashboardTopKeys holds the number of keys of each budget
+// manager shown on the dashboard.
+const dashboardTopKeys = 20
+
+// dashboardThrottles holds the number of recent throttle events
+// shown on the dashboard.
+const dashboardThrottles = 50
+
+// throttleLogSize holds the number of recent throttle events
+// kept by each bucket registered with an Admin.
+const throttleLogSize = 16
+
+// throttleEvent describes a take that a bucket refused or made
+// wait, or would have in dry-run mode.
+type throttleEvent struct {
+	Time     time.Time
+	Bucket   string
+	Count    int64
+	Wait     time.Duration
+	Rejected bool
+	DryRun   bool
+}
+
+// throttleLog holds a bucket's most recent throttle events
+// in a ring.
+type throttleLog struct {
+	events [throttleLogSize]throttleEvent
+	// n holds the number of events ever added.
+	n int
+}
+
+func (l *throttleLog) add(e throttleEvent) {
+	l.events[l.n%throttleLogSize] = e
+	l.n++
+}
+
+// logThrottles makes the bucket keep its most recent
+// throttle events.
+func (tb *Bucket) logThrottles() {
+	tb.mu.Lock()
+	defer tb.unlock()
+	if tb.throttles == nil {
+		tb.throttles = &throttleLog{}
+	}
+}
+
+// throttled records that a take of count tokens at now was made to
+// wait for d or, if rejected is true, refused, if the bucket keeps
+// its throttle events. It must be called with tb.mu held.
+func (tb *Bucket) throttled(now time.Time, count int64, d time.Duration, rejected bool) {
+	if tb.throttles == nil {
+		return
+	}
+	if rejected {
+		d = 0
+	}
+	tb.throttles.add(throttleEvent{
+		Time:     now,
+		Count:    count,
+		Wait:     d,
+		Rejected: rejected,
+		DryRun:   tb.dryRun != nil,
+	})
+}
+
+// recentThrottles returns the bucket's recorded throttle
+// events, most recent first.
+func (tb *Bucket) recentThrottles() []throttleEvent {
+	tb.mu.Lock()
+	defer tb.unlock()
+	l := tb.throttles
+	if l == nil {
+		return nil
+	}
+	start := 0
+	if l.n > throttleLogSize {
+		start = l.n - throttleLogSize
+	}
+	events := make([]throttleEvent, 0, l.n-start)
+	for i := l.n - 1; i >= start; i-- {
+		e := l.events[i%throttleLogSize]
+		e.Bucket = tb.name
+		events = append(events, e)
+	}
+	return events
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>Rate limits</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+.low { background: #fdd; }
+.paused { color: #888; }
+</style>
+</head>
+<body>
+<h1>Rate limits</h1>
+<h2>Buckets</h2>
+{{template "table" .Buckets}}
+{{range .Managers}}
+<h2>{{.Name}}</h2>
+<p>{{.Keys}} keys{{if gt .Keys (len .Top)}}, showing the {{len .Top}} with the fewest tokens{{end}}.</p>
+{{template "table" .Top}}
+{{end}}
+<h2>Recent throttle events</h2>
+{{if .Throttles}}<table>
+<tr><th>Time</th><th>Bucket</th><th>Count</th><th>Wait</th><th>Outcome</th></tr>
+{{range .Throttles}}<tr>
+<td>{{.Time.Format "2006-01-02 15:04:05.000"}}</td><td>{{.Bucket}}</td><td>{{.Count}}</td><td>{{.Wait}}</td>
+<td>{{if .Rejected}}rejected{{else}}delayed{{end}}{{if .DryRun}} (dry run){{end}}</td>
+</tr>
+{{end}}</table>{{else}}<p>None.</p>{{end}}
+</body>
+</html>
+{{define "table"}}<table>
+<tr><th>Name</th><th>Rate (/s)</th><th>Capacity</th><th>Available</th><th>Labels</th></tr>
+{{range .}}<tr class="{{if .Paused}}paused{{else if le .Available 0}}low{{end}}">
+<td>{{.Name}}{{if .Paused}} (paused){{end}}{{if .Disabled}} (disabled){{end}}</td>
+<td>{{printf "%.4g" .Rate}}</td><td>{{.Capacity}}</td><td>{{.Available}}</td>
+<td>{{range $k, $v := .Labels}}{{$k}}={{$v}} {{end}}</td>
+</tr>
+{{end}}</table>{{end}}
+`))
+
+type dashboardManager struct {
+	Name string
+	Keys int
+	Top  []BucketState
+}
+
+// dashboard serves a page showing the state of the registered
+// buckets, for each budget manager the keys with the fewest
+// tokens available, which are those being used the most, and
+// the registered buckets' most recent throttle events.
+func (a *Admin) dashboard(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Buckets   []BucketState
+		Managers  []dashboardManager
+		Throttles []throttleEvent
+	}
+	a.mu.Lock()
+	for _, tb := range a.buckets {
+		data.Buckets = append(data.Buckets, tb.State())
+		data.Throttles = append(data.Throttles, tb.recentThrottles()...)
+	}
+	managers := make(map[string]*BudgetManager, len(a.managers))
+	for name, m := range a.managers {
+		managers[name] = m
+	}
+	a.mu.Unlock()
+	sort.Slice(data.Buckets, func(i, j int) bool {
+		return data.Buckets[i].Name < data.Buckets[j].Name
+	})
+	sort.SliceStable(data.Throttles, func(i, j int) bool {
+		return data.Throttles[i].Time.After(data.Throttles[j].Time)
+	})
+	if len(data.Throttles) > dashboardThrottles {
+		data.Throttles = data.Throttles[:dashboardThrottles]
+	}
+	for name, m := range managers {
+		dm := dashboardManager{Name: name}
+		for _, key := range m.Keys() {
+			if tb := m.Bucket(key); tb != nil {
+				dm.Top = append(dm.Top, tb.State())
+			}
+		}
+		dm.Keys = len(dm.Top)
+		sort.SliceStable(dm.Top, func(i, j int) bool {
+			return dm.Top[i].Available < dm.Top[j].Available
+		})
+		if len(dm.Top) > dashboardTopKeys {
+			dm.Top = dm.Top[:dashboardTopKeys]
+		}
+		data.Managers = append(data.Managers, dm)
+	}
+	sort.Slice(data.Managers, func(i, j int) bool {
+		return data.Managers[i].Name < data.Managers[j].Name
+	})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
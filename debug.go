@@ -0,0 +1,64 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+//go:build ratelimitdebug
+
+package ratelimit
+
+import (
+	"fmt"
+	"time"
+)
+
+// debugInvariants reports whether the package was built
+// with the ratelimitdebug tag.
+const debugInvariants = true
+
+// debugState records a bucket's start time and latest tick as of
+// the previous invariant check, so that ticks can be checked for
+// monotonicity while the start time is unchanged.
+type debugState struct {
+	checked    bool
+	startTime  time.Time
+	latestTick int64
+}
+
+// checkInvariants returns a description of the bucket's state
+// if any of its invariants do not hold, or the empty string if
+// they all do. It must be called with tb.mu held.
+func (tb *Bucket) checkInvariants() string {
+	var problem string
+	switch {
+	case tb.capacity <= 0:
+		problem = "capacity is not > 0"
+	case tb.quantum <= 0:
+		problem = "quantum is not > 0"
+	case tb.fillInterval <= 0:
+		problem = "fill interval is not > 0"
+	case tb.availableTokens > tb.capacity:
+		problem = "available tokens exceed capacity"
+	case tb.latestTick < 0:
+		problem = "latest tick is negative"
+	case tb.ramp != nil && !(tb.ramp.fromRate > 0 && tb.ramp.toRate > 0 && tb.ramp.duration > 0):
+		problem = "rate ramp is invalid"
+	case tb.waiters < 0:
+		problem = "waiter count is negative"
+	}
+	if problem == "" {
+		prev := tb.debug
+		if prev.checked && prev.startTime.Equal(tb.startTime) && tb.latestTick < prev.latestTick {
+			problem = fmt.Sprintf("latest tick moved backwards from %d", prev.latestTick)
+		}
+	}
+	if problem != "" {
+		return fmt.Sprintf("ratelimit: bucket invariant violated: %s\n"+
+			"name: %q\nstartTime: %v\ncapacity: %d\nquantum: %d\nfillInterval: %v\n"+
+			"availableTokens: %d\nlatestTick: %d\nramp: %+v",
+			problem, tb.name, tb.startTime, tb.capacity, tb.quantum, tb.fillInterval,
+			tb.availableTokens, tb.latestTick, tb.ramp,
+		)
+	}
+	tb.debug = debugState{true, tb.startTime, tb.latestTick}
+	return ""
+}
@@ -0,0 +1,35 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+//go:build ratelimitdebug
+
+package ratelimit
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type debugSuite struct{}
+
+var _ = gc.Suite(debugSuite{})
+
+func (debugSuite) TestInvariantViolation(c *gc.C) {
+	tb := NewBucket(time.Second, 10)
+	c.Assert(tb.Take(5), gc.Equals, time.Duration(0))
+	tb.availableTokens = 11
+	c.Assert(func() { tb.Available() }, gc.PanicMatches, `(?s)ratelimit: bucket invariant violated: available tokens exceed capacity\n.*availableTokens: 11\n.*`)
+
+	// The bucket is unlocked before the panic, so it can still be used.
+	tb.availableTokens = 5
+	c.Assert(tb.Available(), gc.Equals, int64(5))
+}
+
+func (debugSuite) TestTickMovedBackwards(c *gc.C) {
+	tb := NewBucket(time.Second, 10)
+	tb.available(tb.startTime.Add(8 * time.Second))
+	tb.latestTick = 3
+	c.Assert(func() { tb.TakeAvailable(0) }, gc.PanicMatches, `(?s)ratelimit: bucket invariant violated: latest tick moved backwards from 8\n.*`)
+}
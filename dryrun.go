@@ -0,0 +1,103 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import "time"
+
+// DryRunEvent describes a take that the bucket would have
+// limited had it not been in dry-run mode.
+type DryRunEvent struct {
+	// Count holds the number of tokens asked for.
+	Count int64
+
+	// Wait holds how long the caller would have waited
+	// for the tokens. It is zero when Rejected is true.
+	Wait time.Duration
+
+	// Rejected reports whether the caller would have been
+	// refused outright rather than made to wait.
+	Rejected bool
+}
+
+// DryRunStats holds the number of takes that a bucket in
+// dry-run mode would have limited.
+type DryRunStats struct {
+	// Delayed holds the number of takes that would have waited.
+	Delayed uint64
+
+	// Rejected holds the number of takes that would have
+	// been refused.
+	Rejected uint64
+}
+
+type dryRun struct {
+	report  func(DryRunEvent)
+	stats   DryRunStats
+	pending []DryRunEvent
+}
+
+// SetDryRun turns dry-run mode on or off. In dry-run mode the
+// bucket keeps full account of the tokens taken from it, but
+// never makes a caller wait and never refuses one: a take that
+// would have been limited succeeds immediately and is instead
+// counted in DryRunStats and, if report is non-nil, passed to
+// report. This allows a new limit to be tried against real
+// traffic before it is enforced. A take that would have waited
+// still takes its tokens, so the bucket's level shows the debt
+// that enforcing the limit would have built up; one that would
+// have been refused takes nothing.
+//
+// The report function is called without the bucket's lock held,
+// but from the goroutine making the take, so it should not block.
+// Turning dry-run mode off or on again clears the stats.
+func (tb *Bucket) SetDryRun(on bool, report func(DryRunEvent)) {
+	tb.mu.Lock()
+	defer tb.unlock()
+	if !on {
+		tb.dryRun = nil
+		return
+	}
+	tb.dryRun = &dryRun{
+		report: report,
+	}
+}
+
+// DryRun reports whether the bucket is in dry-run mode.
+func (tb *Bucket) DryRun() bool {
+	tb.mu.Lock()
+	defer tb.unlock()
+	return tb.dryRun != nil
+}
+
+// DryRunStats returns the number of takes that the bucket would
+// have limited since dry-run mode was turned on. It returns zero
+// stats if the bucket is not in dry-run mode.
+func (tb *Bucket) DryRunStats() DryRunStats {
+	tb.mu.Lock()
+	defer tb.unlock()
+	if tb.dryRun == nil {
+		return DryRunStats{}
+	}
+	return tb.dryRun.stats
+}
+
+// wouldLimit records that a take of count tokens would have waited
+// for d or, if rejected is true, been refused. It must be called
+// with tb.mu held and tb.dryRun non-nil.
+func (tb *Bucket) wouldLimit(count int64, d time.Duration, rejected bool) {
+	if rejected {
+		tb.dryRun.stats.Rejected++
+		d = 0
+	} else {
+		tb.dryRun.stats.Delayed++
+	}
+	if tb.dryRun.report != nil {
+		tb.dryRun.pending = append(tb.dryRun.pending, DryRunEvent{
+			Count:    count,
+			Wait:     d,
+			Rejected: rejected,
+		})
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// milliTokens holds the number of underlying tokens in each token
+// of a FractionalBucket.
+const milliTokens = 1000
+
+// FractionalBucket is a token bucket whose costs may be fractions
+// of a token, such as 0.2 tokens for a lightweight call. It holds
+// a Bucket counting thousandths of a token, so that callers need
+// not scale their rates and costs themselves. Costs are rounded to
+// the nearest thousandth of a token.
+type FractionalBucket struct {
+	tb *Bucket
+}
+
+// NewFractionalBucket returns a bucket that fills at the rate of
+// rate tokens per second up to the given capacity, which may
+// also be fractional. The bucket is initially full.
+func NewFractionalBucket(rate, capacity float64) *FractionalBucket {
+	return NewFractionalBucketWithClock(rate, capacity, nil)
+}
+
+// NewFractionalBucketWithClock is identical to NewFractionalBucket
+// but injects a testable clock interface.
+func NewFractionalBucketWithClock(rate, capacity float64, clock Clock) *FractionalBucket {
+	if capacity <= 0 {
+		panic("token bucket capacity is not > 0")
+	}
+	return &FractionalBucket{
+		tb: NewBucketWithRateAndClock(rate*milliTokens, toMilli(capacity), clock),
+	}
+}
+
+// toMilli returns n tokens in thousandths of a token.
+func toMilli(n float64) int64 {
+	return int64(math.Round(n * milliTokens))
+}
+
+// fromMilli returns n thousandths of a token in tokens.
+func fromMilli(n int64) float64 {
+	return float64(n) / milliTokens
+}
+
+// Bucket returns the underlying bucket, which counts thousandths
+// of a token, such as for registering with an Admin or a Group.
+func (b *FractionalBucket) Bucket() *Bucket {
+	return b.tb
+}
+
+// Allow takes cost tokens if they are available immediately,
+// and reports whether it did, as Bucket.Allow does.
+func (b *FractionalBucket) Allow(cost float64) bool {
+	return b.tb.Allow(toMilli(cost))
+}
+
+// Take takes cost tokens and returns the time to wait until they
+// are available, as Bucket.Take does.
+func (b *FractionalBucket) Take(cost float64) time.Duration {
+	return b.tb.Take(toMilli(cost))
+}
+
+// Wait takes cost tokens, waiting until they are available,
+// as Bucket.Wait does.
+func (b *FractionalBucket) Wait(cost float64) {
+	b.tb.Wait(toMilli(cost))
+}
+
+// WaitContext takes cost tokens, waiting until they are available
+// or ctx is done, as Bucket.WaitContext does.
+func (b *FractionalBucket) WaitContext(ctx context.Context, cost float64) error {
+	return b.tb.WaitContext(ctx, toMilli(cost))
+}
+
+// Available returns the number of available tokens, which
+// is negative when there are callers waiting for tokens.
+func (b *FractionalBucket) Available() float64 {
+	return fromMilli(b.tb.Available())
+}
+
+// Capacity returns the capacity of the bucket, in tokens.
+func (b *FractionalBucket) Capacity() float64 {
+	return fromMilli(b.tb.Capacity())
+}
+
+// Rate returns the fill rate of the bucket, in tokens per second.
+func (b *FractionalBucket) Rate() float64 {
+	return b.tb.Rate() / milliTokens
+}
@@ -0,0 +1,35 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type fractionalSuite struct{}
+
+var _ = gc.Suite(fractionalSuite{})
+
+func (fractionalSuite) TestFractionalBucket(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	b := NewFractionalBucketWithClock(0.5, 1.5, clock)
+	c.Assert(b.Capacity(), gc.Equals, 1.5)
+	c.Assert(isCloseTo(b.Rate(), 0.5, rateMargin), gc.Equals, true)
+
+	for i := 0; i < 7; i++ {
+		c.Assert(b.Allow(0.2), gc.Equals, true)
+	}
+	c.Assert(b.Available(), gc.Equals, 0.1)
+	c.Assert(b.Allow(0.2), gc.Equals, false)
+
+	// Half a token needs 0.4 more, which takes 0.8s at 0.5/s.
+	c.Assert(b.Take(0.5), gc.Equals, 800*time.Millisecond)
+	c.Assert(b.Available(), gc.Equals, -0.4)
+	clock.Sleep(time.Second)
+	c.Assert(b.Available(), gc.Equals, 0.1)
+	c.Assert(b.Bucket().Available(), gc.Equals, int64(100))
+}
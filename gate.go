@@ -0,0 +1,143 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrQuotaExhausted is returned by Gate.Acquire when
+// the gate's quota has no tokens left.
+var ErrQuotaExhausted = errors.New("quota exhausted")
+
+// GateParams holds the parameters for NewGate. Any of
+// the limits may be left unset.
+type GateParams struct {
+	// Rate, if not nil, limits the rate of acquisitions. Callers
+	// wait for its tokens.
+	Rate *Bucket
+
+	// MaxInFlight, if positive, limits the number of
+	// acquisitions that have not yet been released. Callers
+	// wait for a slot.
+	MaxInFlight int
+
+	// Quota, if not nil, holds a long-horizon budget, such as a
+	// bucket that refills daily. Callers do not wait for its
+	// tokens: when it is empty, acquisitions fail immediately
+	// with ErrQuotaExhausted.
+	Quota *Bucket
+}
+
+// GateStats holds statistics about a Gate.
+type GateStats struct {
+	// InFlight holds the number of acquisitions
+	// not yet released.
+	InFlight int64
+
+	// Acquired holds the total number of
+	// successful acquisitions.
+	Acquired uint64
+
+	// Rejected holds the total number of failed
+	// acquisitions, whatever the reason.
+	Rejected uint64
+}
+
+// Gate enforces a rate, a concurrency limit and a quota together.
+// Each successful Acquire holds a token from the rate bucket, a
+// token from the quota and an in-flight slot until the matching
+// Release; if any of them cannot be had, whatever was already
+// taken is given back.
+type Gate struct {
+	params GateParams
+
+	// slots holds one value for each acquisition in flight,
+	// if MaxInFlight is set.
+	slots chan struct{}
+
+	inFlight atomic.Int64
+	acquired atomic.Uint64
+	rejected atomic.Uint64
+}
+
+// NewGate returns a gate enforcing the limits in p.
+func NewGate(p GateParams) *Gate {
+	g := &Gate{params: p}
+	if p.MaxInFlight > 0 {
+		g.slots = make(chan struct{}, p.MaxInFlight)
+	}
+	return g
+}
+
+// Acquire waits until the gate admits one request, or until ctx
+// is done. It returns ErrQuotaExhausted if the quota is empty, or
+// the error from Bucket.WaitContext or the context if it gives up.
+// Every successful call must be matched by a call to Release.
+func (g *Gate) Acquire(ctx context.Context) error {
+	if err := g.acquire(ctx); err != nil {
+		g.rejected.Add(1)
+		return err
+	}
+	g.inFlight.Add(1)
+	g.acquired.Add(1)
+	return nil
+}
+
+func (g *Gate) acquire(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	quota, rate := g.params.Quota, g.params.Rate
+	var quotaTaken, rateTaken int64
+	if quota != nil {
+		n, ok := quota.allowTaken(1)
+		if !ok {
+			return ErrQuotaExhausted
+		}
+		quotaTaken = n
+	}
+	if rate != nil {
+		n, err := rate.waitContext(ctx, 1)
+		if err != nil {
+			putBack(quota, quotaTaken)
+			return err
+		}
+		rateTaken = n
+	}
+	if g.slots != nil {
+		select {
+		case g.slots <- struct{}{}:
+		case <-ctx.Done():
+			putBack(quota, quotaTaken)
+			putBack(rate, rateTaken)
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Release releases an acquisition made by Acquire. The rate and
+// quota tokens stay spent; only the in-flight slot is freed.
+func (g *Gate) Release() {
+	if g.inFlight.Add(-1) < 0 {
+		g.inFlight.Add(1)
+		panic("gate released without acquire")
+	}
+	if g.slots != nil {
+		<-g.slots
+	}
+}
+
+// Stats returns statistics about the gate.
+func (g *Gate) Stats() GateStats {
+	return GateStats{
+		InFlight: g.inFlight.Load(),
+		Acquired: g.acquired.Load(),
+		Rejected: g.rejected.Load(),
+	}
+}
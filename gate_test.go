@@ -0,0 +1,61 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type gateSuite struct{}
+
+var _ = gc.Suite(gateSuite{})
+
+func (gateSuite) TestGate(c *gc.C) {
+	rate := NewBucket(time.Hour, 3)
+	quota := NewBucket(24*time.Hour, 4)
+	g := NewGate(GateParams{
+		Rate:        rate,
+		MaxInFlight: 1,
+		Quota:       quota,
+	})
+	ctx := context.Background()
+	c.Assert(g.Acquire(ctx), gc.IsNil)
+	c.Assert(g.Stats(), gc.Equals, GateStats{InFlight: 1, Acquired: 1})
+
+	// Waiting for a slot is abandoned with the context, and
+	// the rate and quota tokens are given back.
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	c.Assert(g.Acquire(tctx), gc.Equals, context.DeadlineExceeded)
+	c.Assert(rate.Available(), gc.Equals, int64(2))
+	c.Assert(quota.Available(), gc.Equals, int64(3))
+
+	g.Release()
+	c.Assert(g.Acquire(ctx), gc.IsNil)
+	g.Release()
+	c.Assert(g.Acquire(ctx), gc.IsNil)
+	g.Release()
+
+	// The rate is exhausted: a wait beyond the deadline is
+	// refused and the quota token given back.
+	tctx, cancel = context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	c.Assert(g.Acquire(tctx), gc.Equals, ErrDeadline)
+	c.Assert(quota.Available(), gc.Equals, int64(1))
+
+	// Once the quota is spent, acquisitions fail at once.
+	rate.SetCapacity(10)
+	rate.refund(rate.clock.Now(), 10)
+	c.Assert(g.Acquire(ctx), gc.IsNil)
+	g.Release()
+	c.Assert(g.Acquire(ctx), gc.Equals, ErrQuotaExhausted)
+	c.Assert(rate.Available(), gc.Equals, int64(9))
+
+	c.Assert(g.Stats(), gc.Equals, GateStats{InFlight: 0, Acquired: 4, Rejected: 3})
+	c.Assert(func() { g.Release() }, gc.PanicMatches, "gate released without acquire")
+}
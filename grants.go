@@ -0,0 +1,165 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import "time"
+
+// GrantSchedule describes blocks of tokens granted to a bucket at
+// particular times, such as for a partner whose quota resets at
+// midnight UTC.
+type GrantSchedule struct {
+	// Count holds the number of tokens granted at each time.
+	// As with refill, the bucket never holds more than its
+	// capacity, but a grant first pays off any debt.
+	Count int64
+
+	// Next returns the first grant time after t. It must
+	// return a time after t. See AlignedEvery.
+	Next func(t time.Time) time.Time
+
+	// NoRefill reports whether the grants replace the bucket's
+	// continuous refill, rather than adding to it. Waits for
+	// tokens then last until the grant that pays for them.
+	NoRefill bool
+}
+
+// AlignedEvery returns a GrantSchedule.Next function that grants
+// at every multiple of d since the zero time, so that, in UTC,
+// time.Hour grants at the top of every hour and 24*time.Hour at
+// every midnight.
+func AlignedEvery(d time.Duration) func(time.Time) time.Time {
+	if d <= 0 {
+		panic("grant interval is not > 0")
+	}
+	return func(t time.Time) time.Time {
+		return t.Truncate(d).Add(d)
+	}
+}
+
+// grantState holds the state of a bucket's grant schedule.
+type grantState struct {
+	GrantSchedule
+
+	// at holds the time of the next grant.
+	at time.Time
+}
+
+// SetGrantSchedule sets the bucket to be granted tokens as described
+// by s, replacing any schedule set before, from the first grant time
+// after now. A nil schedule removes it. While the bucket is paused,
+// grants are skipped.
+func (tb *Bucket) SetGrantSchedule(s *GrantSchedule) {
+	if s != nil && (s.Count <= 0 || s.Next == nil) {
+		panic("grant schedule count is not > 0 or has no next time")
+	}
+	now := tb.clock.Now()
+	tb.mu.Lock()
+	defer tb.unlock()
+	tb.adjust(now)
+	if s == nil {
+		tb.grants = nil
+		return
+	}
+	tb.grants = &grantState{
+		GrantSchedule: *s,
+		at:            s.nextAfter(now),
+	}
+}
+
+// nextAfter returns s.Next(t), checking that it is after t.
+func (s *GrantSchedule) nextAfter(t time.Time) time.Time {
+	next := s.Next(t)
+	if !next.After(t) {
+		panic("grant schedule next time is not after the given time")
+	}
+	return next
+}
+
+// maxGrantSteps bounds the number of times Next is called for
+// one grant or wait calculation, so that a bucket far behind its
+// schedule, or a take far beyond the tokens of one grant, cannot
+// hold the bucket's lock for long. Beyond it, grants are taken
+// to continue at the average interval of the steps so far, which
+// is exact for regular schedules such as AlignedEvery.
+const maxGrantSteps = 1000
+
+// grant adds the tokens for any grants due by now.
+// It must be called with tb.mu held.
+func (tb *Bucket) grant(now time.Time) {
+	g := tb.grants
+	start := g.at
+	for steps := int64(0); !now.Before(g.at); steps++ {
+		if tb.availableTokens >= tb.capacity {
+			// Further grants would be discarded.
+			g.at = g.nextAfter(now)
+			return
+		}
+		if steps == maxGrantSteps {
+			if !tb.paused {
+				interval := g.at.Sub(start) / time.Duration(steps)
+				tb.addGrants(uint64(now.Sub(g.at)/max(interval, 1)) + 1)
+			}
+			g.at = g.nextAfter(now)
+			return
+		}
+		if !tb.paused {
+			tb.addGrants(1)
+		}
+		g.at = g.nextAfter(g.at)
+	}
+}
+
+// addGrants adds the tokens for n grants to the bucket,
+// up to its capacity.
+func (tb *Bucket) addGrants(n uint64) {
+	// The number of missing tokens can exceed the
+	// int64 range when the bucket is deep in debt.
+	missing := uint64(tb.capacity) - uint64(tb.availableTokens)
+	if n >= grantsFor(missing, tb.grants.Count) {
+		tb.availableTokens = tb.capacity
+		return
+	}
+	// The sum is less than the capacity, so wrapping
+	// arithmetic gives the right result.
+	tb.availableTokens = int64(uint64(tb.availableTokens) + n*uint64(tb.grants.Count))
+}
+
+// grantsFor returns the number of grants of
+// count tokens needed to make up missing tokens.
+func grantsFor(missing uint64, count int64) uint64 {
+	n := missing / uint64(count)
+	if missing%uint64(count) != 0 {
+		n++
+	}
+	return n
+}
+
+// grantWait returns how long after now it will be until the
+// bucket's grants bring its token count up to zero from the
+// given negative count.
+func (g *grantState) grantWait(now time.Time, avail int64) time.Duration {
+	n := grantsFor(-uint64(avail), g.Count)
+	// The first grant, at g.at, makes up Count of
+	// the missing tokens, and each one after it
+	// Count more.
+	at := g.at
+	steps := uint64(1)
+	for ; steps < n && steps < maxGrantSteps; steps++ {
+		at = g.nextAfter(at)
+	}
+	wait := at.Sub(now)
+	if steps == n {
+		return wait
+	}
+	interval := at.Sub(g.at) / time.Duration(steps-1)
+	if n-steps > uint64(infinityDuration) {
+		return infinityDuration
+	}
+	rest := mulDuration(int64(n-steps), max(interval, 1))
+	if rest > infinityDuration-wait {
+		return infinityDuration
+	}
+	return wait + rest
+}
@@ -0,0 +1,89 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"math"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type grantsSuite struct{}
+
+var _ = gc.Suite(grantsSuite{})
+
+func (grantsSuite) TestGrantsOnly(c *gc.C) {
+	// 01:46:40 UTC.
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Minute, 10, clock)
+	tb.SetGrantSchedule(&GrantSchedule{
+		Count:    5,
+		Next:     AlignedEvery(time.Hour),
+		NoRefill: true,
+	})
+	c.Assert(tb.Take(10), gc.Equals, time.Duration(0))
+
+	// The debt is paid by the grants at 02:00 and 03:00.
+	c.Assert(tb.Take(7), gc.Equals, time.Hour+13*time.Minute+20*time.Second)
+	clock.Sleep(13*time.Minute + 20*time.Second)
+	c.Assert(tb.Available(), gc.Equals, int64(-2))
+	clock.Sleep(59 * time.Minute)
+	c.Assert(tb.Available(), gc.Equals, int64(-2))
+	clock.Sleep(time.Minute)
+	c.Assert(tb.Available(), gc.Equals, int64(3))
+
+	// Grants, like refill, do not exceed the capacity.
+	clock.Sleep(10 * time.Hour)
+	c.Assert(tb.Available(), gc.Equals, int64(10))
+}
+
+func (grantsSuite) TestGrantsWithRefill(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Minute, 100, clock)
+	tb.SetAvailable(0)
+	tb.SetGrantSchedule(&GrantSchedule{
+		Count: 50,
+		Next:  AlignedEvery(time.Hour),
+	})
+	clock.Sleep(13*time.Minute + 20*time.Second)
+	c.Assert(tb.Available(), gc.Equals, int64(63))
+
+	tb.SetGrantSchedule(nil)
+	clock.Sleep(time.Hour)
+	c.Assert(tb.Available(), gc.Equals, int64(100))
+
+	c.Assert(func() { tb.SetGrantSchedule(&GrantSchedule{Count: 1}) }, gc.PanicMatches, "grant schedule count is not > 0 or has no next time")
+}
+
+func (grantsSuite) TestGrantsHugeTake(c *gc.C) {
+	// 01:46:40 UTC.
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Minute, 10, clock)
+	tb.SetGrantSchedule(&GrantSchedule{
+		Count:    1,
+		Next:     AlignedEvery(time.Hour),
+		NoRefill: true,
+	})
+	tb.SetAvailable(0)
+
+	// The wait is extrapolated from the schedule rather
+	// than found grant by grant.
+	d, ok := tb.TryTake(1 << 20)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(d, gc.Equals, time.Duration(1<<20-1)*time.Hour+13*time.Minute+20*time.Second)
+	d, ok = tb.TryTake(1 << 40)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(d, gc.Equals, infinityDuration)
+	d, ok = tb.TryTake(math.MaxInt64)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(d, gc.Equals, infinityDuration)
+
+	// A bucket deep in debt catches up on a long
+	// absence in bounded time.
+	tb.SetAvailable(-1 << 40)
+	clock.Sleep(10000*time.Hour + 13*time.Minute + 20*time.Second)
+	c.Assert(tb.Available(), gc.Equals, int64(-1<<40+10001))
+}
@@ -0,0 +1,172 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import "sync"
+
+// GroupStats holds aggregate statistics about the
+// buckets in a Group.
+type GroupStats struct {
+	// Buckets holds the number of buckets in the group.
+	Buckets int
+
+	// Rate holds the sum of the buckets' fill rates,
+	// in tokens per second.
+	Rate float64
+
+	// Capacity, Available and Debt hold the sums of the
+	// buckets' capacities, available tokens and debts.
+	Capacity  int64
+	Available int64
+	Debt      int64
+}
+
+// Group holds related buckets, such as all those that limit calls
+// to external APIs, so that they can be controlled together, for
+// example to halve all their rates during an incident.
+type Group struct {
+	name string
+
+	// mu guards the fields below it.
+	mu sync.Mutex
+
+	// buckets holds the buckets in the group, with the rate
+	// each had when it was added.
+	buckets map[*Bucket]float64
+
+	// factor holds the factor set by Scale.
+	factor float64
+}
+
+// NewGroup returns a new empty group with the given name.
+func NewGroup(name string) *Group {
+	return &Group{
+		name:    name,
+		buckets: make(map[*Bucket]float64),
+		factor:  1,
+	}
+}
+
+// Name returns the name of the group.
+func (g *Group) Name() string {
+	return g.name
+}
+
+// Add adds a bucket to the group. Its current rate is taken as
+// its base rate, to which any factor set by Scale is applied
+// immediately.
+func (g *Group) Add(tb *Bucket) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.buckets[tb]; ok {
+		return
+	}
+	base := tb.Rate()
+	g.buckets[tb] = base
+	if g.factor != 1 {
+		tb.SetRate(base * g.factor)
+	}
+}
+
+// Remove removes a bucket from the group, restoring
+// its base rate.
+func (g *Group) Remove(tb *Bucket) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	base, ok := g.buckets[tb]
+	if !ok {
+		return
+	}
+	delete(g.buckets, tb)
+	if g.factor != 1 {
+		tb.SetRate(base)
+	}
+}
+
+// Buckets returns the buckets in the group,
+// in no particular order.
+func (g *Group) Buckets() []*Bucket {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	buckets := make([]*Bucket, 0, len(g.buckets))
+	for tb := range g.buckets {
+		buckets = append(buckets, tb)
+	}
+	return buckets
+}
+
+// Scale sets the rate of every bucket in the group to its base
+// rate multiplied by factor, which must be positive. Scale(0.5)
+// halves all the rates, and Scale(1) restores them.
+func (g *Group) Scale(factor float64) {
+	if !(factor > 0) {
+		panic("group scale factor is not > 0")
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.factor = factor
+	for tb, base := range g.buckets {
+		tb.SetRate(base * factor)
+	}
+}
+
+// Factor returns the factor set by Scale.
+func (g *Group) Factor() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.factor
+}
+
+// Pause pauses every bucket in the group. See Bucket.Pause.
+func (g *Group) Pause() {
+	g.each((*Bucket).Pause)
+}
+
+// Resume resumes every bucket in the group.
+func (g *Group) Resume() {
+	g.each((*Bucket).Resume)
+}
+
+// Disable turns off limiting by every bucket in the group.
+// See Bucket.Disable.
+func (g *Group) Disable() {
+	g.each((*Bucket).Disable)
+}
+
+// Enable turns limiting by every bucket in the group back on.
+func (g *Group) Enable() {
+	g.each((*Bucket).Enable)
+}
+
+// Reset resets every bucket in the group. See Bucket.Reset.
+func (g *Group) Reset() {
+	g.each((*Bucket).Reset)
+}
+
+func (g *Group) each(f func(*Bucket)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for tb := range g.buckets {
+		f(tb)
+	}
+}
+
+// Stats returns aggregate statistics about the
+// buckets in the group.
+func (g *Group) Stats() GroupStats {
+	var s GroupStats
+	g.each(func(tb *Bucket) {
+		avail := tb.Available()
+		s.Buckets++
+		s.Rate += tb.Rate()
+		s.Capacity += tb.Capacity()
+		if avail < 0 {
+			s.Debt -= avail
+		} else {
+			s.Available += avail
+		}
+	})
+	return s
+}
@@ -0,0 +1,107 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type groupSuite struct{}
+
+var _ = gc.Suite(groupSuite{})
+
+func (groupSuite) TestGroup(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	a := NewBucketWithRateAndClock(100, 10, clock)
+	b := NewBucketWithRateAndClock(10, 5, clock)
+	g := NewGroup("external-api")
+	c.Assert(g.Name(), gc.Equals, "external-api")
+	g.Add(a)
+	g.Add(b)
+	g.Add(b)
+	c.Assert(g.Buckets(), gc.HasLen, 2)
+
+	g.Scale(0.5)
+	c.Assert(isCloseTo(a.Rate(), 50, rateMargin), gc.Equals, true)
+	c.Assert(isCloseTo(b.Rate(), 5, rateMargin), gc.Equals, true)
+
+	// Buckets added later are scaled too, and
+	// restored when removed.
+	x := NewBucketWithRateAndClock(20, 1, clock)
+	g.Add(x)
+	c.Assert(isCloseTo(x.Rate(), 10, rateMargin), gc.Equals, true)
+	g.Remove(x)
+	c.Assert(isCloseTo(x.Rate(), 20, rateMargin), gc.Equals, true)
+
+	g.Scale(1)
+	c.Assert(isCloseTo(a.Rate(), 100, rateMargin), gc.Equals, true)
+
+	b.Take(7)
+	s := g.Stats()
+	c.Assert(s.Buckets, gc.Equals, 2)
+	c.Assert(isCloseTo(s.Rate, 110, rateMargin), gc.Equals, true)
+	c.Assert(s.Capacity, gc.Equals, int64(15))
+	c.Assert(s.Available, gc.Equals, int64(10))
+	c.Assert(s.Debt, gc.Equals, int64(2))
+
+	g.Reset()
+	c.Assert(b.Available(), gc.Equals, int64(5))
+}
+
+func (groupSuite) TestPause(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Second, 10, clock)
+	tb.TakeAvailable(8)
+	g := NewGroup("g")
+	g.Add(tb)
+	g.Pause()
+	c.Assert(tb.Paused(), gc.Equals, true)
+
+	// A paused bucket grants nothing and does not refill.
+	clock.Sleep(5 * time.Second)
+	c.Assert(tb.Available(), gc.Equals, int64(2))
+	c.Assert(tb.Allow(1), gc.Equals, false)
+	c.Assert(tb.TakeAvailable(1), gc.Equals, int64(0))
+	_, ok := tb.TakeMaxDuration(1, time.Hour)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(tb.Take(1), gc.Equals, infinityDuration)
+	c.Assert(tb.WaitContext(context.Background(), 1), gc.Equals, ErrPaused)
+	c.Assert(tb.Available(), gc.Equals, int64(2))
+
+	g.Resume()
+	c.Assert(tb.Paused(), gc.Equals, false)
+	c.Assert(tb.Allow(1), gc.Equals, true)
+	clock.Sleep(3 * time.Second)
+	c.Assert(tb.Available(), gc.Equals, int64(4))
+}
+
+func (groupSuite) TestDisable(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Second, 2, clock)
+	g := NewGroup("g")
+	g.Add(tb)
+	g.Disable()
+	c.Assert(tb.Disabled(), gc.Equals, true)
+
+	// While disabled, every take succeeds at once and
+	// takes nothing, even from a paused bucket.
+	tb.Pause()
+	c.Assert(tb.Take(100), gc.Equals, time.Duration(0))
+	c.Assert(tb.Allow(100), gc.Equals, true)
+	c.Assert(tb.TakeAvailable(100), gc.Equals, int64(100))
+	granted, wait := tb.TakeBatch(100)
+	c.Assert(granted, gc.Equals, int64(100))
+	c.Assert(wait, gc.Equals, time.Duration(0))
+	c.Assert(tb.WaitContext(context.Background(), 100), gc.IsNil)
+	c.Assert(tb.Available(), gc.Equals, int64(2))
+	tb.Resume()
+
+	g.Enable()
+	c.Assert(tb.Allow(3), gc.Equals, false)
+	c.Assert(tb.Allow(2), gc.Equals, true)
+}
@@ -0,0 +1,47 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrLimited is returned by limiters that refuse a request
+// because no tokens are available.
+var ErrLimited = errors.New("rate limit exceeded")
+
+// GRPCLimiter implements the Limiter interface used by the ratelimit
+// interceptors in github.com/grpc-ecosystem/go-grpc-middleware/v2,
+// charging each call Cost tokens from an Allower such as a Bucket.
+// It does not depend on that module; any type with a matching Limit
+// method satisfies the interface.
+type GRPCLimiter struct {
+	Allower Allower
+
+	// Cost holds the number of tokens charged per call.
+	// If it is zero, each call costs one token.
+	Cost int64
+}
+
+// NewGRPCLimiter returns a limiter that charges one
+// token per call to a.
+func NewGRPCLimiter(a Allower) *GRPCLimiter {
+	return &GRPCLimiter{Allower: a}
+}
+
+// Limit takes the cost of one call and returns ErrLimited if
+// the tokens are not available. The interceptors reject the call
+// with codes.ResourceExhausted in that case.
+func (l *GRPCLimiter) Limit(ctx context.Context) error {
+	cost := l.Cost
+	if cost == 0 {
+		cost = 1
+	}
+	if !l.Allower.Allow(cost) {
+		return ErrLimited
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+// SetName sets the name of the bucket, so that a process with
+// many buckets can tell them apart when reporting on them.
+// Buckets have no name by default.
+func (tb *Bucket) SetName(name string) {
+	tb.mu.Lock()
+	defer tb.unlock()
+	tb.name = name
+}
+
+// Name returns the name set by SetName.
+func (tb *Bucket) Name() string {
+	tb.mu.Lock()
+	defer tb.unlock()
+	return tb.name
+}
+
+// SetLabels sets key/value labels describing the bucket, such
+// as the service or tenant it limits, replacing any labels set
+// before. The map is copied.
+func (tb *Bucket) SetLabels(labels map[string]string) {
+	tb.mu.Lock()
+	defer tb.unlock()
+	tb.labels = copyLabels(labels)
+}
+
+// Labels returns a copy of the labels set by SetLabels.
+func (tb *Bucket) Labels() map[string]string {
+	tb.mu.Lock()
+	defer tb.unlock()
+	return copyLabels(tb.labels)
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	c := make(map[string]string, len(labels))
+	for k, v := range labels {
+		c[k] = v
+	}
+	return c
+}
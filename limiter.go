@@ -0,0 +1,47 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Allower is implemented by limiters that can admit or refuse
+// a request immediately, without queuing it.
+type Allower interface {
+	// Allow reports whether count tokens were available,
+	// taking them if so.
+	Allow(count int64) bool
+}
+
+// Taker is implemented by limiters that hand out tokens
+// without blocking.
+type Taker interface {
+	// Take takes count tokens and returns the time the
+	// caller should wait until they are available.
+	Take(count int64) time.Duration
+
+	// TakeAvailable takes up to count tokens that are
+	// available immediately and returns how many were taken.
+	TakeAvailable(count int64) int64
+}
+
+// Waiter is implemented by limiters that can block until
+// tokens are available.
+type Waiter interface {
+	// Wait takes count tokens, waiting until they are
+	// available.
+	Wait(count int64)
+
+	// WaitContext is like Wait but gives up when ctx is done.
+	WaitContext(ctx context.Context, count int64) error
+}
+
+var (
+	_ Allower = (*Bucket)(nil)
+	_ Taker   = (*Bucket)(nil)
+	_ Waiter  = (*Bucket)(nil)
+)
@@ -0,0 +1,209 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// LogLimitParams holds the parameters for NewLogHandler.
+type LogLimitParams struct {
+	// Rate and Burst hold the rate, in records per second, and
+	// the burst of records allowed for each key. Both must be
+	// positive.
+	Rate  float64
+	Burst int64
+
+	// Key, if not nil, returns the key under which a record is
+	// limited. By default, records with the same level and
+	// message share a key.
+	Key func(r slog.Record) string
+
+	// MaxKeys holds the number of keys tracked at once. Once it
+	// is reached, keys that have been quiet long enough for
+	// their bucket to refill are forgotten, and if none have,
+	// records with new keys share a single bucket. If it is
+	// zero, 1000 is used.
+	MaxKeys int
+}
+
+// LogHandler is a slog.Handler that limits the rate of similar
+// records passed to another handler, so that a storm of errors
+// cannot saturate disks and log pipelines. When a record is let
+// through after others with the same key were dropped, it is
+// preceded by a summary record saying how many were dropped.
+type LogHandler struct {
+	h     slog.Handler
+	state *logLimitState
+}
+
+// logLimitState holds the state shared by a LogHandler
+// and the handlers derived from it.
+type logLimitState struct {
+	params LogLimitParams
+
+	// mu guards the fields below it.
+	mu       sync.Mutex
+	keys     map[string]*logKey
+	overflow *logKey
+}
+
+// logKey holds the state of the records with one key.
+type logKey struct {
+	tb         *Bucket
+	suppressed int
+}
+
+// NewLogHandler returns a handler that passes records
+// to h, limited according to p.
+func NewLogHandler(h slog.Handler, p LogLimitParams) *LogHandler {
+	if !(p.Rate > 0) || p.Burst <= 0 {
+		panic("log limit rate or burst is not > 0")
+	}
+	if p.Key == nil {
+		p.Key = func(r slog.Record) string {
+			return r.Level.String() + " " + r.Message
+		}
+	}
+	if p.MaxKeys <= 0 {
+		p.MaxKeys = 1000
+	}
+	state := &logLimitState{
+		params: p,
+		keys:   make(map[string]*logKey),
+	}
+	state.overflow = state.newKey()
+	return &LogHandler{
+		h:     h,
+		state: state,
+	}
+}
+
+func (s *logLimitState) newKey() *logKey {
+	return &logKey{
+		tb: NewBucketWithRate(s.params.Rate, s.params.Burst),
+	}
+}
+
+// allow reports whether a record with the given key should be
+// let through and, if so, how many records with the key were
+// dropped since the last one let through.
+func (s *logLimitState) allow(key string) (bool, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := s.keys[key]
+	if k == nil {
+		if len(s.keys) >= s.params.MaxKeys {
+			s.forgetQuiet()
+		}
+		if len(s.keys) < s.params.MaxKeys {
+			k = s.newKey()
+			s.keys[key] = k
+		} else {
+			k = s.overflow
+		}
+	}
+	if !k.tb.Allow(1) {
+		k.suppressed++
+		return false, 0
+	}
+	n := k.suppressed
+	k.suppressed = 0
+	return true, n
+}
+
+// forgetQuiet removes the keys whose buckets are full, as
+// nothing has been dropped or logged with them lately. Called
+// with s.mu held.
+func (s *logLimitState) forgetQuiet() {
+	for key, k := range s.keys {
+		if k.suppressed == 0 && k.tb.Available() >= s.params.Burst {
+			delete(s.keys, key)
+		}
+	}
+}
+
+// Enabled implements slog.Handler.
+func (h *LogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.h.Enabled(ctx, level)
+}
+
+// Handle implements slog.Handler.
+func (h *LogHandler) Handle(ctx context.Context, r slog.Record) error {
+	ok, suppressed := h.state.allow(h.state.params.Key(r))
+	if !ok {
+		return nil
+	}
+	if suppressed > 0 {
+		summary := slog.NewRecord(r.Time, r.Level, fmt.Sprintf("suppressed %d similar messages", suppressed), r.PC)
+		summary.AddAttrs(slog.String("message", r.Message))
+		if err := h.h.Handle(ctx, summary); err != nil {
+			return err
+		}
+	}
+	return h.h.Handle(ctx, r)
+}
+
+// WithAttrs implements slog.Handler. The returned handler
+// shares its limits with h.
+func (h *LogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &LogHandler{
+		h:     h.h.WithAttrs(attrs),
+		state: h.state,
+	}
+}
+
+// WithGroup implements slog.Handler. The returned handler
+// shares its limits with h.
+func (h *LogHandler) WithGroup(name string) slog.Handler {
+	return &LogHandler{
+		h:     h.h.WithGroup(name),
+		state: h.state,
+	}
+}
+
+// NewLogWriter returns a writer that passes writes to w, taking a
+// token from tb for each, and drops those for which no token is
+// available immediately. It suits log output written a line at a
+// time, such as by the log package. When a write is passed on after
+// others were dropped, it is preceded by a line saying how many were
+// dropped. Dropped writes report success, so that loggers do not
+// treat them as errors.
+func NewLogWriter(w io.Writer, tb *Bucket) io.Writer {
+	return &logWriter{
+		w:  w,
+		tb: tb,
+	}
+}
+
+type logWriter struct {
+	w  io.Writer
+	tb *Bucket
+
+	// mu guards suppressed.
+	mu         sync.Mutex
+	suppressed int
+}
+
+// Write implements io.Writer.
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.tb.Allow(1) {
+		w.suppressed++
+		return len(p), nil
+	}
+	if w.suppressed > 0 {
+		if _, err := fmt.Fprintf(w.w, "suppressed %d log writes\n", w.suppressed); err != nil {
+			return 0, err
+		}
+		w.suppressed = 0
+	}
+	return w.w.Write(p)
+}
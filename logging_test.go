@@ -0,0 +1,75 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type loggingSuite struct{}
+
+var _ = gc.Suite(loggingSuite{})
+
+func (loggingSuite) TestLogHandler(c *gc.C) {
+	var buf bytes.Buffer
+	h := NewLogHandler(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}), LogLimitParams{
+		Rate:    1,
+		Burst:   2,
+		MaxKeys: 2,
+	})
+	logger := slog.New(h).With("component", "db")
+	for i := 0; i < 5; i++ {
+		logger.Error("connection failed")
+	}
+	logger.Info("connection failed")
+	c.Assert(buf.String(), gc.Equals, ""+
+		"level=ERROR msg=\"connection failed\" component=db\n"+
+		"level=ERROR msg=\"connection failed\" component=db\n"+
+		"level=INFO msg=\"connection failed\" component=db\n")
+
+	// A new key beyond the maximum shares the overflow bucket.
+	buf.Reset()
+	for i := 0; i < 3; i++ {
+		logger.Warn("disk full")
+	}
+	c.Assert(strings.Count(buf.String(), "disk full"), gc.Equals, 2)
+
+	// The count of dropped records is reported with the next
+	// record let through.
+	buf.Reset()
+	k := h.state.keys["ERROR connection failed"]
+	k.tb.SetCapacity(3)
+	k.tb.putBack(1)
+	logger.Error("connection failed")
+	c.Assert(buf.String(), gc.Equals, ""+
+		"level=ERROR msg=\"suppressed 3 similar messages\" component=db message=\"connection failed\"\n"+
+		"level=ERROR msg=\"connection failed\" component=db\n")
+}
+
+func (loggingSuite) TestLogWriter(c *gc.C) {
+	var buf bytes.Buffer
+	tb := NewBucket(time.Hour, 2)
+	w := NewLogWriter(&buf, tb)
+	for i := 0; i < 4; i++ {
+		n, err := w.Write([]byte("line\n"))
+		c.Assert(err, gc.IsNil)
+		c.Assert(n, gc.Equals, 5)
+	}
+	tb.putBack(1)
+	w.Write([]byte("last\n"))
+	c.Assert(buf.String(), gc.Equals, "line\nline\nsuppressed 2 log writes\nlast\n")
+}
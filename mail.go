@@ -0,0 +1,94 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"context"
+	"strings"
+)
+
+// MailParams holds the parameters for NewMailThrottle.
+type MailParams struct {
+	// Domains holds the policies for particular recipient
+	// domains, keyed by lower case domain name.
+	Domains map[string]BudgetPolicy
+
+	// DefaultDomain, if not nil, holds the policy for each
+	// recipient domain without a policy in Domains. Domains
+	// with no policy at all are not limited.
+	DefaultDomain *BudgetPolicy
+
+	// Rate, if not nil, limits the overall rate of sending.
+	Rate *Bucket
+
+	// Daily, if not nil, holds the daily quota, such as a
+	// bucket that refills once a day. Sends fail immediately
+	// with ErrQuotaExhausted once it is empty.
+	Daily *Bucket
+}
+
+// MailThrottle paces outbound mail the way mail providers limit it,
+// with a limit for each recipient domain, an overall sending rate
+// and a daily quota.
+type MailThrottle struct {
+	domains *BudgetManager
+	rate    *Bucket
+	daily   *Bucket
+}
+
+// NewMailThrottle returns a throttle with the limits in p.
+func NewMailThrottle(p MailParams) *MailThrottle {
+	t := &MailThrottle{
+		domains: NewBudgetManager(p.Domains),
+		rate:    p.Rate,
+		daily:   p.Daily,
+	}
+	if p.DefaultDomain != nil {
+		t.domains.SetDefaultPolicy(*p.DefaultDomain)
+	}
+	return t
+}
+
+// Domains returns the manager holding the budget of
+// each recipient domain.
+func (t *MailThrottle) Domains() *BudgetManager {
+	return t.domains
+}
+
+// Wait waits until a message may be sent to the given recipient
+// address. It returns ErrQuotaExhausted if the daily quota is
+// spent; otherwise, if ctx is done first, or has a deadline before
+// which the message could not be sent, it returns an error as
+// Bucket.WaitContext does. If it returns an error, no tokens
+// remain taken.
+func (t *MailThrottle) Wait(ctx context.Context, recipient string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var dailyTaken int64
+	if t.daily != nil {
+		n, ok := t.daily.allowTaken(1)
+		if !ok {
+			return ErrQuotaExhausted
+		}
+		dailyTaken = n
+	}
+	domain := t.domains.Bucket(recipientDomain(recipient))
+	if err := waitBoth(ctx, domain, 1, t.rate, 1); err != nil {
+		putBack(t.daily, dailyTaken)
+		return err
+	}
+	return nil
+}
+
+// recipientDomain returns the lower case domain
+// of the given mail address.
+func recipientDomain(addr string) string {
+	addr = strings.TrimSuffix(strings.TrimSpace(addr), ">")
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		addr = addr[i+1:]
+	}
+	return strings.ToLower(addr)
+}
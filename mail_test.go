@@ -0,0 +1,59 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type mailSuite struct{}
+
+var _ = gc.Suite(mailSuite{})
+
+func (mailSuite) TestMailThrottle(c *gc.C) {
+	rate := NewBucket(time.Hour, 4)
+	daily := NewBucket(24*time.Hour, 3)
+	t := NewMailThrottle(MailParams{
+		Domains: map[string]BudgetPolicy{
+			"gmail.com": {Rate: 0.001, Capacity: 1},
+		},
+		DefaultDomain: &BudgetPolicy{Rate: 0.001, Capacity: 2},
+		Rate:          rate,
+		Daily:         daily,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c.Assert(t.Wait(ctx, "alice@Gmail.com"), gc.IsNil)
+	c.Assert(t.Wait(ctx, "Bob <bob@gmail.com>"), gc.Equals, ErrDeadline)
+	c.Assert(daily.Available(), gc.Equals, int64(2))
+	c.Assert(rate.Available(), gc.Equals, int64(3))
+
+	// Other domains each get the default policy.
+	c.Assert(t.Wait(ctx, "carol@example.com"), gc.IsNil)
+	n, ok := t.Domains().Remaining("example.com")
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(n, gc.Equals, int64(1))
+	c.Assert(t.Wait(ctx, "dave@example.org"), gc.IsNil)
+
+	// The daily quota is spent.
+	c.Assert(t.Wait(ctx, "erin@example.com"), gc.Equals, ErrQuotaExhausted)
+	c.Assert(rate.Available(), gc.Equals, int64(1))
+	n, _ = t.Domains().Remaining("example.com")
+	c.Assert(n, gc.Equals, int64(1))
+}
+
+func (mailSuite) TestRecipientDomain(c *gc.C) {
+	for addr, domain := range map[string]string{
+		"a@Example.COM":        "example.com",
+		" Bob <b@example.org>": "example.org",
+		"example.net":          "example.net",
+	} {
+		c.Check(recipientDomain(addr), gc.Equals, domain)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+// Marking is the outcome of marking a request with a TwoRateMarker.
+type Marking int
+
+const (
+	// Conform marks a request within the committed rate
+	// (green, in the terms of RFC 2698).
+	Conform Marking = iota
+
+	// Exceed marks a request over the committed rate but
+	// within the peak rate (yellow).
+	Exceed
+
+	// Violate marks a request over the peak rate (red).
+	Violate
+)
+
+var markingNames = []string{
+	Conform: "conform",
+	Exceed:  "exceed",
+	Violate: "violate",
+}
+
+// String returns the name of the marking.
+func (m Marking) String() string {
+	if m >= 0 && int(m) < len(markingNames) {
+		return markingNames[m]
+	}
+	return "unknown"
+}
+
+// TwoRateMarker implements the two rate three color marker of
+// RFC 2698, in its color-blind mode, so that callers can tell a
+// request over a soft limit, the committed rate, from one over
+// a hard limit, the peak rate, and handle each differently.
+type TwoRateMarker struct {
+	committed *Bucket
+	peak      *Bucket
+}
+
+// NewTwoRateMarker returns a marker that uses committed for the
+// committed rate and burst size and peak for the peak rate and
+// burst size. The peak rate should be no less than the committed
+// rate. The two buckets must be distinct.
+func NewTwoRateMarker(committed, peak *Bucket) *TwoRateMarker {
+	if committed == peak {
+		panic("two rate marker buckets are the same")
+	}
+	return &TwoRateMarker{
+		committed: committed,
+		peak:      peak,
+	}
+}
+
+// Mark marks a request costing count tokens. A request that
+// violates the peak rate takes no tokens; one that exceeds the
+// committed rate takes tokens from the peak bucket only; and one
+// that conforms takes tokens from both.
+func (m *TwoRateMarker) Mark(count int64) Marking {
+	// Lock the buckets in order of id, as MultiTake does,
+	// so that concurrent calls cannot deadlock.
+	first, second := m.committed, m.peak
+	if second.id < first.id {
+		first, second = second, first
+	}
+	first.mu.Lock()
+	defer first.unlock()
+	second.mu.Lock()
+	defer second.unlock()
+
+	if _, ok := m.peak.tryTake(m.peak.clock.Now(), count); !ok {
+		return Violate
+	}
+	if _, ok := m.committed.tryTake(m.committed.clock.Now(), count); !ok {
+		return Exceed
+	}
+	return Conform
+}
+
+// Allow marks a request costing count tokens and reports
+// whether it is within the peak rate. It implements Allower.
+func (m *TwoRateMarker) Allow(count int64) bool {
+	return m.Mark(count) != Violate
+}
@@ -0,0 +1,46 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type markerSuite struct{}
+
+var _ = gc.Suite(markerSuite{})
+
+func (markerSuite) TestMark(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	committed := NewBucketWithClock(time.Second, 2, clock)
+	peak := NewBucketWithClock(100*time.Millisecond, 4, clock)
+	m := NewTwoRateMarker(committed, peak)
+
+	var marks []Marking
+	for i := 0; i < 6; i++ {
+		marks = append(marks, m.Mark(1))
+	}
+	c.Assert(marks, gc.DeepEquals, []Marking{
+		Conform, Conform, Exceed, Exceed, Violate, Violate,
+	})
+	c.Assert(committed.Available(), gc.Equals, int64(0))
+	c.Assert(peak.Available(), gc.Equals, int64(0))
+
+	// The peak bucket refills first.
+	clock.Sleep(200 * time.Millisecond)
+	c.Assert(m.Allow(2), gc.Equals, true)
+	c.Assert(m.Allow(1), gc.Equals, false)
+	clock.Sleep(time.Second)
+	c.Assert(m.Mark(1), gc.Equals, Conform)
+}
+
+func (markerSuite) TestMarkingString(c *gc.C) {
+	c.Assert(Exceed.String(), gc.Equals, "exceed")
+	c.Assert(Marking(99).String(), gc.Equals, "unknown")
+	tb := NewBucket(time.Second, 1)
+	c.Assert(func() { NewTwoRateMarker(tb, tb) }, gc.PanicMatches, "two rate marker buckets are the same")
+}
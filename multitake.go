@@ -0,0 +1,93 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// bucketIDs holds the most recently assigned bucket id.
+var bucketIDs atomic.Uint64
+
+// BucketCount holds a number of tokens to take from a bucket.
+type BucketCount struct {
+	Bucket *Bucket
+	Count  int64
+}
+
+// MultiTake takes tokens from several buckets at once, for a
+// request that consumes several resources. It is like
+// TakeMaxDuration applied to each bucket, except that it happens
+// atomically: either the tokens are taken from every bucket, in
+// which case MultiTake returns the longest of the waits and true,
+// or, if any bucket would need a wait longer than maxWait, none
+// are taken and it returns false. Counts for the same bucket given
+// more than once are added together.
+func MultiTake(takes []BucketCount, maxWait time.Duration) (time.Duration, bool) {
+	takes = mergeTakes(takes)
+	// Lock the buckets in order of id, so that concurrent
+	// calls cannot deadlock.
+	for _, t := range takes {
+		t.Bucket.mu.Lock()
+	}
+	defer func() {
+		for i := len(takes) - 1; i >= 0; i-- {
+			takes[i].Bucket.unlock()
+		}
+	}()
+	var wait time.Duration
+	nows := make([]time.Time, len(takes))
+	taken := make([]int64, len(takes))
+	for i, t := range takes {
+		nows[i] = t.Bucket.clock.Now()
+		d, n, ok := t.Bucket.charge(nows[i], t.Count, maxWait)
+		if !ok {
+			// Tokens returned straight after they were
+			// taken restore the bucket exactly.
+			for j, t := range takes[:i] {
+				t.Bucket.refund(nows[j], taken[j])
+			}
+			return 0, false
+		}
+		taken[i] = n
+		if d > wait {
+			wait = d
+		}
+	}
+	return wait, true
+}
+
+// mergeTakes returns the takes with positive counts, sorted by
+// bucket id, with the counts for each bucket added together. A sum
+// too large to represent saturates at math.MaxInt64, which no bucket
+// can grant.
+func mergeTakes(takes []BucketCount) []BucketCount {
+	merged := make([]BucketCount, 0, len(takes))
+	for _, t := range takes {
+		if t.Count > 0 {
+			merged = append(merged, t)
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Bucket.id < merged[j].Bucket.id
+	})
+	n := 0
+	for _, t := range merged {
+		if n > 0 && merged[n-1].Bucket == t.Bucket {
+			if merged[n-1].Count > math.MaxInt64-t.Count {
+				merged[n-1].Count = math.MaxInt64
+			} else {
+				merged[n-1].Count += t.Count
+			}
+			continue
+		}
+		merged[n] = t
+		n++
+	}
+	return merged[:n]
+}
@@ -0,0 +1,60 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"math"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type multiTakeSuite struct{}
+
+var _ = gc.Suite(multiTakeSuite{})
+
+func (multiTakeSuite) TestMultiTake(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	cpu := NewBucketWithClock(time.Second, 4, clock)
+	disk := NewBucketWithClock(time.Millisecond, 10, clock)
+	d, ok := MultiTake([]BucketCount{
+		{cpu, 5},
+		{disk, 5},
+		{disk, 6},
+	}, time.Minute)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(d, gc.Equals, time.Second)
+	c.Assert(cpu.Available(), gc.Equals, int64(-1))
+	c.Assert(disk.Available(), gc.Equals, int64(-1))
+
+	// A take that one bucket cannot satisfy in time
+	// charges none of them.
+	_, ok = MultiTake([]BucketCount{
+		{disk, 1},
+		{cpu, 100},
+	}, time.Minute)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(cpu.Available(), gc.Equals, int64(-1))
+	c.Assert(disk.Available(), gc.Equals, int64(-1))
+
+	d, ok = MultiTake(nil, 0)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(d, gc.Equals, time.Duration(0))
+}
+
+func (multiTakeSuite) TestMultiTakeOverflow(c *gc.C) {
+	a := NewBucket(time.Hour, 10)
+	b := NewBucket(time.Hour, 10)
+	// Counts for the same bucket whose sum overflows are
+	// refused like any other oversized take.
+	_, ok := MultiTake([]BucketCount{
+		{a, 1},
+		{b, math.MaxInt64 / 2},
+		{b, math.MaxInt64/2 + 2},
+	}, infinityDuration)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(a.Available(), gc.Equals, int64(10))
+	c.Assert(b.Available(), gc.Equals, int64(10))
+}
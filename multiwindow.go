@@ -0,0 +1,104 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import "time"
+
+// Window describes a limit of Count tokens per Period,
+// such as 300 requests per minute.
+type Window struct {
+	Count  int64
+	Period time.Duration
+}
+
+// MultiWindowLimiter enforces several limits at once on the same
+// stream of requests, such as 10 per second and 300 per minute and
+// 5000 per hour, in the layered form in which providers commonly
+// publish their limits. Each window is a bucket that holds up to
+// Count tokens and refills at Count per Period.
+type MultiWindowLimiter struct {
+	// buckets holds a bucket for each window. They were created
+	// in order, so they are in order of id.
+	buckets []*Bucket
+}
+
+// NewMultiWindowLimiter returns a limiter that enforces
+// all the given windows.
+func NewMultiWindowLimiter(windows ...Window) *MultiWindowLimiter {
+	return NewMultiWindowLimiterWithClock(nil, windows...)
+}
+
+// NewMultiWindowLimiterWithClock is identical to
+// NewMultiWindowLimiter but injects a testable clock interface.
+func NewMultiWindowLimiterWithClock(clock Clock, windows ...Window) *MultiWindowLimiter {
+	if len(windows) == 0 {
+		panic("multi-window limiter has no windows")
+	}
+	l := &MultiWindowLimiter{
+		buckets: make([]*Bucket, len(windows)),
+	}
+	for i, w := range windows {
+		if w.Count <= 0 || w.Period <= 0 {
+			panic("multi-window limiter window count or period is not > 0")
+		}
+		rate := float64(w.Count) / w.Period.Seconds()
+		l.buckets[i] = NewBucketWithRateAndClock(rate, w.Count, clock)
+	}
+	return l
+}
+
+// Buckets returns the buckets for the windows, in the order
+// the windows were given.
+func (l *MultiWindowLimiter) Buckets() []*Bucket {
+	return append([]*Bucket(nil), l.buckets...)
+}
+
+// Allow takes count tokens from every window if they are all
+// available immediately, and reports whether it did.
+func (l *MultiWindowLimiter) Allow(count int64) bool {
+	_, ok := l.TryTake(count)
+	return ok
+}
+
+// TryTake takes count tokens from every window if they are all
+// available immediately. If any window lacks the tokens, none
+// are taken from any window, and TryTake returns false and the
+// time after which all the windows would allow the take: the
+// longest wait of the most restrictive window, suitable for a
+// Retry-After header.
+func (l *MultiWindowLimiter) TryTake(count int64) (time.Duration, bool) {
+	for _, tb := range l.buckets {
+		tb.mu.Lock()
+	}
+	defer func() {
+		for i := len(l.buckets) - 1; i >= 0; i-- {
+			l.buckets[i].unlock()
+		}
+	}()
+	nows := make([]time.Time, len(l.buckets))
+	taken := make([]int64, len(l.buckets))
+	var wait time.Duration
+	ok := true
+	for i, tb := range l.buckets {
+		nows[i] = tb.clock.Now()
+		d, n, allowed := tb.tryCharge(nows[i], count)
+		taken[i] = n
+		if !allowed {
+			ok = false
+			if d > wait {
+				wait = d
+			}
+		}
+	}
+	if ok {
+		return 0, true
+	}
+	// Tokens returned straight after they were
+	// taken restore the bucket exactly.
+	for i, tb := range l.buckets {
+		tb.refund(nows[i], taken[i])
+	}
+	return wait, false
+}
@@ -0,0 +1,45 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type multiWindowSuite struct{}
+
+var _ = gc.Suite(multiWindowSuite{})
+
+func (multiWindowSuite) TestTryTake(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	l := NewMultiWindowLimiterWithClock(clock,
+		Window{Count: 2, Period: time.Second},
+		Window{Count: 3, Period: time.Minute},
+	)
+	perSecond, perMinute := l.Buckets()[0], l.Buckets()[1]
+
+	c.Assert(l.Allow(2), gc.Equals, true)
+
+	// The per-second window refuses; the per-minute
+	// window keeps its tokens.
+	d, ok := l.TryTake(1)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(d, gc.Equals, 500*time.Millisecond)
+	c.Assert(perMinute.Available(), gc.Equals, int64(1))
+
+	clock.Sleep(time.Second)
+	c.Assert(l.Allow(1), gc.Equals, true)
+
+	// Now both refuse, and the wait is the longer one.
+	d, ok = l.TryTake(2)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(d, gc.Equals, 39*time.Second)
+	c.Assert(perSecond.Available(), gc.Equals, int64(1))
+	c.Assert(perMinute.Available(), gc.Equals, int64(0))
+
+	c.Assert(func() { NewMultiWindowLimiter() }, gc.PanicMatches, "multi-window limiter has no windows")
+}
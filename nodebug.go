@@ -0,0 +1,21 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+//go:build !ratelimitdebug
+
+package ratelimit
+
+// debugInvariants reports whether the package was built
+// with the ratelimitdebug tag.
+const debugInvariants = false
+
+// debugState holds nothing unless the package is built
+// with the ratelimitdebug tag.
+type debugState struct{}
+
+// checkInvariants does nothing unless the package is
+// built with the ratelimitdebug tag.
+func (tb *Bucket) checkInvariants() string {
+	return ""
+}
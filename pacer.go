@@ -0,0 +1,35 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import "time"
+
+// Pacer implements the Limiter interface of go.uber.org/ratelimit
+// with a Bucket, so that code written against that interface can
+// use a Bucket unchanged.
+//
+// The bucket's capacity plays the part of that package's slack: a
+// bucket of capacity 1 paces calls strictly, and a larger capacity
+// lets calls that were delayed catch up with a burst.
+type Pacer struct {
+	tb *Bucket
+}
+
+// NewPacer returns a pacer that takes one token from tb
+// for each call to Take.
+func NewPacer(tb *Bucket) *Pacer {
+	return &Pacer{tb: tb}
+}
+
+// Take blocks until the next call is allowed and returns the
+// time at which it was allowed.
+func (p *Pacer) Take() time.Time {
+	now := p.tb.clock.Now()
+	d := p.tb.Take(1)
+	if d > 0 {
+		p.tb.clock.Sleep(d)
+	}
+	return now.Add(d)
+}
@@ -0,0 +1,85 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import "sort"
+
+// PressureEvent describes a change in the pressure on a bucket,
+// as measured by its debt: the number of tokens owed to callers
+// that are waiting for them.
+type PressureEvent struct {
+	// Level holds the number of thresholds that the debt has
+	// reached. It is zero when the debt is below all of them.
+	Level int
+
+	// Debt holds the debt of the bucket when the level changed.
+	Debt int64
+}
+
+// pressureWatch holds the state of a bucket's pressure watch.
+type pressureWatch struct {
+	thresholds []int64
+	level      int
+	c          chan PressureEvent
+}
+
+// Pressure returns a channel on which an event is sent whenever the
+// bucket's debt reaches, or falls back below, one of the given
+// thresholds. Producers can use it to slow down before they start
+// seeing long waits, and speed up again as the backlog clears.
+//
+// The channel holds only the most recent event: if the receiver falls
+// behind, older events are discarded. Changes are noticed when the
+// bucket is used, so a debt that is paid off by refill alone is
+// reported by the next call on the bucket. Calling Pressure again
+// replaces the thresholds and closes the previous channel.
+func (tb *Bucket) Pressure(thresholds ...int64) <-chan PressureEvent {
+	t := append([]int64(nil), thresholds...)
+	sort.Slice(t, func(i, j int) bool { return t[i] < t[j] })
+	if len(t) == 0 || t[0] <= 0 {
+		panic("pressure thresholds are not > 0")
+	}
+	w := &pressureWatch{
+		thresholds: t,
+		c:          make(chan PressureEvent, 1),
+	}
+	tb.mu.Lock()
+	defer tb.unlock()
+	if tb.pressure != nil {
+		close(tb.pressure.c)
+	}
+	tb.pressure = w
+	tb.adjust(tb.clock.Now())
+	return w.c
+}
+
+// update sends an event if the level for the given
+// token count differs from the current level.
+func (w *pressureWatch) update(avail int64) {
+	var debt int64
+	if avail < 0 {
+		debt = -avail
+	}
+	level := sort.Search(len(w.thresholds), func(i int) bool {
+		return w.thresholds[i] > debt
+	})
+	if level == w.level {
+		return
+	}
+	w.level = level
+	e := PressureEvent{Level: level, Debt: debt}
+	for {
+		select {
+		case w.c <- e:
+			return
+		default:
+		}
+		// Discard the stale event to make room.
+		select {
+		case <-w.c:
+		default:
+		}
+	}
+}
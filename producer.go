@@ -0,0 +1,172 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// ProducerThrottle paces the production of messages, such as to a
+// Kafka producer, with one bucket charged a token per message and
+// another charged a token per byte, so that both the message rate
+// and the bandwidth are limited. It does not depend on any
+// particular client: call Wait or TakeBatch before handing a batch
+// to the producer.
+//
+// A batch is charged in a single call to each bucket, however many
+// messages it holds, so large batches are accounted for
+// accurately and cheaply.
+type ProducerThrottle struct {
+	messages *Bucket
+	bytes    *Bucket
+}
+
+// NewProducerThrottle returns a throttle that charges messages a
+// token per message and bytes a token per byte. Either bucket
+// may be nil, in which case that measure is not limited.
+func NewProducerThrottle(messages, bytes *Bucket) *ProducerThrottle {
+	return &ProducerThrottle{
+		messages: messages,
+		bytes:    bytes,
+	}
+}
+
+// Wait waits until a batch of n messages totalling size bytes
+// may be produced. If ctx is done first, or has a deadline before
+// which the batch would not be allowed, Wait returns an error as
+// Bucket.WaitContext does, and no tokens remain taken.
+func (p *ProducerThrottle) Wait(ctx context.Context, n int, size int64) error {
+	return waitBoth(ctx, p.messages, int64(n), p.bytes, size)
+}
+
+// waitBoth waits until it has taken an tokens from a and bn tokens
+// from b, waiting for both at once. Either bucket may be nil. If ctx
+// is done first, or the tokens would not become available before its
+// deadline or at all, or either bucket refuses the wait, it returns
+// an error as Bucket.WaitContext does, and no tokens remain taken.
+func waitBoth(ctx context.Context, a *Bucket, an int64, b *Bucket, bn int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ad, at, err := takeForWait(ctx, a, an)
+	if err != nil {
+		return err
+	}
+	bd, bt, err := takeForWait(ctx, b, bn)
+	if err != nil {
+		endWait(a, at, ad, true)
+		return err
+	}
+	switch {
+	case ad <= 0 && bd <= 0:
+		return nil
+	case ad >= bd:
+		err = a.sleepContext(ctx, ad)
+	default:
+		err = b.sleepContext(ctx, bd)
+	}
+	endWait(a, at, ad, err != nil)
+	endWait(b, bt, bd, err != nil)
+	return err
+}
+
+// takeForWait takes count tokens from tb, if it is not nil, with
+// takeQueued, for a caller that will wait until ctx is done for
+// them. It returns the wait and the number of tokens actually
+// taken, as Bucket.charge does. The caller must pass both to
+// endWait once it is done waiting.
+func takeForWait(ctx context.Context, tb *Bucket, count int64) (time.Duration, int64, error) {
+	if tb == nil || count <= 0 {
+		return 0, 0, nil
+	}
+	tb.mu.Lock()
+	now := tb.clock.Now()
+	d, taken, ok, err := tb.takeQueued(now, count, maxWaitBefore(ctx, now))
+	if err == nil && !ok {
+		err = tb.waitRefusal(ctx)
+	}
+	tb.unlock()
+	if err != nil {
+		return 0, 0, err
+	}
+	return d, taken, nil
+}
+
+// endWait ends a wait of d for count tokens taken from tb by
+// takeForWait, returning the tokens if failed is true. It does
+// nothing if tb is nil.
+func endWait(tb *Bucket, count int64, d time.Duration, failed bool) {
+	switch {
+	case tb == nil:
+	case d > 0:
+		tb.endWait(count, failed)
+	case failed:
+		putBack(tb, count)
+	}
+}
+
+// putBack returns count tokens to tb, if it is not nil.
+func putBack(tb *Bucket, count int64) {
+	if tb != nil && count > 0 {
+		tb.putBack(count)
+	}
+}
+
+// TakeBatch takes the tokens for a batch of messages with the
+// given sizes in bytes without blocking, as Bucket.TakeBatch does.
+// It returns how many of the messages, from the start of the
+// batch, may be produced immediately, and the time the caller
+// should wait until the rest may be. As with Bucket.Take, the
+// tokens are taken irrevocably.
+func (p *ProducerThrottle) TakeBatch(sizes []int) (granted int, wait time.Duration) {
+	granted = len(sizes)
+	if p.messages != nil {
+		g, d := p.messages.TakeBatch(int64(len(sizes)))
+		granted, wait = int(g), d
+	}
+	if p.bytes != nil {
+		g, d := p.takeBytes(sizes)
+		if g < granted {
+			granted = g
+		}
+		if d > wait {
+			wait = d
+		}
+	}
+	return granted, wait
+}
+
+// takeBytes takes the tokens for messages with the given sizes
+// from the bytes bucket and returns how many of them, from the
+// start, are covered by tokens that were available immediately.
+func (p *ProducerThrottle) takeBytes(sizes []int) (int, time.Duration) {
+	var total int64
+	for _, size := range sizes {
+		total += int64(size)
+	}
+	tb := p.bytes
+	tb.mu.Lock()
+	defer tb.unlock()
+	now := tb.clock.Now()
+	tb.adjust(now)
+	avail := tb.availableTokens
+	wait, ok := tb.take(now, total, infinityDuration)
+	if !ok {
+		return 0, infinityDuration
+	}
+	if tb.disabled || tb.dryRun != nil {
+		return len(sizes), 0
+	}
+	granted := 0
+	for _, size := range sizes {
+		if int64(size) > avail {
+			break
+		}
+		avail -= int64(size)
+		granted++
+	}
+	return granted, wait
+}
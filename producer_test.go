@@ -0,0 +1,93 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type producerSuite struct{}
+
+var _ = gc.Suite(producerSuite{})
+
+func (producerSuite) TestProducerThrottleTakeBatch(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	messages := NewBucketWithClock(time.Second, 3, clock)
+	bytes := NewBucketWithClock(time.Millisecond, 1000, clock)
+	p := NewProducerThrottle(messages, bytes)
+
+	// The bytes run out first.
+	granted, wait := p.TakeBatch([]int{400, 400, 400})
+	c.Assert(granted, gc.Equals, 2)
+	c.Assert(wait, gc.Equals, 200*time.Millisecond)
+
+	// Then the messages.
+	clock.Sleep(time.Second)
+	granted, wait = p.TakeBatch([]int{10, 10})
+	c.Assert(granted, gc.Equals, 1)
+	c.Assert(wait, gc.Equals, time.Second)
+	c.Assert(bytes.Available(), gc.Equals, int64(780))
+
+	granted, wait = NewProducerThrottle(nil, nil).TakeBatch([]int{1, 2})
+	c.Assert(granted, gc.Equals, 2)
+	c.Assert(wait, gc.Equals, time.Duration(0))
+}
+
+func (producerSuite) TestProducerThrottleWait(c *gc.C) {
+	messages := NewBucket(time.Hour, 10)
+	bytes := NewBucket(time.Millisecond, 100)
+	p := NewProducerThrottle(messages, bytes)
+	ctx := context.Background()
+
+	start := time.Now()
+	c.Assert(p.Wait(ctx, 2, 120), gc.IsNil)
+	if d := time.Since(start); d < 20*time.Millisecond {
+		c.Errorf("batch allowed after %v, want at least 20ms", d)
+	}
+	c.Assert(messages.Available(), gc.Equals, int64(8))
+
+	// A batch that cannot be allowed in time takes nothing.
+	tctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	c.Assert(p.Wait(tctx, 9, 10), gc.Equals, ErrDeadline)
+	c.Assert(p.Wait(tctx, 1, 1e9), gc.Equals, ErrDeadline)
+	c.Assert(messages.Available(), gc.Equals, int64(8))
+}
+
+func (producerSuite) TestProducerThrottleWaitRefused(c *gc.C) {
+	messages := NewBucket(time.Hour, 10)
+	bytes := NewBucket(time.Hour, 100)
+	p := NewProducerThrottle(messages, bytes)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Waits that can never end are refused at once.
+	c.Assert(p.Wait(ctx, 1, 1<<62), gc.Equals, ErrTakeTooLarge)
+	c.Assert(messages.Available(), gc.Equals, int64(10))
+	bytes.Pause()
+	c.Assert(p.Wait(ctx, 1, 1), gc.Equals, ErrPaused)
+	c.Assert(messages.Available(), gc.Equals, int64(10))
+	bytes.Resume()
+
+	// The buckets' limits on waiters hold.
+	bytes.SetMaxWaiters(1)
+	done := make(chan error)
+	go func() {
+		done <- p.Wait(ctx, 1, 101)
+	}()
+	for bytes.Debt() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(p.Wait(ctx, 1, 1), gc.Equals, ErrQueueFull)
+	c.Assert(messages.Available(), gc.Equals, int64(9))
+	cancel()
+	c.Assert(<-done, gc.Equals, context.Canceled)
+	c.Assert(bytes.waiters, gc.Equals, 0)
+	c.Assert(messages.Available(), gc.Equals, int64(10))
+	c.Assert(bytes.Available(), gc.Equals, int64(100))
+}
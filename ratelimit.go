@@ -8,6 +8,9 @@
 package ratelimit
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"math"
 	"strconv"
 	"sync"
@@ -42,8 +45,17 @@ import (
 // Bucket represents a token bucket that fills at a predetermined rate.
 // Methods on Bucket may be called concurrently.
 type Bucket struct {
+	// id uniquely identifies the bucket, giving the order in
+	// which MultiTake locks buckets.
+	id uint64
+
 	clock Clock
 
+	// name and labels identify the bucket to people. They
+	// are guarded by mu. See SetName and SetLabels.
+	name   string
+	labels map[string]string
+
 	// startTime holds the moment when the bucket was
 	// first created and ticks began.
 	startTime time.Time
@@ -70,6 +82,60 @@ type Bucket struct {
 	// latestTick holds the latest tick for which
 	// we know the number of tokens in the bucket.
 	latestTick int64
+
+	// ramp holds the rate transition in progress, if any.
+	ramp *rateRamp
+
+	// pressure holds the pressure watch set by Pressure, if any.
+	pressure *pressureWatch
+
+	// grace holds the number of tokens that may be borrowed
+	// by the non-queuing take methods. See SetGrace.
+	grace int64
+
+	// delay holds the delay target set by SetDelayTarget, if any.
+	delay *delayControl
+
+	// grants holds the schedule set by SetGrantSchedule, if any.
+	grants *grantState
+
+	// paused reports whether the bucket is paused.
+	// See Pause.
+	paused bool
+
+	// disabled reports whether limiting is turned off.
+	// See Disable.
+	disabled bool
+
+	// dryRun holds the state of dry-run mode, if it is on.
+	// See SetDryRun.
+	dryRun *dryRun
+
+	// maxWaiters holds the maximum number of callers that
+	// may be waiting for tokens, or zero if there is no
+	// limit. See SetMaxWaiters.
+	maxWaiters int
+
+	// waiters holds the number of callers currently waiting
+	// in WaitContext, WaitMaxDuration or RateLimiter.WaitN.
+	waiters int
+
+	// throttles holds the bucket's recent throttle events,
+	// if it is registered with an Admin.
+	throttles *throttleLog
+
+	// debug holds the state kept by checkInvariants in
+	// debug builds.
+	debug debugState
+}
+
+// rateRamp describes a linear transition of the fill rate
+// from one value to another.
+type rateRamp struct {
+	startTime time.Time
+	duration  time.Duration
+	fromRate  float64
+	toRate    float64
 }
 
 // NewBucket returns a new token bucket that fills at the
@@ -102,18 +168,63 @@ func NewBucketWithRate(rate float64, capacity int64) *Bucket {
 // NewBucketWithRateAndClock is identical to NewBucketWithRate but injects a
 // testable clock interface.
 func NewBucketWithRateAndClock(rate float64, capacity int64, clock Clock) *Bucket {
-	// Use the same bucket each time through the loop
-	// to save allocations.
-	tb := NewBucketWithQuantumAndClock(1, capacity, 1, clock)
+	fillInterval, quantum := rateParams(rate)
+	return NewBucketWithQuantumAndClock(fillInterval, capacity, quantum, clock)
+}
+
+// Limit defines a fill rate in tokens per second. It has the same
+// meaning as the Limit type in golang.org/x/time/rate, so that
+// limits expressed in that package's terms can be used here
+// unchanged.
+type Limit float64
+
+// Inf is the infinite rate limit. No bucket can be created
+// with an infinite limit; it is defined for compatibility
+// with golang.org/x/time/rate.
+const Inf = Limit(math.MaxFloat64)
+
+// Every converts a minimum time interval between tokens to a Limit.
+// A non-positive interval yields Inf.
+func Every(interval time.Duration) Limit {
+	if interval <= 0 {
+		return Inf
+	}
+	return 1 / Limit(interval.Seconds())
+}
+
+// NewBucketWithLimit is like NewBucketWithRate but takes
+// the rate as a Limit.
+func NewBucketWithLimit(limit Limit, capacity int64) *Bucket {
+	return NewBucketWithLimitAndClock(limit, capacity, nil)
+}
+
+// NewBucketWithLimitAndClock is identical to NewBucketWithLimit
+// but injects a testable clock interface.
+func NewBucketWithLimitAndClock(limit Limit, capacity int64, clock Clock) *Bucket {
+	if limit == Inf {
+		panic("token bucket limit is infinite")
+	}
+	return NewBucketWithRateAndClock(float64(limit), capacity, clock)
+}
+
+// minRate and maxRate bound the rates, in tokens per second,
+// for which rateParams can find a fill interval and quantum,
+// with room to spare.
+const (
+	minRate = 1e-9
+	maxRate = 1e18
+)
+
+// rateParams returns a fill interval and quantum that
+// together approximate the given rate to within rateMargin.
+func rateParams(rate float64) (time.Duration, int64) {
 	for quantum := int64(1); quantum < 1<<50; quantum = nextQuantum(quantum) {
 		fillInterval := time.Duration(1e9 * float64(quantum) / rate)
 		if fillInterval <= 0 {
 			continue
 		}
-		tb.fillInterval = fillInterval
-		tb.quantum = quantum
-		if diff := math.Abs(tb.Rate() - rate); diff/rate <= rateMargin {
-			return tb
+		if diff := math.Abs(tickRate(fillInterval, quantum) - rate); diff/rate <= rateMargin {
+			return fillInterval, quantum
 		}
 	}
 	panic("cannot find suitable quantum for " + strconv.FormatFloat(rate, 'g', -1, 64))
@@ -154,6 +265,7 @@ func NewBucketWithQuantumAndClock(fillInterval time.Duration, capacity, quantum
 		panic("token bucket quantum is not > 0")
 	}
 	return &Bucket{
+		id:              bucketIDs.Add(1),
 		clock:           clock,
 		startTime:       clock.Now(),
 		latestTick:      0,
@@ -164,27 +276,298 @@ func NewBucketWithQuantumAndClock(fillInterval time.Duration, capacity, quantum
 	}
 }
 
+// unlock checks the bucket's invariants, when built with the
+// ratelimitdebug tag, reports any change in pressure, unlocks
+// tb.mu and then reports any dry-run events. If an invariant
+// does not hold, it panics after unlocking tb.mu.
+func (tb *Bucket) unlock() {
+	violation := tb.checkInvariants()
+	if tb.pressure != nil {
+		tb.pressure.update(tb.availableTokens)
+	}
+	var events []DryRunEvent
+	var report func(DryRunEvent)
+	if tb.dryRun != nil && len(tb.dryRun.pending) > 0 {
+		events, report = tb.dryRun.pending, tb.dryRun.report
+		tb.dryRun.pending = nil
+	}
+	tb.mu.Unlock()
+	if violation != "" {
+		panic(violation)
+	}
+	for _, e := range events {
+		report(e)
+	}
+}
+
 // Wait takes count tokens from the bucket, waiting until they are
 // available.
+//
+// Waiters are served in arrival order: each call's wake-up time is
+// fixed when it takes its tokens, and is never earlier than that of
+// any call that took tokens before it, so a later caller cannot
+// overtake an earlier one however the goroutines are scheduled.
 func (tb *Bucket) Wait(count int64) {
 	if d := tb.Take(count); d > 0 {
 		tb.clock.Sleep(d)
 	}
 }
 
+// WaitContext is like Wait except that it returns early with the
+// context's error if ctx is done before the tokens become available.
+// In that case the tokens are returned to the bucket, so that an
+// abandoned wait does not delay later callers. If ctx is already
+// done, no tokens are taken. If ctx has a deadline before which the
+// tokens would not become available, WaitContext returns ErrDeadline
+// immediately, without taking any tokens.
+// Likewise, if it would have to wait but too many callers are
+// already waiting (see SetMaxWaiters), it returns ErrQueueFull, and
+// if the wait is refused by the delay target (see SetDelayTarget),
+// it returns ErrQueueDelay. If the tokens can never become
+// available, it returns ErrPaused or ErrTakeTooLarge immediately,
+// as TakeContext does.
+func (tb *Bucket) WaitContext(ctx context.Context, count int64) error {
+	_, err := tb.waitContext(ctx, count)
+	return err
+}
+
+// waitContext is like WaitContext but also returns the number
+// of tokens actually taken, as charge does.
+func (tb *Bucket) waitContext(ctx context.Context, count int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	tb.mu.Lock()
+	now := tb.clock.Now()
+	d, taken, ok, err := tb.takeQueued(now, count, maxWaitBefore(ctx, now))
+	if err == nil && !ok {
+		err = tb.waitRefusal(ctx)
+	}
+	tb.unlock()
+	if err != nil {
+		return 0, err
+	}
+	if err := tb.waitTaken(ctx, taken, d); err != nil {
+		return 0, err
+	}
+	return taken, nil
+}
+
+// ErrDeadline is returned when the requested tokens would not
+// become available before the deadline of the caller's context.
+var ErrDeadline = errors.New("tokens not available before context deadline")
+
+// TakeContext is like Take except that it takes the caller's
+// deadline into account: if ctx has a deadline before which the
+// tokens would not become available, it takes no tokens and returns
+// ErrDeadline, so that no tokens are spent on a request that will
+// time out anyway. If ctx is already done, it takes no tokens and
+// returns the context's error. Where Take would return the longest
+// possible duration, TakeContext takes no tokens and returns
+// ErrPaused or ErrTakeTooLarge.
+func (tb *Bucket) TakeContext(ctx context.Context, count int64) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	tb.mu.Lock()
+	defer tb.unlock()
+	d, ok := tb.takeBefore(ctx, tb.clock.Now(), count)
+	if !ok {
+		return 0, tb.waitRefusal(ctx)
+	}
+	return d, nil
+}
+
+// waitRefusal returns the error for a take refused with the
+// maximum wait set by the deadline of ctx, if it has one: either
+// ErrDeadline or, if the tokens can never become available, the
+// error returned by refusal. It must be called with tb.mu held.
+func (tb *Bucket) waitRefusal(ctx context.Context) error {
+	if _, hasDeadline := ctx.Deadline(); hasDeadline && !tb.paused {
+		return ErrDeadline
+	}
+	return tb.refusal()
+}
+
+// takeBefore is like take with a maximum wait that ends at
+// the deadline of ctx, if it has one.
+func (tb *Bucket) takeBefore(ctx context.Context, now time.Time, count int64) (time.Duration, bool) {
+	return tb.take(now, count, maxWaitBefore(ctx, now))
+}
+
+// maxWaitBefore returns the time from now until the
+// deadline of ctx, if it has one.
+func maxWaitBefore(ctx context.Context, now time.Time) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return deadline.Sub(now)
+	}
+	return infinityDuration
+}
+
+// ErrQueueFull is returned when a caller would have to wait
+// for tokens but the maximum number of callers set by
+// SetMaxWaiters are already waiting.
+var ErrQueueFull = errors.New("too many callers waiting for tokens")
+
+// takeQueued is like take for a caller that will wait for the
+// tokens with waitTaken. If the caller must wait, it is counted
+// among the bucket's waiters, unless there are already too many
+// or the wait is refused by the delay target, in which case
+// nothing is taken and ErrQueueFull or ErrQueueDelay is returned.
+func (tb *Bucket) takeQueued(now time.Time, count int64, maxWait time.Duration) (time.Duration, int64, bool, error) {
+	if tb.refusesWaits() {
+		tb.adjust(now)
+		return 0, 0, false, ErrPaused
+	}
+	full := tb.maxWaiters > 0 && tb.waiters >= tb.maxWaiters
+	if full {
+		maxWait = 0
+	}
+	d, taken, ok := tb.charge(now, count, maxWait)
+	if !ok && full {
+		return 0, 0, false, ErrQueueFull
+	}
+	if ok && tb.delay != nil && !tb.delay.admit(now, d) {
+		tb.refund(now, taken)
+		return 0, 0, false, ErrQueueDelay
+	}
+	if d > 0 {
+		tb.waiters++
+	}
+	return d, taken, ok, nil
+}
+
+// waitTaken waits for the duration d after count tokens have been
+// taken by takeQueued, returning the tokens to the bucket if ctx is
+// done first.
+func (tb *Bucket) waitTaken(ctx context.Context, count int64, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	err := tb.sleepContext(ctx, d)
+	tb.endWait(count, err != nil)
+	return err
+}
+
+// endWait ends a wait for count tokens taken by takeQueued with
+// a non-zero wait, returning the tokens to the bucket if the wait
+// failed.
+func (tb *Bucket) endWait(count int64, failed bool) {
+	tb.mu.Lock()
+	defer tb.unlock()
+	tb.waiters--
+	if failed {
+		tb.refund(tb.clock.Now(), count)
+	}
+}
+
+// sleepContext sleeps for the duration d, returning early with
+// the context's error if ctx is done first.
+func (tb *Bucket) sleepContext(ctx context.Context, d time.Duration) error {
+	if ctx.Done() == nil {
+		// The context can never be done.
+		tb.clock.Sleep(d)
+		return nil
+	}
+	if _, ok := tb.clock.(realClock); ok {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	// An arbitrary clock cannot be interrupted, so leave
+	// it sleeping in the background.
+	done := make(chan struct{})
+	go func() {
+		tb.clock.Sleep(d)
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// putBack is like refund but acquires the lock.
+func (tb *Bucket) putBack(count int64) {
+	tb.mu.Lock()
+	defer tb.unlock()
+	tb.refund(tb.clock.Now(), count)
+}
+
+// refund returns count tokens, previously taken, to the bucket.
+// Refill that has happened since the tokens were taken went towards
+// paying for them, so returning all of them restores the count the
+// bucket would have had without the take, up to its capacity.
+func (tb *Bucket) refund(now time.Time, count int64) {
+	if count <= 0 {
+		return
+	}
+	tb.adjust(now)
+	if tb.availableTokens >= 0 && count >= tb.capacity-tb.availableTokens {
+		tb.availableTokens = tb.capacity
+		return
+	}
+	tb.availableTokens += count
+	if tb.availableTokens > tb.capacity {
+		tb.availableTokens = tb.capacity
+	}
+}
+
 // WaitMaxDuration is like Wait except that it will
 // only take tokens from the bucket if it needs to wait
 // for no greater than maxWait. It reports whether
 // any tokens have been removed from the bucket
 // If no tokens have been removed, it returns immediately.
+//
+// It also returns false without taking any tokens if it
+// would have to wait but too many callers are already
+// waiting (see SetMaxWaiters), or if the wait is refused
+// by the delay target (see SetDelayTarget).
 func (tb *Bucket) WaitMaxDuration(count int64, maxWait time.Duration) bool {
-	d, ok := tb.TakeMaxDuration(count, maxWait)
-	if d > 0 {
-		tb.clock.Sleep(d)
+	tb.mu.Lock()
+	d, taken, ok, _ := tb.takeQueued(tb.clock.Now(), count, maxWait)
+	tb.unlock()
+	if ok {
+		tb.waitTaken(context.Background(), taken, d)
 	}
 	return ok
 }
 
+// TakeChan takes count tokens from the bucket without blocking, as
+// Take does, and returns a channel that is closed when the tokens
+// become available. This allows callers to wait for tokens in a
+// select statement alongside other events such as context
+// cancellation.
+//
+// As with Take, the tokens are taken irrevocably, even if the
+// caller stops waiting on the channel. If Take would refuse the
+// take, such as when the bucket is paused, no tokens are taken and
+// the channel is never closed, so the caller should also select on
+// some other event, such as the done channel of a context.
+func (tb *Bucket) TakeChan(count int64) <-chan struct{} {
+	ch := make(chan struct{})
+	d := tb.Take(count)
+	if d == infinityDuration {
+		return ch
+	}
+	if d <= 0 {
+		close(ch)
+		return ch
+	}
+	go func() {
+		tb.clock.Sleep(d)
+		close(ch)
+	}()
+	return ch
+}
+
 const infinityDuration time.Duration = 0x7fffffffffffffff
 
 // Take takes count tokens from the bucket without blocking. It returns
@@ -193,13 +576,57 @@ const infinityDuration time.Duration = 0x7fffffffffffffff
 //
 // Note that if the request is irrevocable - there is no way to return
 // tokens to the bucket once this method commits us to taking them.
+//
+// If taking count tokens would put the bucket further into debt than
+// an int64 can represent, or mean a wait longer than a time.Duration
+// can represent, or if the bucket is paused, no tokens are taken and
+// Take returns the longest possible duration. Take returns that
+// duration only when it takes no tokens.
 func (tb *Bucket) Take(count int64) time.Duration {
 	tb.mu.Lock()
-	defer tb.mu.Unlock()
-	d, _ := tb.take(tb.clock.Now(), count, infinityDuration)
+	defer tb.unlock()
+	d, ok := tb.take(tb.clock.Now(), count, infinityDuration)
+	if !ok {
+		return infinityDuration
+	}
 	return d
 }
 
+// ErrTakeTooLarge is returned when a take is refused because the
+// debt or the wait it would incur is too large to represent.
+var ErrTakeTooLarge = errors.New("take too large for token bucket")
+
+// ErrExceedsCapacity is the error returned, wrapped with more
+// detail, when more tokens are requested than the bucket can hold.
+var ErrExceedsCapacity = errors.New("exceeds bucket capacity")
+
+// TakeWithinCapacity is like Take except that if count is greater
+// than the capacity of the bucket it takes no tokens and returns an
+// error satisfying errors.Is(err, ErrExceedsCapacity). Such a take
+// can never be satisfied from a full bucket, and with Take it would
+// put the bucket into debt and delay every other caller behind it.
+// Where Take would return the longest possible duration,
+// TakeWithinCapacity takes no tokens and returns ErrPaused or
+// ErrTakeTooLarge.
+func (tb *Bucket) TakeWithinCapacity(count int64) (time.Duration, error) {
+	tb.mu.Lock()
+	defer tb.unlock()
+	return tb.takeWithinCapacity(tb.clock.Now(), count)
+}
+
+// takeWithinCapacity is the internal version of TakeWithinCapacity - it
+// takes the current time as an argument to enable easy testing.
+func (tb *Bucket) takeWithinCapacity(now time.Time, count int64) (time.Duration, error) {
+	if count > tb.capacity {
+		return 0, fmt.Errorf("take of %d tokens %w (%d)", count, ErrExceedsCapacity, tb.capacity)
+	}
+	d, ok := tb.take(now, count, infinityDuration)
+	if !ok {
+		return 0, tb.refusal()
+	}
+	return d, nil
+}
+
 // TakeMaxDuration is like Take, except that
 // it will only take tokens from the bucket if the wait
 // time for the tokens is no greater than maxWait.
@@ -211,36 +638,237 @@ func (tb *Bucket) Take(count int64) time.Duration {
 // true.
 func (tb *Bucket) TakeMaxDuration(count int64, maxWait time.Duration) (time.Duration, bool) {
 	tb.mu.Lock()
-	defer tb.mu.Unlock()
+	defer tb.unlock()
 	return tb.take(tb.clock.Now(), count, maxWait)
 }
 
+// TakeBatch takes count tokens from the bucket without blocking,
+// as Take does, for a batch of count items that each need one
+// token. It returns how many of the items can proceed immediately
+// and the time the caller should wait until the tokens for the
+// remaining items are available. This lets a producer account
+// for a whole queue of items with a single call rather than
+// calling Take once per item.
+//
+// As with Take, the tokens are taken irrevocably.
+func (tb *Bucket) TakeBatch(count int64) (granted int64, wait time.Duration) {
+	tb.mu.Lock()
+	defer tb.unlock()
+	return tb.takeBatch(tb.clock.Now(), count)
+}
+
+// takeBatch is the internal version of TakeBatch - it takes the
+// current time as an argument to enable easy testing.
+func (tb *Bucket) takeBatch(now time.Time, count int64) (int64, time.Duration) {
+	if count <= 0 {
+		return 0, 0
+	}
+	tb.adjust(now)
+	granted := count
+	if granted > tb.availableTokens && !tb.disabled && tb.dryRun == nil {
+		granted = tb.availableTokens
+	}
+	if granted < 0 {
+		granted = 0
+	}
+	wait, ok := tb.take(now, count, infinityDuration)
+	if !ok {
+		return 0, infinityDuration
+	}
+	return granted, wait
+}
+
+// Allow takes count tokens from the bucket if they are all
+// available immediately, and reports whether it did. It is
+// equivalent to TryTake, discarding the wait.
+func (tb *Bucket) Allow(count int64) bool {
+	_, ok := tb.TryTake(count)
+	return ok
+}
+
+// TryTake takes count tokens from the bucket only if they are all
+// available immediately, in which case it returns zero and true.
+// Otherwise it takes nothing and returns false along with the time
+// it would be until the tokens became available. Unlike Take,
+// TryTake never puts the bucket into debt beyond its grace (see
+// SetGrace), so callers that use only TryTake and TakeAvailable
+// never queue behind one another.
+func (tb *Bucket) TryTake(count int64) (time.Duration, bool) {
+	tb.mu.Lock()
+	defer tb.unlock()
+	return tb.tryTake(tb.clock.Now(), count)
+}
+
+// tryTake is the internal version of TryTake - it takes the
+// current time as an argument to enable easy testing.
+func (tb *Bucket) tryTake(now time.Time, count int64) (time.Duration, bool) {
+	d, _, ok := tb.tryCharge(now, count)
+	return d, ok
+}
+
+// tryCharge is like tryTake but also returns the number of
+// tokens actually taken, as charge does.
+func (tb *Bucket) tryCharge(now time.Time, count int64) (time.Duration, int64, bool) {
+	d, ok := tb.enforceTryTake(now, count)
+	taken := count
+	if !ok || tb.disabled || count <= 0 {
+		taken = 0
+	}
+	if !ok {
+		tb.throttled(now, count, d, true)
+		if tb.dryRun != nil {
+			tb.wouldLimit(count, d, true)
+			return 0, taken, true
+		}
+	}
+	return d, taken, ok
+}
+
+// allowTaken is like Allow but also returns the number of tokens
+// actually taken, as charge does, for a caller that may back out
+// and return them with putBack.
+func (tb *Bucket) allowTaken(count int64) (int64, bool) {
+	tb.mu.Lock()
+	defer tb.unlock()
+	_, taken, ok := tb.tryCharge(tb.clock.Now(), count)
+	return taken, ok
+}
+
+// enforceTryTake implements tryTake, ignoring dry-run mode.
+func (tb *Bucket) enforceTryTake(now time.Time, count int64) (time.Duration, bool) {
+	if count <= 0 {
+		return 0, true
+	}
+	tick := tb.adjust(now)
+	if tb.disabled {
+		return 0, true
+	}
+	if tb.paused {
+		return infinityDuration, false
+	}
+	if tb.availableTokens < math.MinInt64+1+count {
+		return infinityDuration, false
+	}
+	avail := tb.availableTokens - count
+	if avail < -tb.grace {
+		return tb.waitTime(now, tick, avail+tb.grace), false
+	}
+	tb.availableTokens = avail
+	return 0, true
+}
+
 // TakeAvailable takes up to count immediately available tokens from the
 // bucket. It returns the number of tokens removed, or zero if there are
 // no available tokens. It does not block.
 func (tb *Bucket) TakeAvailable(count int64) int64 {
 	tb.mu.Lock()
-	defer tb.mu.Unlock()
+	defer tb.unlock()
 	return tb.takeAvailable(tb.clock.Now(), count)
 }
 
 // takeAvailable is the internal version of TakeAvailable - it takes the
 // current time as an argument to enable easy testing.
 func (tb *Bucket) takeAvailable(now time.Time, count int64) int64 {
+	got := tb.enforceTakeAvailable(now, count)
+	if got < count {
+		tb.throttled(now, count, 0, true)
+		if tb.dryRun != nil {
+			tb.wouldLimit(count, 0, true)
+			return count
+		}
+	}
+	return got
+}
+
+// enforceTakeAvailable implements takeAvailable,
+// ignoring dry-run mode.
+func (tb *Bucket) enforceTakeAvailable(now time.Time, count int64) int64 {
 	if count <= 0 {
 		return 0
 	}
-	tb.adjustavailableTokens(tb.currentTick(now))
-	if tb.availableTokens <= 0 {
+	tb.adjust(now)
+	if tb.disabled {
+		return count
+	}
+	avail := tb.availableTokens + tb.grace
+	if avail <= 0 || tb.paused {
 		return 0
 	}
-	if count > tb.availableTokens {
-		count = tb.availableTokens
+	if count > avail {
+		count = avail
 	}
 	tb.availableTokens -= count
 	return count
 }
 
+// TakeAtLeast takes as many immediately available tokens as it can,
+// up to max, but only if at least min are available; otherwise it
+// takes none. It returns the number of tokens taken and whether any
+// were. This suits batch senders that can use any amount between
+// min and max but would rather wait than send less than min. Like
+// TakeAvailable, it does not block.
+func (tb *Bucket) TakeAtLeast(min, max int64) (int64, bool) {
+	tb.mu.Lock()
+	defer tb.unlock()
+	return tb.takeAtLeast(tb.clock.Now(), min, max)
+}
+
+// takeAtLeast is the internal version of TakeAtLeast - it takes the
+// current time as an argument to enable easy testing.
+func (tb *Bucket) takeAtLeast(now time.Time, min, max int64) (int64, bool) {
+	if max <= 0 || min > max {
+		return 0, false
+	}
+	tb.adjust(now)
+	if min > 0 && tb.availableTokens+tb.grace < min && !tb.disabled {
+		tb.throttled(now, min, 0, true)
+		if tb.dryRun == nil {
+			return 0, false
+		}
+		tb.wouldLimit(min, 0, true)
+		tb.enforceTakeAvailable(now, max)
+		return max, true
+	}
+	got := tb.takeAvailable(now, max)
+	return got, got > 0
+}
+
+// SetGrace sets the number of tokens that TryTake, Allow and
+// TakeAvailable may borrow from future refill once the bucket is
+// empty, which softens the cliff at exactly the limit: a caller
+// that slightly exceeds it is let through, and repays the
+// borrowed tokens from subsequent refill before any more are
+// available. The grace must be between zero, the default, and
+// the bucket's capacity; if the capacity is later reduced below
+// it, the grace is reduced to match.
+func (tb *Bucket) SetGrace(grace int64) {
+	tb.mu.Lock()
+	defer tb.unlock()
+	if grace < 0 || grace > tb.capacity {
+		panic("token bucket grace is not between 0 and capacity")
+	}
+	tb.grace = grace
+}
+
+// SetMaxWaiters sets the maximum number of callers that may be
+// waiting for tokens in WaitContext, WaitMaxDuration and
+// RateLimiter.WaitN at any one time. Once that many are waiting,
+// further calls that would have to wait fail immediately without
+// taking any tokens: WaitContext and RateLimiter.WaitN return
+// ErrQueueFull and WaitMaxDuration returns false. Calls that need
+// not wait still succeed. Zero, the default, means no limit.
+//
+// Wait, which cannot fail, and TakeChan are neither limited
+// nor counted.
+func (tb *Bucket) SetMaxWaiters(n int) {
+	tb.mu.Lock()
+	defer tb.unlock()
+	if n < 0 {
+		panic("token bucket max waiters is not >= 0")
+	}
+	tb.maxWaiters = n
+}
+
 // Available returns the number of available tokens. It will be negative
 // when there are consumers waiting for tokens. Note that if this
 // returns greater than zero, it does not guarantee that calls that take
@@ -255,49 +883,391 @@ func (tb *Bucket) Available() int64 {
 // an argument to enable easy testing.
 func (tb *Bucket) available(now time.Time) int64 {
 	tb.mu.Lock()
-	defer tb.mu.Unlock()
-	tb.adjustavailableTokens(tb.currentTick(now))
+	defer tb.unlock()
+	tb.adjust(now)
 	return tb.availableTokens
 }
 
-// Capacity returns the capacity that the bucket was created with.
+// Capacity returns the capacity of the bucket.
 func (tb *Bucket) Capacity() int64 {
+	tb.mu.Lock()
+	defer tb.unlock()
 	return tb.capacity
 }
 
+// SetCapacity changes the capacity of the bucket. The capacity
+// must be positive.
+//
+// If the bucket holds more tokens than the new capacity, the
+// excess is discarded. If the bucket is in debt because callers
+// are waiting for tokens, the debt is preserved, so the waits
+// already returned to those callers remain valid; refill then
+// pays off the debt before tokens accumulate again, up to the
+// new capacity.
+func (tb *Bucket) SetCapacity(capacity int64) {
+	if capacity <= 0 {
+		panic("token bucket capacity is not > 0")
+	}
+	tb.mu.Lock()
+	defer tb.unlock()
+	tb.setCapacity(tb.clock.Now(), capacity)
+}
+
+// setCapacity is the internal version of SetCapacity - it takes the
+// current time as an argument to enable easy testing.
+func (tb *Bucket) setCapacity(now time.Time, capacity int64) {
+	tb.adjust(now)
+	tb.capacity = capacity
+	if tb.availableTokens > capacity {
+		tb.availableTokens = capacity
+	}
+	if tb.grace > capacity {
+		tb.grace = capacity
+	}
+}
+
+// Reset refills the bucket to its capacity, clearing any debt, and
+// restarts its ticks from now, as if it had just been created with
+// its current rate and capacity. This suits administrative
+// intervention and test setup. Callers already waiting for tokens
+// are not woken early, as the length of their waits was fixed when
+// they took their tokens.
+func (tb *Bucket) Reset() {
+	tb.mu.Lock()
+	defer tb.unlock()
+	tb.reset(tb.clock.Now())
+}
+
+// reset is the internal version of Reset - it takes the current
+// time as an argument to enable easy testing.
+func (tb *Bucket) reset(now time.Time) {
+	tb.adjustRamp(now)
+	tb.startTime = now
+	tb.latestTick = 0
+	tb.availableTokens = tb.capacity
+	if tb.delay != nil {
+		tb.delay.firstAbove = time.Time{}
+	}
+}
+
+// SetAvailable sets the number of tokens in the bucket, overriding
+// its current balance, so that an operator can, for example, set it
+// to zero to hold back traffic until refill resumes it, or to the
+// capacity to release a backlog. A negative count puts the bucket
+// into debt. The count must not exceed the bucket's capacity. Any
+// resulting change in pressure is reported on the channel returned
+// by Pressure.
+func (tb *Bucket) SetAvailable(count int64) {
+	tb.mu.Lock()
+	defer tb.unlock()
+	if count > tb.capacity {
+		panic("token bucket available count exceeds capacity")
+	}
+	tb.adjust(tb.clock.Now())
+	tb.availableTokens = count
+}
+
+// ErrPaused is returned when a caller would wait for tokens
+// from a paused bucket.
+var ErrPaused = errors.New("token bucket paused")
+
+// Pause pauses the bucket: until Resume is called, it does not
+// refill and grants no tokens, whatever it holds. TryTake, Allow,
+// TakeAvailable and TakeMaxDuration refuse, Take returns the
+// longest possible duration, and WaitContext, WaitMaxDuration and
+// RateLimiter.WaitN fail immediately, WaitContext and WaitN
+// returning ErrPaused. Wait blocks indefinitely, so callers of
+// buckets that may be paused should use WaitContext instead.
+func (tb *Bucket) Pause() {
+	tb.mu.Lock()
+	defer tb.unlock()
+	tb.adjust(tb.clock.Now())
+	tb.paused = true
+}
+
+// Resume resumes a bucket paused by Pause. The bucket holds
+// the tokens it held when it was paused, and refill resumes
+// from now.
+func (tb *Bucket) Resume() {
+	tb.mu.Lock()
+	defer tb.unlock()
+	tb.adjust(tb.clock.Now())
+	tb.paused = false
+}
+
+// Disable turns off limiting by the bucket, as a kill switch for
+// when limits must be lifted at once: until Enable is called, every
+// take succeeds immediately without taking any tokens, even if the
+// bucket is paused. Unless paused, the bucket goes on refilling
+// meanwhile.
+func (tb *Bucket) Disable() {
+	tb.mu.Lock()
+	defer tb.unlock()
+	tb.disabled = true
+}
+
+// Enable turns limiting by the bucket back on
+// after a call to Disable.
+func (tb *Bucket) Enable() {
+	tb.mu.Lock()
+	defer tb.unlock()
+	tb.disabled = false
+}
+
+// Disabled reports whether limiting by the bucket
+// is turned off.
+func (tb *Bucket) Disabled() bool {
+	tb.mu.Lock()
+	defer tb.unlock()
+	return tb.disabled
+}
+
+// Paused reports whether the bucket is paused.
+func (tb *Bucket) Paused() bool {
+	tb.mu.Lock()
+	defer tb.unlock()
+	return tb.paused
+}
+
+// refusal returns the error for a take refused without a
+// maximum wait. It must be called with tb.mu held.
+func (tb *Bucket) refusal() error {
+	if tb.paused && !tb.disabled {
+		return ErrPaused
+	}
+	return ErrTakeTooLarge
+}
+
+// refusesWaits reports whether callers that would wait for
+// tokens must instead fail with ErrPaused.
+func (tb *Bucket) refusesWaits() bool {
+	return tb.paused && !tb.disabled && tb.dryRun == nil
+}
+
+// Debt returns the number of tokens owed to callers that are
+// waiting for tokens, or zero if there are none.
+func (tb *Bucket) Debt() int64 {
+	if avail := tb.Available(); avail < 0 {
+		return -avail
+	}
+	return 0
+}
+
+// Limit returns the fill rate of the bucket as a Limit.
+func (tb *Bucket) Limit() Limit {
+	return Limit(tb.Rate())
+}
+
 // Rate returns the fill rate of the bucket, in tokens per second.
+// While a rate ramp is in progress, this is the current
+// effective rate.
 func (tb *Bucket) Rate() float64 {
-	return 1e9 * float64(tb.quantum) / float64(tb.fillInterval)
+	tb.mu.Lock()
+	defer tb.unlock()
+	tb.adjustRamp(tb.clock.Now())
+	return tickRate(tb.fillInterval, tb.quantum)
+}
+
+// tickRate returns the rate, in tokens per second, of a bucket
+// that adds quantum tokens every fillInterval.
+func tickRate(fillInterval time.Duration, quantum int64) float64 {
+	return 1e9 * float64(quantum) / float64(fillInterval)
+}
+
+// SetRate changes the fill rate of the bucket to rate tokens
+// per second, cancelling any rate ramp in progress. Tokens
+// accumulated so far are kept; waits already returned by Take
+// are not recomputed. As with NewBucketWithRate, the actual
+// rate may be up to 1% different from the specified rate.
+func (tb *Bucket) SetRate(rate float64) {
+	tb.SetRateWithRamp(rate, 0)
+}
+
+// SetRateWithRamp is like SetRate except that the effective
+// fill rate moves linearly from the current rate to the new
+// rate over the given duration rather than changing all at
+// once. This avoids a sudden surge of traffic when a limit
+// is raised substantially.
+func (tb *Bucket) SetRateWithRamp(rate float64, ramp time.Duration) {
+	if !(rate > 0) {
+		panic("token bucket rate is not > 0")
+	}
+	tb.mu.Lock()
+	defer tb.unlock()
+	now := tb.clock.Now()
+	if ramp <= 0 {
+		tb.ramp = nil
+		tb.setRate(now, rate)
+		return
+	}
+	tb.adjustRamp(now)
+	tb.ramp = &rateRamp{
+		startTime: now,
+		duration:  ramp,
+		fromRate:  tickRate(tb.fillInterval, tb.quantum),
+		toRate:    rate,
+	}
+}
+
+// setRate changes the fill interval and quantum of the bucket
+// to approximate the given rate. The tokens accrued up to now are
+// accounted for at the old rate and the tick origin is moved so
+// that subsequent ticks are measured at the new rate, carrying
+// over the fraction of the current tick that has already elapsed.
+func (tb *Bucket) setRate(now time.Time, rate float64) {
+	fillInterval, quantum := rateParams(rate)
+	tb.advance(now)
+	tickTime := tb.startTime.Add(time.Duration(tb.latestTick) * tb.fillInterval)
+	partial := float64(now.Sub(tickTime)) / float64(tb.fillInterval)
+	tb.startTime = now.Add(-time.Duration(partial * float64(fillInterval)))
+	tb.latestTick = 0
+	tb.fillInterval = fillInterval
+	tb.quantum = quantum
+}
+
+// adjustRamp moves the fill rate along the rate ramp in progress,
+// if any, to the rate that applies at the given time. To avoid
+// needless work, the rate is only changed when it has moved
+// by more than rateMargin.
+func (tb *Bucket) adjustRamp(now time.Time) {
+	r := tb.ramp
+	if r == nil {
+		return
+	}
+	elapsed := now.Sub(r.startTime)
+	if elapsed >= r.duration {
+		tb.ramp = nil
+		tb.setRate(now, r.toRate)
+		return
+	}
+	if elapsed < 0 {
+		return
+	}
+	rate := r.fromRate + (r.toRate-r.fromRate)*float64(elapsed)/float64(r.duration)
+	current := tickRate(tb.fillInterval, tb.quantum)
+	if math.Abs(rate-current)/current > rateMargin {
+		tb.setRate(now, rate)
+	}
 }
 
 // take is the internal version of Take - it takes the current time as
 // an argument to enable easy testing.
 func (tb *Bucket) take(now time.Time, count int64, maxWait time.Duration) (time.Duration, bool) {
+	d, _, ok := tb.charge(now, count, maxWait)
+	return d, ok
+}
+
+// charge is like take but also returns the number of tokens
+// actually taken, which is what the caller must refund if it backs
+// out. It is less than count when the take succeeds without taking
+// tokens, as it does when the bucket is disabled, or in dry-run
+// mode when the take would have been refused.
+func (tb *Bucket) charge(now time.Time, count int64, maxWait time.Duration) (time.Duration, int64, bool) {
+	d, ok := tb.enforceTake(now, count, maxWait)
+	taken := count
+	if !ok || tb.disabled || count <= 0 {
+		taken = 0
+	}
+	if !ok || d > 0 {
+		tb.throttled(now, count, d, !ok)
+		if tb.dryRun != nil {
+			tb.wouldLimit(count, d, !ok)
+			return 0, taken, true
+		}
+	}
+	return d, taken, ok
+}
+
+// enforceTake implements take, ignoring dry-run mode.
+func (tb *Bucket) enforceTake(now time.Time, count int64, maxWait time.Duration) (time.Duration, bool) {
 	if count <= 0 {
 		return 0, true
 	}
 
-	tick := tb.currentTick(now)
-	tb.adjustavailableTokens(tick)
+	tick := tb.adjust(now)
+	if tb.disabled {
+		return 0, true
+	}
+	if tb.paused {
+		return 0, false
+	}
+	if tb.availableTokens < math.MinInt64+1+count {
+		// The resulting debt cannot be represented, so
+		// the tokens can never become available.
+		return 0, false
+	}
 	avail := tb.availableTokens - count
 	if avail >= 0 {
 		tb.availableTokens = avail
 		return 0, true
 	}
+	waitTime := tb.waitTime(now, tick, avail)
+	if waitTime > maxWait || waitTime == infinityDuration {
+		// A wait too long to represent is refused even without
+		// a maximum, rather than leaving the bucket in a debt it
+		// cannot repay.
+		return 0, false
+	}
+	tb.availableTokens = avail
+	return waitTime, true
+}
+
+// waitTime returns how long after now it will be until the
+// bucket's token count reaches zero from the given negative
+// count at the given tick.
+func (tb *Bucket) waitTime(now time.Time, tick, avail int64) time.Duration {
+	if tb.grants != nil && tb.grants.NoRefill {
+		return tb.grants.grantWait(now, avail)
+	}
 	// Round up the missing tokens to the nearest multiple
 	// of quantum - the tokens won't be available until
 	// that tick.
 
-	// endTick holds the tick when all the requested tokens will
-	// become available.
-	endTick := tick + (-avail+tb.quantum-1)/tb.quantum
-	endTime := tb.startTime.Add(time.Duration(endTick) * tb.fillInterval)
-	waitTime := endTime.Sub(now)
-	if waitTime > maxWait {
-		return 0, false
+	// ticks holds the number of ticks after the current tick
+	// when all the requested tokens will become available.
+	ticks := -avail / tb.quantum
+	if -avail%tb.quantum != 0 {
+		ticks++
 	}
-	tb.availableTokens = avail
-	return waitTime, true
+	// sinceTick holds the time elapsed since the start of the
+	// current tick.
+	sinceTick := now.Sub(tb.startTime) - time.Duration(tick)*tb.fillInterval
+	d := mulDuration(ticks, tb.fillInterval)
+	if d == infinityDuration {
+		return infinityDuration
+	}
+	return d - sinceTick
+}
+
+// adjust brings the bucket up to date as of the given time,
+// including any rate ramp in progress and any scheduled grants,
+// and returns the current tick.
+func (tb *Bucket) adjust(now time.Time) int64 {
+	tb.adjustRamp(now)
+	tick := tb.advance(now)
+	if tb.grants != nil {
+		tb.grant(now)
+	}
+	return tick
+}
+
+// advance adjusts the number of available tokens to the
+// given time and returns the current tick.
+//
+// If the time is earlier than the latest tick, the clock has
+// gone backwards, and the start time is moved back so that
+// the given time corresponds to the latest tick: time spent
+// going backwards is treated as no time at all, rather than
+// taking tokens away from the bucket or delaying refill
+// until the clock catches up again.
+func (tb *Bucket) advance(now time.Time) int64 {
+	tick := tb.currentTick(now)
+	if tick < tb.latestTick {
+		tb.startTime = now.Add(-time.Duration(tb.latestTick) * tb.fillInterval)
+		tick = tb.latestTick
+	}
+	tb.adjustavailableTokens(tick)
+	return tick
 }
 
 // currentTick returns the current time tick, measured
@@ -312,18 +1282,53 @@ func (tb *Bucket) currentTick(now time.Time) int64 {
 func (tb *Bucket) adjustavailableTokens(tick int64) {
 	lastTick := tb.latestTick
 	tb.latestTick = tick
+	if !tb.paused && (tb.grants == nil || !tb.grants.NoRefill) {
+		tb.refill(tick - lastTick)
+	}
+}
+
+// refill adds the tokens for the given number of ticks
+// to the bucket, up to its capacity.
+func (tb *Bucket) refill(ticks int64) {
 	if tb.availableTokens >= tb.capacity {
 		return
 	}
-	tb.availableTokens += (tick - lastTick) * tb.quantum
-	if tb.availableTokens > tb.capacity {
+	// Compare in units of ticks rather than tokens so that
+	// a long absence with a large quantum cannot overflow.
+	// The number of missing tokens can exceed the int64 range
+	// when the bucket is deep in debt, so use unsigned
+	// arithmetic for it.
+	missing := uint64(tb.capacity) - uint64(tb.availableTokens)
+	fullTicks := missing / uint64(tb.quantum)
+	if missing%uint64(tb.quantum) != 0 {
+		fullTicks++
+	}
+	if ticks >= 0 && uint64(ticks) >= fullTicks {
 		tb.availableTokens = tb.capacity
+	} else {
+		tb.availableTokens += ticks * tb.quantum
 	}
-	return
+}
+
+// mulDuration returns n*d for non-negative n and positive d,
+// saturating at infinityDuration rather than overflowing.
+func mulDuration(n int64, d time.Duration) time.Duration {
+	if n > int64(infinityDuration/d) {
+		return infinityDuration
+	}
+	return time.Duration(n) * d
 }
 
 // Clock represents the passage of time in a way that
 // can be faked out for tests.
+//
+// A bucket measures elapsed time by subtracting times returned
+// by Now, so those times should carry a monotonic clock reading,
+// as those returned by time.Now do; the bucket is then unaffected
+// by steps in the wall clock. If Now does go backwards, the bucket
+// treats it as if no time had passed. A forward jump cannot be
+// told apart from time really passing, and refills the bucket
+// accordingly, up to its capacity.
 type Clock interface {
 	// Now returns the current time.
 	Now() time.Time
@@ -5,7 +5,10 @@
 package ratelimit
 
 import (
+	"context"
+	"errors"
 	"math"
+	"sync"
 	"testing"
 	"time"
 
@@ -297,6 +300,317 @@ func (rateLimitSuite) TestTakeAvailable(c *gc.C) {
 	}
 }
 
+func (rateLimitSuite) TestTakeBatch(c *gc.C) {
+	tb := NewBucket(10*time.Millisecond, 10)
+	granted, wait := tb.takeBatch(tb.startTime, 4)
+	c.Assert(granted, gc.Equals, int64(4))
+	c.Assert(wait, gc.Equals, time.Duration(0))
+
+	granted, wait = tb.takeBatch(tb.startTime, 9)
+	c.Assert(granted, gc.Equals, int64(6))
+	c.Assert(wait, gc.Equals, 30*time.Millisecond)
+
+	granted, wait = tb.takeBatch(tb.startTime.Add(10*time.Millisecond), 2)
+	c.Assert(granted, gc.Equals, int64(0))
+	c.Assert(wait, gc.Equals, 40*time.Millisecond)
+
+	granted, wait = tb.takeBatch(tb.startTime, 0)
+	c.Assert(granted, gc.Equals, int64(0))
+	c.Assert(wait, gc.Equals, time.Duration(0))
+}
+
+func (rateLimitSuite) TestNoOverflow(c *gc.C) {
+	// Refilling many ticks at once with a large quantum
+	// must not overflow the token count.
+	tb := NewBucketWithQuantum(1, 1<<62, 1<<40)
+	c.Assert(tb.takeAvailable(tb.startTime, 1<<62), gc.Equals, int64(1<<62))
+	c.Assert(tb.available(tb.startTime.Add(time.Hour)), gc.Equals, int64(1<<62))
+
+	// A wait too long to represent is refused rather than
+	// going negative or saturating, and takes nothing.
+	tb = NewBucket(time.Hour, 1<<62)
+	d, ok := tb.take(tb.startTime, 1<<62, infinityDuration)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(d, gc.Equals, time.Duration(0))
+	d, ok = tb.take(tb.startTime.Add(time.Minute), 1<<62, infinityDuration)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(d, gc.Equals, time.Duration(0))
+	c.Assert(tb.available(tb.startTime.Add(3*time.Hour)), gc.Equals, int64(3))
+
+	// A refill while deep in debt is still accounted exactly.
+	tb = NewBucket(time.Nanosecond, 1<<62)
+	tb.take(tb.startTime, 1<<62, infinityDuration)
+	d, ok = tb.take(tb.startTime, 1<<62, infinityDuration)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(d, gc.Equals, time.Duration(1<<62))
+	c.Assert(tb.available(tb.startTime.Add(3)), gc.Equals, int64(-1<<62+3))
+}
+
+func (rateLimitSuite) TestWaitsInArrivalOrder(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Millisecond, 1, clock)
+	tb.TakeAvailable(1)
+
+	// Record the order in which concurrent takes are made
+	// along with the wait each is given.
+	var (
+		mu    sync.Mutex
+		waits []time.Duration
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(count int64) {
+			defer wg.Done()
+			mu.Lock()
+			defer mu.Unlock()
+			waits = append(waits, tb.Take(count))
+		}(int64(i%3 + 1))
+	}
+	wg.Wait()
+
+	// Each take needs more refill than all the takes before it,
+	// so its wait must end strictly later.
+	for i := 1; i < len(waits); i++ {
+		if waits[i] <= waits[i-1] {
+			c.Fatalf("take %d was given wait %v, not after %v", i, waits[i], waits[i-1])
+		}
+	}
+}
+
+func (rateLimitSuite) TestTryTake(c *gc.C) {
+	tb := NewBucket(10*time.Millisecond, 10)
+	d, ok := tb.tryTake(tb.startTime, 8)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(d, gc.Equals, time.Duration(0))
+
+	// Not enough tokens: nothing is taken, but the caller
+	// learns how long to wait.
+	d, ok = tb.tryTake(tb.startTime.Add(5*time.Millisecond), 5)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(d, gc.Equals, 25*time.Millisecond)
+	c.Assert(tb.available(tb.startTime.Add(5*time.Millisecond)), gc.Equals, int64(2))
+
+	d, ok = tb.tryTake(tb.startTime.Add(30*time.Millisecond), 5)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(d, gc.Equals, time.Duration(0))
+	c.Assert(tb.available(tb.startTime.Add(30*time.Millisecond)), gc.Equals, int64(0))
+
+	d, ok = tb.tryTake(tb.startTime, 0)
+	c.Assert(ok, gc.Equals, true)
+}
+
+func (rateLimitSuite) TestGrace(c *gc.C) {
+	tb := NewBucket(time.Second, 5)
+	c.Assert(func() { tb.SetGrace(-1) }, gc.PanicMatches, "token bucket grace is not between 0 and capacity")
+	c.Assert(func() { tb.SetGrace(6) }, gc.PanicMatches, "token bucket grace is not between 0 and capacity")
+	tb.SetGrace(2)
+
+	c.Assert(tb.takeAvailable(tb.startTime, 4), gc.Equals, int64(4))
+	d, ok := tb.tryTake(tb.startTime, 2)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(d, gc.Equals, time.Duration(0))
+	c.Assert(tb.takeAvailable(tb.startTime, 4), gc.Equals, int64(1))
+
+	// The borrowed tokens are repaid before any more
+	// can be taken.
+	d, ok = tb.tryTake(tb.startTime.Add(time.Second), 1)
+	c.Assert(ok, gc.Equals, true)
+	d, ok = tb.tryTake(tb.startTime.Add(time.Second), 1)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(d, gc.Equals, time.Second)
+	c.Assert(tb.available(tb.startTime.Add(time.Second)), gc.Equals, int64(-2))
+	c.Assert(tb.available(tb.startTime.Add(5*time.Second)), gc.Equals, int64(2))
+}
+
+func (rateLimitSuite) TestAllow(c *gc.C) {
+	tb := NewBucket(time.Hour, 2)
+	c.Assert(tb.Allow(2), gc.Equals, true)
+	c.Assert(tb.Allow(1), gc.Equals, false)
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+}
+
+func (rateLimitSuite) TestDryRun(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Second, 2, clock)
+	var events []DryRunEvent
+	tb.SetDryRun(true, func(e DryRunEvent) {
+		events = append(events, e)
+	})
+	c.Assert(tb.DryRun(), gc.Equals, true)
+
+	// Takes within the limit are not reported.
+	c.Assert(tb.Allow(2), gc.Equals, true)
+	c.Assert(events, gc.HasLen, 0)
+
+	// A take that would have been refused succeeds
+	// without taking any tokens.
+	c.Assert(tb.Allow(1), gc.Equals, true)
+	c.Assert(tb.TakeAvailable(1), gc.Equals, int64(1))
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+
+	// A take that would have waited does not wait, but
+	// still runs the bucket into debt.
+	c.Assert(tb.Take(3), gc.Equals, time.Duration(0))
+	tb.Wait(1)
+	c.Assert(clock.now, gc.Equals, time.Unix(1e9, 0))
+	c.Assert(tb.Debt(), gc.Equals, int64(4))
+
+	c.Assert(events, gc.DeepEquals, []DryRunEvent{
+		{Count: 1, Rejected: true},
+		{Count: 1, Rejected: true},
+		{Count: 3, Wait: 3 * time.Second},
+		{Count: 1, Wait: 4 * time.Second},
+	})
+	c.Assert(tb.DryRunStats(), gc.Equals, DryRunStats{Delayed: 2, Rejected: 2})
+
+	// Once dry-run mode is off, the debt is enforced.
+	tb.SetDryRun(false, nil)
+	c.Assert(tb.DryRunStats(), gc.Equals, DryRunStats{})
+	c.Assert(tb.Take(1), gc.Equals, 5*time.Second)
+}
+
+func (rateLimitSuite) TestDryRunRollback(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	shadow := NewBucketWithClock(time.Second, 2, clock)
+	full := NewBucketWithClock(time.Hour, 1, clock)
+	full.TakeAvailable(1)
+	shadow.SetDryRun(true, nil)
+
+	// A take that dry-run mode lets through without tokens
+	// is not refunded when a later bucket refuses.
+	shadow.TakeAvailable(2)
+	c.Assert(Chain(shadow, full).Allow(1), gc.Equals, false)
+	c.Assert(shadow.Available(), gc.Equals, int64(0))
+
+	// A take that dry-run mode charges as debt is refunded
+	// exactly.
+	_, ok := MultiTake([]BucketCount{{shadow, 3}, {full, 1}}, 10*time.Second)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(shadow.Available(), gc.Equals, int64(0))
+	c.Assert(shadow.DryRunStats(), gc.Equals, DryRunStats{Delayed: 1, Rejected: 1})
+}
+
+func (rateLimitSuite) TestSetCapacity(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Second, 10, clock)
+
+	// Shrinking a full bucket discards the excess tokens.
+	tb.SetCapacity(5)
+	c.Assert(tb.Capacity(), gc.Equals, int64(5))
+	c.Assert(tb.Available(), gc.Equals, int64(5))
+	c.Assert(tb.Debt(), gc.Equals, int64(0))
+
+	// Growing it does not add tokens, but allows more to
+	// accumulate.
+	tb.SetCapacity(8)
+	c.Assert(tb.Available(), gc.Equals, int64(5))
+	clock.Sleep(time.Hour)
+	c.Assert(tb.Available(), gc.Equals, int64(8))
+
+	// Shrinking while in debt keeps the debt, so that the
+	// waits already handed out are honoured ...
+	c.Assert(tb.Take(11), gc.Equals, 3*time.Second)
+	c.Assert(tb.Take(1), gc.Equals, 4*time.Second)
+	tb.SetCapacity(2)
+	c.Assert(tb.Debt(), gc.Equals, int64(4))
+
+	// ... and the refill is clamped to the new capacity once
+	// the debt is paid.
+	clock.Sleep(4 * time.Second)
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+	clock.Sleep(time.Hour)
+	c.Assert(tb.Available(), gc.Equals, int64(2))
+
+	c.Assert(func() { tb.SetCapacity(0) }, gc.PanicMatches, "token bucket capacity is not > 0")
+}
+
+func (rateLimitSuite) TestTakeWithinCapacity(c *gc.C) {
+	tb := NewBucket(10*time.Millisecond, 10)
+	d, err := tb.takeWithinCapacity(tb.startTime, 10)
+	c.Assert(err, gc.IsNil)
+	c.Assert(d, gc.Equals, time.Duration(0))
+
+	d, err = tb.takeWithinCapacity(tb.startTime, 11)
+	c.Assert(err, gc.ErrorMatches, `take of 11 tokens exceeds bucket capacity \(10\)`)
+	c.Assert(errors.Is(err, ErrExceedsCapacity), gc.Equals, true)
+	c.Assert(d, gc.Equals, time.Duration(0))
+	c.Assert(tb.available(tb.startTime), gc.Equals, int64(0))
+
+	d, err = tb.takeWithinCapacity(tb.startTime, 10)
+	c.Assert(err, gc.IsNil)
+	c.Assert(d, gc.Equals, 100*time.Millisecond)
+
+	// A refused take is reported as an error,
+	// not as a zero wait.
+	tb.Pause()
+	d, err = tb.takeWithinCapacity(tb.startTime, 1)
+	c.Assert(err, gc.Equals, ErrPaused)
+	c.Assert(d, gc.Equals, time.Duration(0))
+	tb.Resume()
+
+	tb = NewBucketWithQuantum(time.Nanosecond, 10, 1<<40)
+	_, ok := tb.take(tb.startTime, math.MaxInt64, infinityDuration)
+	c.Assert(ok, gc.Equals, true)
+	_, err = tb.takeWithinCapacity(tb.startTime, 10)
+	c.Assert(err, gc.IsNil)
+	d, err = tb.takeWithinCapacity(tb.startTime, 10)
+	c.Assert(err, gc.Equals, ErrTakeTooLarge)
+	c.Assert(d, gc.Equals, time.Duration(0))
+}
+
+func (rateLimitSuite) TestHugeTake(c *gc.C) {
+	// The wait for the tokens cannot be represented, so the
+	// take is refused and the state is left alone.
+	tb := NewBucket(time.Second, 10)
+	d, ok := tb.take(tb.startTime, math.MaxInt64, infinityDuration)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(d, gc.Equals, time.Duration(0))
+	c.Assert(tb.Take(math.MaxInt64), gc.Equals, infinityDuration)
+	c.Assert(tb.available(tb.startTime), gc.Equals, int64(10))
+
+	// With a fast enough refill the wait can be represented...
+	tb = NewBucketWithQuantum(time.Nanosecond, 10, 1<<40)
+	d, ok = tb.take(tb.startTime, math.MaxInt64, infinityDuration)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(d, gc.Equals, 8388608*time.Nanosecond)
+	c.Assert(tb.available(tb.startTime), gc.Equals, int64(10-math.MaxInt64))
+
+	// ... but a further take would overflow the debt, so it
+	// is refused and the state is left alone.
+	d, ok = tb.take(tb.startTime, math.MaxInt64, infinityDuration)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(d, gc.Equals, time.Duration(0))
+	granted, d := tb.takeBatch(tb.startTime, math.MaxInt64)
+	c.Assert(granted, gc.Equals, int64(0))
+	c.Assert(d, gc.Equals, infinityDuration)
+	c.Assert(tb.takeAvailable(tb.startTime, math.MaxInt64), gc.Equals, int64(0))
+	c.Assert(tb.available(tb.startTime.Add(2*time.Nanosecond)), gc.Equals, int64(10+2<<40-math.MaxInt64))
+}
+
+func (rateLimitSuite) TestClockGoesBackwards(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Second, 10, clock)
+	clock.Sleep(5 * time.Second)
+	c.Assert(tb.TakeAvailable(10), gc.Equals, int64(10))
+
+	// Stepping the clock back, as an NTP correction might,
+	// takes no tokens away...
+	clock.now = clock.now.Add(-3 * time.Second)
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+	c.Assert(tb.Take(1), gc.Equals, time.Second)
+
+	// ... and refill resumes from the new time rather than
+	// waiting for the clock to catch up.
+	clock.Sleep(2 * time.Second)
+	c.Assert(tb.Available(), gc.Equals, int64(1))
+
+	// A step forward is indistinguishable from elapsed time
+	// and refills at most to capacity.
+	clock.Sleep(24 * time.Hour)
+	c.Assert(tb.Available(), gc.Equals, int64(10))
+}
+
 func (rateLimitSuite) TestPanics(c *gc.C) {
 	c.Assert(func() { NewBucket(0, 1) }, gc.PanicMatches, "token bucket fill interval is not > 0")
 	c.Assert(func() { NewBucket(-2, 1) }, gc.PanicMatches, "token bucket fill interval is not > 0")
@@ -323,6 +637,18 @@ func (rateLimitSuite) TestRate(c *gc.C) {
 	}
 }
 
+func (rateLimitSuite) TestLimit(c *gc.C) {
+	c.Assert(Every(0), gc.Equals, Inf)
+	c.Assert(Every(-time.Second), gc.Equals, Inf)
+	c.Assert(Every(100*time.Millisecond), gc.Equals, Limit(10))
+
+	tb := NewBucketWithLimit(Every(250*time.Millisecond), 1)
+	if !isCloseTo(float64(tb.Limit()), 4, rateMargin) {
+		c.Fatalf("got %v want 4", tb.Limit())
+	}
+	c.Assert(func() { NewBucketWithLimit(Inf, 1) }, gc.PanicMatches, "token bucket limit is infinite")
+}
+
 func checkRate(c *gc.C, rate float64) {
 	tb := NewBucketWithRate(rate, 1<<62)
 	if !isCloseTo(tb.Rate(), rate, rateMargin) {
@@ -407,8 +733,486 @@ func TestNoBonusTokenAfterBucketIsFull(t *testing.T) {
 	}
 }
 
+// fakeClock implements Clock with a time that only moves
+// when it is told to.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func (rateLimitSuite) TestSetRate(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Second, 10, clock)
+	c.Assert(tb.TakeAvailable(10), gc.Equals, int64(10))
+	clock.Sleep(500 * time.Millisecond)
+
+	tb.SetRate(100)
+	c.Assert(isCloseTo(tb.Rate(), 100, rateMargin), gc.Equals, true)
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+
+	clock.Sleep(50 * time.Millisecond)
+	c.Assert(tb.Available(), gc.Equals, int64(5))
+
+	c.Assert(func() { tb.SetRate(0) }, gc.PanicMatches, "token bucket rate is not > 0")
+}
+
+func (rateLimitSuite) TestSetRateWithRamp(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithRateAndClock(10, 1000, clock)
+	tb.SetRateWithRamp(110, 10*time.Second)
+	c.Assert(isCloseTo(tb.Rate(), 10, rateMargin), gc.Equals, true)
+
+	clock.Sleep(5 * time.Second)
+	c.Assert(isCloseTo(tb.Rate(), 60, 2*rateMargin), gc.Equals, true)
+
+	clock.Sleep(5 * time.Second)
+	c.Assert(isCloseTo(tb.Rate(), 110, rateMargin), gc.Equals, true)
+	c.Assert(tb.ramp, gc.IsNil)
+
+	// Setting the rate directly cancels a ramp.
+	tb.SetRateWithRamp(10, time.Hour)
+	tb.SetRate(50)
+	clock.Sleep(time.Minute)
+	c.Assert(isCloseTo(tb.Rate(), 50, rateMargin), gc.Equals, true)
+}
+
+func (rateLimitSuite) TestWaitContext(c *gc.C) {
+	tb := NewBucket(time.Hour, 2)
+	c.Assert(tb.WaitContext(context.Background(), 1), gc.IsNil)
+
+	// A wait that is cancelled returns its tokens.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	err := tb.WaitContext(ctx, 3)
+	c.Assert(err, gc.Equals, context.Canceled)
+	c.Assert(tb.Available(), gc.Equals, int64(1))
+
+	// A context that is already done takes nothing.
+	c.Assert(tb.WaitContext(ctx, 1), gc.Equals, context.Canceled)
+	c.Assert(tb.Available(), gc.Equals, int64(1))
+
+	// A wait that would outlast the deadline is refused
+	// immediately.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	c.Assert(tb.WaitContext(ctx, 2), gc.Equals, ErrDeadline)
+	c.Assert(tb.Available(), gc.Equals, int64(1))
+
+	// Waits that can never end are refused at once, even
+	// with no deadline.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	c.Assert(tb.WaitContext(ctx, 1<<62), gc.Equals, ErrTakeTooLarge)
+	c.Assert(tb.Available(), gc.Equals, int64(1))
+	tb.Pause()
+	c.Assert(tb.WaitContext(ctx, 2), gc.Equals, ErrPaused)
+	tb.SetDryRun(true, nil)
+	c.Assert(tb.WaitContext(ctx, 2), gc.IsNil)
+	tb.SetDryRun(false, nil)
+	tb.Resume()
+
+	tb = NewBucket(10*time.Millisecond, 1)
+	c.Assert(tb.WaitContext(context.Background(), 1), gc.IsNil)
+	c.Assert(tb.WaitContext(context.Background(), 1), gc.IsNil)
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+}
+
+func (rateLimitSuite) TestTakeContext(c *gc.C) {
+	tb := NewBucket(time.Second, 2)
+	ctx := context.Background()
+	d, err := tb.TakeContext(ctx, 3)
+	c.Assert(err, gc.IsNil)
+	if d <= 900*time.Millisecond || d > time.Second {
+		c.Fatalf("got wait %v, want about 1s", d)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 1500*time.Millisecond)
+	defer cancel()
+	d, err = tb.TakeContext(ctx, 1)
+	c.Assert(err, gc.Equals, ErrDeadline)
+	c.Assert(d, gc.Equals, time.Duration(0))
+	c.Assert(tb.Available(), gc.Equals, int64(-1))
+
+	cancel()
+	d, err = tb.TakeContext(ctx, 1)
+	c.Assert(err, gc.Equals, context.Canceled)
+	c.Assert(tb.Available(), gc.Equals, int64(-1))
+
+	// Takes that Take would refuse are reported as errors.
+	d, err = tb.TakeContext(context.Background(), math.MaxInt64)
+	c.Assert(err, gc.Equals, ErrTakeTooLarge)
+	c.Assert(d, gc.Equals, time.Duration(0))
+	tb.Pause()
+	d, err = tb.TakeContext(context.Background(), 1)
+	c.Assert(err, gc.Equals, ErrPaused)
+	c.Assert(d, gc.Equals, time.Duration(0))
+}
+
+func (rateLimitSuite) TestRefund(c *gc.C) {
+	tb := NewBucket(time.Second, 10)
+	tb.take(tb.startTime, 15, infinityDuration)
+	tb.take(tb.startTime, 2, infinityDuration)
+
+	// Refill since the take is kept.
+	tb.refund(tb.startTime.Add(3*time.Second), 2)
+	c.Assert(tb.available(tb.startTime.Add(3*time.Second)), gc.Equals, int64(-2))
+
+	// The capacity is never exceeded.
+	tb.refund(tb.startTime.Add(3*time.Second), 1e6)
+	c.Assert(tb.available(tb.startTime.Add(3*time.Second)), gc.Equals, int64(10))
+	tb.refund(tb.startTime.Add(3*time.Second), math.MaxInt64)
+	c.Assert(tb.available(tb.startTime.Add(3*time.Second)), gc.Equals, int64(10))
+}
+
+func (rateLimitSuite) TestPressure(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Second, 10, clock)
+	c.Assert(func() { tb.Pressure() }, gc.PanicMatches, "pressure thresholds are not > 0")
+	c.Assert(func() { tb.Pressure(0, 5) }, gc.PanicMatches, "pressure thresholds are not > 0")
+
+	p := tb.Pressure(10, 5)
+	assertNoEvent := func() {
+		select {
+		case e := <-p:
+			c.Fatalf("unexpected event %+v", e)
+		default:
+		}
+	}
+	tb.Take(14)
+	assertNoEvent()
+	tb.Take(1)
+	c.Assert(<-p, gc.Equals, PressureEvent{Level: 1, Debt: 5})
+
+	// Only the latest event is kept.
+	tb.Take(5)
+	clock.Sleep(6 * time.Second)
+	tb.Available()
+	c.Assert(<-p, gc.Equals, PressureEvent{Level: 0, Debt: 4})
+	assertNoEvent()
+
+	// Refill is noticed next time the bucket is used.
+	tb.Take(2)
+	c.Assert(<-p, gc.Equals, PressureEvent{Level: 1, Debt: 6})
+	clock.Sleep(2 * time.Second)
+	assertNoEvent()
+	tb.Available()
+	c.Assert(<-p, gc.Equals, PressureEvent{Level: 0, Debt: 4})
+
+	// Replacing the watch closes the old channel.
+	p1 := tb.Pressure(1)
+	_, ok := <-p
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(<-p1, gc.Equals, PressureEvent{Level: 1, Debt: 4})
+}
+
+func (rateLimitSuite) TestTakeChan(c *gc.C) {
+	tb := NewBucket(50*time.Millisecond, 1)
+	select {
+	case <-tb.TakeChan(1):
+	default:
+		c.Fatalf("channel not closed with tokens available")
+	}
+	ch := tb.TakeChan(1)
+	select {
+	case <-ch:
+		c.Fatalf("channel closed before tokens available")
+	default:
+	}
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("channel not closed after tokens available")
+	}
+}
+
+func (rateLimitSuite) TestTakeChanRefused(c *gc.C) {
+	start := time.Unix(1e9, 0)
+	clock := &fakeClock{now: start}
+	tb := NewBucketWithClock(time.Second, 1, clock)
+	tb.Pause()
+	ch := tb.TakeChan(1)
+
+	// No goroutine is left sleeping on the clock
+	// for a wait that will never end.
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(clock.now, gc.Equals, start)
+	select {
+	case <-ch:
+		c.Fatalf("channel closed for refused take")
+	default:
+	}
+	c.Assert(tb.Available(), gc.Equals, int64(1))
+}
+
+func (rateLimitSuite) TestCoarseClock(c *gc.C) {
+	c.Assert(func() { NewCoarseClock(0) }, gc.PanicMatches, "coarse clock resolution is not > 0")
+
+	clock := NewCoarseClock(time.Millisecond)
+	defer clock.Stop()
+	start := clock.Now()
+	time.Sleep(20 * time.Millisecond)
+	now := clock.Now()
+	if d := now.Sub(start); d < 10*time.Millisecond {
+		c.Fatalf("clock advanced by %v, want at least 10ms", d)
+	}
+	if d := time.Since(now); d < 0 || d > 500*time.Millisecond {
+		c.Fatalf("clock lags real time by %v", d)
+	}
+
+	clock.Stop()
+	clock.Stop()
+	stopped := clock.Now()
+	time.Sleep(5 * time.Millisecond)
+	c.Assert(clock.Now().Equal(stopped), gc.Equals, true)
+}
+
+func (rateLimitSuite) TestNoAllocations(c *gc.C) {
+	if debugInvariants {
+		c.Skip("invariant checks allocate")
+	}
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Millisecond, 1e6, clock)
+	for _, test := range []struct {
+		about string
+		f     func()
+	}{{
+		about: "Take",
+		f:     func() { tb.Take(1) },
+	}, {
+		about: "TakeMaxDuration",
+		f:     func() { tb.TakeMaxDuration(1, time.Second) },
+	}, {
+		about: "TakeAvailable",
+		f:     func() { tb.TakeAvailable(1) },
+	}, {
+		about: "Allow",
+		f:     func() { tb.Allow(1) },
+	}, {
+		about: "TryTake",
+		f:     func() { tb.TryTake(1) },
+	}, {
+		about: "Wait",
+		f:     func() { tb.Wait(1) },
+	}, {
+		about: "Available",
+		f:     func() { tb.Available() },
+	}, {
+		about: "Rate",
+		f:     func() { tb.Rate() },
+	}} {
+		if n := testing.AllocsPerRun(1000, test.f); n != 0 {
+			c.Errorf("%s: got %v allocations per call, want 0", test.about, n)
+		}
+	}
+}
+
+func (rateLimitSuite) TestWheelClock(c *gc.C) {
+	c.Assert(func() { NewWheelClock(0) }, gc.PanicMatches, "wheel clock resolution is not > 0")
+
+	clock := NewWheelClock(50 * time.Millisecond)
+	const n = 100
+	var wg sync.WaitGroup
+	wg.Add(n)
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			clock.Sleep(10 * time.Millisecond)
+		}()
+	}
+	time.Sleep(5 * time.Millisecond)
+	clock.mu.Lock()
+	slots := len(clock.slots)
+	clock.mu.Unlock()
+	if slots > 2 {
+		c.Errorf("got %d timer slots for %d sleepers", slots, n)
+	}
+	wg.Wait()
+	if d := time.Since(start); d < 10*time.Millisecond {
+		c.Errorf("sleepers woke after %v, want at least 10ms", d)
+	}
+	clock.mu.Lock()
+	c.Assert(clock.slots, gc.HasLen, 0)
+	clock.mu.Unlock()
+
+	// A sleep that cannot end never does.
+	done := make(chan struct{})
+	go func() {
+		clock.Sleep(infinityDuration)
+		close(done)
+	}()
+	select {
+	case <-done:
+		c.Fatalf("sleep of the longest possible duration ended")
+	case <-time.After(20 * time.Millisecond):
+	}
+	clock.mu.Lock()
+	c.Assert(clock.slots, gc.HasLen, 0)
+	clock.mu.Unlock()
+}
+
+func (rateLimitSuite) TestSpinClock(c *gc.C) {
+	for _, threshold := range []time.Duration{0, time.Millisecond, time.Hour} {
+		clock := SpinClock{Threshold: threshold}
+		start := time.Now()
+		clock.Sleep(2 * time.Millisecond)
+		if d := time.Since(start); d < 2*time.Millisecond {
+			c.Errorf("threshold %v: slept for %v, want at least 2ms", threshold, d)
+		}
+	}
+}
+
+func (rateLimitSuite) TestMaxWaiters(c *gc.C) {
+	tb := NewBucket(50*time.Millisecond, 1)
+	tb.SetMaxWaiters(1)
+	tb.TakeAvailable(1)
+	ctx := context.Background()
+	done := make(chan error)
+	go func() {
+		done <- tb.WaitContext(ctx, 1)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// The queue is full, so callers that would wait are refused
+	// without taking tokens.
+	c.Assert(tb.WaitContext(ctx, 1), gc.Equals, ErrQueueFull)
+	c.Assert(tb.WaitMaxDuration(1, time.Hour), gc.Equals, false)
+	c.Assert(RateLimiterFromBucket(tb).Wait(ctx), gc.Equals, ErrQueueFull)
+	c.Assert(tb.Available(), gc.Equals, int64(-1))
+
+	c.Assert(<-done, gc.IsNil)
+	c.Assert(tb.WaitMaxDuration(1, time.Hour), gc.Equals, true)
+	tb.mu.Lock()
+	c.Assert(tb.waiters, gc.Equals, 0)
+	tb.mu.Unlock()
+}
+
+func (rateLimitSuite) TestDelayTarget(c *gc.C) {
+	tb := NewBucket(time.Second, 10)
+	tb.SetDelayTarget(2*time.Second, 5*time.Second)
+	t0 := tb.startTime
+	takeQueued := func(t time.Duration, count int64) (time.Duration, error) {
+		tb.mu.Lock()
+		defer tb.unlock()
+		d, _, ok, err := tb.takeQueued(t0.Add(t), count, infinityDuration)
+		c.Assert(ok, gc.Equals, err == nil)
+		return d, err
+	}
+	d, err := takeQueued(0, 10)
+	c.Assert(err, gc.IsNil)
+	c.Assert(d, gc.Equals, time.Duration(0))
+
+	// Long waits are allowed for the interval...
+	d, err = takeQueued(0, 3)
+	c.Assert(err, gc.IsNil)
+	c.Assert(d, gc.Equals, 3*time.Second)
+	d, err = takeQueued(time.Second, 1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(d, gc.Equals, 3*time.Second)
+
+	// ... after which they are refused without taking tokens.
+	_, err = takeQueued(5*time.Second, 5)
+	c.Assert(err, gc.Equals, ErrQueueDelay)
+	c.Assert(tb.available(t0.Add(5*time.Second)), gc.Equals, int64(1))
+
+	// A short wait ends the refusals.
+	d, err = takeQueued(5*time.Second, 1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(d, gc.Equals, time.Duration(0))
+	d, err = takeQueued(5*time.Second, 3)
+	c.Assert(err, gc.IsNil)
+	c.Assert(d, gc.Equals, 3*time.Second)
+	c.Assert(tb.waiters, gc.Equals, 3)
+
+	tb.SetDelayTarget(0, 0)
+	c.Assert(tb.delay, gc.IsNil)
+}
+
+func (rateLimitSuite) TestTakeAtLeast(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Hour, 100, clock)
+	t0 := clock.now
+	got, ok := tb.takeAtLeast(t0, 10, 60)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(got, gc.Equals, int64(60))
+	got, ok = tb.takeAtLeast(t0, 10, 60)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(got, gc.Equals, int64(40))
+
+	// Too few tokens are available, so none are taken.
+	tb.putBack(5)
+	got, ok = tb.takeAtLeast(t0, 10, 60)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(got, gc.Equals, int64(0))
+	c.Assert(tb.available(t0), gc.Equals, int64(5))
+
+	got, ok = tb.takeAtLeast(t0, 0, 60)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(got, gc.Equals, int64(5))
+	got, ok = tb.takeAtLeast(t0, 0, 60)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(got, gc.Equals, int64(0))
+
+	_, ok = tb.takeAtLeast(t0, 10, 5)
+	c.Assert(ok, gc.Equals, false)
+}
+
+func (rateLimitSuite) TestReset(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Second, 10, clock)
+	c.Assert(tb.Take(15), gc.Equals, 5*time.Second)
+	clock.Sleep(1500 * time.Millisecond)
+	tb.Reset()
+	c.Assert(tb.Available(), gc.Equals, int64(10))
+
+	// Ticks restart from the reset, so the half tick
+	// that had elapsed is discarded.
+	c.Assert(tb.Take(11), gc.Equals, time.Second)
+	clock.Sleep(500 * time.Millisecond)
+	c.Assert(tb.Available(), gc.Equals, int64(-1))
+	clock.Sleep(500 * time.Millisecond)
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+}
+
+func (rateLimitSuite) TestSetAvailable(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Second, 10, clock)
+	pressure := tb.Pressure(5)
+	tb.SetAvailable(0)
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+	tb.SetAvailable(-5)
+	c.Assert(tb.Debt(), gc.Equals, int64(5))
+	c.Assert(<-pressure, gc.Equals, PressureEvent{Level: 1, Debt: 5})
+	clock.Sleep(7 * time.Second)
+	c.Assert(tb.Available(), gc.Equals, int64(2))
+	c.Assert(func() { tb.SetAvailable(11) }, gc.PanicMatches, "token bucket available count exceeds capacity")
+}
+
+func (rateLimitSuite) TestNameAndLabels(c *gc.C) {
+	tb := NewBucket(time.Second, 1)
+	c.Assert(tb.Name(), gc.Equals, "")
+	c.Assert(tb.Labels(), gc.IsNil)
+	tb.SetName("search")
+	labels := map[string]string{"tenant": "acme"}
+	tb.SetLabels(labels)
+	labels["tenant"] = "other"
+	c.Assert(tb.Name(), gc.Equals, "search")
+	c.Assert(tb.Labels(), gc.DeepEquals, map[string]string{"tenant": "acme"})
+}
+
 func BenchmarkWait(b *testing.B) {
 	tb := NewBucket(1, 16*1024)
+	b.ReportAllocs()
 	for i := b.N - 1; i >= 0; i-- {
 		tb.Wait(1)
 	}
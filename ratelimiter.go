@@ -0,0 +1,220 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// InfDuration is the duration returned by Reservation.Delay
+// when a reservation is not OK.
+const InfDuration = infinityDuration
+
+// RateLimiter provides the method set of the Limiter type in
+// golang.org/x/time/rate, implemented with a Bucket, so that code
+// written against that package can use this one with little more
+// than a change of names. The limiter's burst size is the bucket's
+// capacity.
+type RateLimiter struct {
+	tb *Bucket
+}
+
+// NewRateLimiter returns a limiter that allows events up to rate r
+// and permits bursts of at most b tokens, like rate.NewLimiter. Unlike
+// rate.NewLimiter, r must be finite and b must be positive.
+func NewRateLimiter(r Limit, b int) *RateLimiter {
+	return RateLimiterFromBucket(NewBucketWithLimit(r, int64(b)))
+}
+
+// RateLimiterFromBucket returns a limiter that takes its
+// tokens from the given bucket.
+func RateLimiterFromBucket(tb *Bucket) *RateLimiter {
+	return &RateLimiter{tb: tb}
+}
+
+// Bucket returns the bucket that the limiter takes tokens from.
+func (lim *RateLimiter) Bucket() *Bucket {
+	return lim.tb
+}
+
+// Limit returns the maximum overall event rate.
+func (lim *RateLimiter) Limit() Limit {
+	return lim.tb.Limit()
+}
+
+// Burst returns the maximum burst size.
+func (lim *RateLimiter) Burst() int {
+	return int(lim.tb.Capacity())
+}
+
+// SetLimit sets a new limit for the limiter.
+func (lim *RateLimiter) SetLimit(r Limit) {
+	lim.tb.SetRate(float64(r))
+}
+
+// SetBurst sets a new burst size for the limiter.
+func (lim *RateLimiter) SetBurst(b int) {
+	lim.tb.SetCapacity(int64(b))
+}
+
+// Tokens returns the number of tokens available now.
+func (lim *RateLimiter) Tokens() float64 {
+	return float64(lim.tb.Available())
+}
+
+// Allow reports whether an event may happen now.
+func (lim *RateLimiter) Allow() bool {
+	return lim.AllowN(lim.tb.clock.Now(), 1)
+}
+
+// AllowN reports whether n events may happen at time t,
+// consuming tokens only if they may. As with x/time/rate, a time
+// earlier than one already seen by the limiter is treated as the
+// latest time seen.
+func (lim *RateLimiter) AllowN(t time.Time, n int) bool {
+	tb := lim.tb
+	tb.mu.Lock()
+	defer tb.unlock()
+	_, ok := tb.tryTake(tb.notBefore(t), int64(n))
+	return ok
+}
+
+// notBefore returns t, or the time of the bucket's latest tick if
+// t is earlier, so that a time in the past passed by a caller is
+// not taken to mean that the clock has gone backwards, which would
+// move the bucket's start time. It must be called with tb.mu held.
+func (tb *Bucket) notBefore(t time.Time) time.Time {
+	latest := tb.startTime.Add(time.Duration(tb.latestTick) * tb.fillInterval)
+	if t.Before(latest) {
+		return latest
+	}
+	return t
+}
+
+// Reserve is shorthand for ReserveN(time.Now(), 1).
+func (lim *RateLimiter) Reserve() *Reservation {
+	return lim.ReserveN(lim.tb.clock.Now(), 1)
+}
+
+// ReserveN returns a Reservation that indicates how long the caller
+// must wait before n events happen. The limiter takes the tokens
+// into account when allowing future events. The reservation is not
+// OK if n exceeds the limiter's burst size. A time earlier than one
+// already seen by the limiter is treated as the latest time seen.
+func (lim *RateLimiter) ReserveN(t time.Time, n int) *Reservation {
+	tb := lim.tb
+	tb.mu.Lock()
+	defer tb.unlock()
+	if int64(n) > tb.capacity {
+		return &Reservation{}
+	}
+	t = tb.notBefore(t)
+	d, taken, ok := tb.charge(t, int64(n), infinityDuration)
+	if !ok {
+		return &Reservation{}
+	}
+	return &Reservation{
+		ok:        true,
+		tb:        tb,
+		tokens:    taken,
+		timeToAct: t.Add(d),
+	}
+}
+
+// Wait is shorthand for WaitN(ctx, 1).
+func (lim *RateLimiter) Wait(ctx context.Context) error {
+	return lim.WaitN(ctx, 1)
+}
+
+// WaitN blocks until n events may happen. It returns an error if n
+// exceeds the limiter's burst size, the context is cancelled, the
+// expected wait time exceeds the context's deadline, or too many
+// callers are already waiting (see Bucket.SetMaxWaiters), or the
+// wait is refused by the bucket's delay target (see
+// Bucket.SetDelayTarget). In all of those cases, no tokens remain
+// taken.
+func (lim *RateLimiter) WaitN(ctx context.Context, n int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tb := lim.tb
+	tb.mu.Lock()
+	if int64(n) > tb.capacity {
+		burst := tb.capacity
+		tb.unlock()
+		return fmt.Errorf("rate: Wait(n=%d) exceeds limiter's burst %d", n, burst)
+	}
+	now := tb.clock.Now()
+	d, taken, ok, err := tb.takeQueued(now, int64(n), maxWaitBefore(ctx, now))
+	tb.unlock()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("rate: Wait(n=%d) would exceed context deadline", n)
+	}
+	return tb.waitTaken(ctx, taken, d)
+}
+
+// Reservation holds information about events that are permitted
+// by a RateLimiter to happen after a delay.
+type Reservation struct {
+	ok        bool
+	tb        *Bucket
+	tokens    int64
+	timeToAct time.Time
+}
+
+// OK reports whether the limiter can provide the requested number
+// of tokens within the maximum wait time. If OK is false, Delay
+// returns InfDuration, and Cancel does nothing.
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Delay is shorthand for DelayFrom(time.Now()).
+func (r *Reservation) Delay() time.Duration {
+	if !r.ok {
+		return InfDuration
+	}
+	return r.DelayFrom(r.tb.clock.Now())
+}
+
+// DelayFrom returns the duration for which the reservation holder
+// must wait before taking the reserved action, measured from t.
+func (r *Reservation) DelayFrom(t time.Time) time.Duration {
+	if !r.ok {
+		return InfDuration
+	}
+	if d := r.timeToAct.Sub(t); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// Cancel is shorthand for CancelAt(time.Now()).
+func (r *Reservation) Cancel() {
+	if !r.ok {
+		return
+	}
+	r.CancelAt(r.tb.clock.Now())
+}
+
+// CancelAt indicates that the reservation holder will not perform
+// the reserved action and returns the reserved tokens to the
+// limiter, as far as is possible given that it is now time t.
+// Cancelling a reservation whose time to act has passed, or that
+// has already been cancelled, does nothing.
+func (r *Reservation) CancelAt(t time.Time) {
+	if !r.ok || r.tokens == 0 || t.After(r.timeToAct) {
+		return
+	}
+	r.tb.mu.Lock()
+	defer r.tb.unlock()
+	r.tb.refund(r.tb.notBefore(t), r.tokens)
+	r.tokens = 0
+}
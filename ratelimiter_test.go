@@ -0,0 +1,139 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type rateLimiterSuite struct{}
+
+var _ = gc.Suite(rateLimiterSuite{})
+
+func (rateLimiterSuite) TestAllow(c *gc.C) {
+	lim := NewRateLimiter(10, 2)
+	c.Assert(lim.Burst(), gc.Equals, 2)
+	c.Assert(lim.Limit(), gc.Equals, Limit(10))
+	t0 := lim.Bucket().startTime
+	c.Assert(lim.AllowN(t0, 2), gc.Equals, true)
+	c.Assert(lim.AllowN(t0, 1), gc.Equals, false)
+	c.Assert(lim.AllowN(t0.Add(50*time.Millisecond), 1), gc.Equals, false)
+	c.Assert(lim.AllowN(t0.Add(100*time.Millisecond), 1), gc.Equals, true)
+	c.Assert(lim.AllowN(t0.Add(100*time.Millisecond), 0), gc.Equals, true)
+}
+
+func (rateLimiterSuite) TestReserve(c *gc.C) {
+	lim := NewRateLimiter(10, 2)
+	t0 := lim.Bucket().startTime
+	r := lim.ReserveN(t0, 3)
+	c.Assert(r.OK(), gc.Equals, false)
+	c.Assert(r.DelayFrom(t0), gc.Equals, InfDuration)
+	r.CancelAt(t0)
+
+	r = lim.ReserveN(t0, 2)
+	c.Assert(r.OK(), gc.Equals, true)
+	c.Assert(r.DelayFrom(t0), gc.Equals, time.Duration(0))
+
+	r = lim.ReserveN(t0, 2)
+	c.Assert(r.OK(), gc.Equals, true)
+	c.Assert(r.DelayFrom(t0), gc.Equals, 200*time.Millisecond)
+	c.Assert(r.DelayFrom(t0.Add(time.Second)), gc.Equals, time.Duration(0))
+
+	// Cancelling returns the tokens, once only.
+	r.CancelAt(t0.Add(100 * time.Millisecond))
+	r.CancelAt(t0.Add(100 * time.Millisecond))
+	c.Assert(lim.Bucket().available(t0.Add(100*time.Millisecond)), gc.Equals, int64(1))
+
+	// Cancelling after the time to act does nothing.
+	r = lim.ReserveN(t0.Add(100*time.Millisecond), 1)
+	c.Assert(r.DelayFrom(t0.Add(100*time.Millisecond)), gc.Equals, time.Duration(0))
+	r.CancelAt(t0.Add(time.Second))
+	c.Assert(lim.Bucket().available(t0.Add(100*time.Millisecond)), gc.Equals, int64(0))
+}
+
+func (rateLimiterSuite) TestPastTime(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	lim := RateLimiterFromBucket(NewBucketWithClock(time.Second, 2, clock))
+	c.Assert(lim.Allow(), gc.Equals, true)
+	c.Assert(lim.Allow(), gc.Equals, true)
+
+	// A time in the past is treated as now, rather than as
+	// the clock going backwards, which would grant extra
+	// refill on the next call.
+	c.Assert(lim.AllowN(clock.now.Add(-time.Hour), 1), gc.Equals, false)
+	r := lim.ReserveN(clock.now.Add(-time.Hour), 1)
+	c.Assert(r.DelayFrom(clock.now), gc.Equals, time.Second)
+	clock.Sleep(time.Second)
+	c.Assert(lim.Allow(), gc.Equals, false)
+	clock.Sleep(time.Second)
+	c.Assert(lim.Allow(), gc.Equals, true)
+	c.Assert(lim.Allow(), gc.Equals, false)
+}
+
+func (rateLimiterSuite) TestReserveDisabled(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Hour, 2, clock)
+	lim := RateLimiterFromBucket(tb)
+	c.Assert(lim.Allow(), gc.Equals, true)
+
+	// A reservation that took no tokens returns none
+	// when cancelled.
+	tb.Disable()
+	lim.Reserve().Cancel()
+	tb.Enable()
+	c.Assert(tb.Available(), gc.Equals, int64(1))
+
+	tb.SetDryRun(true, nil)
+	c.Assert(lim.Allow(), gc.Equals, true)
+	lim.ReserveN(clock.now, 2).Cancel()
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+}
+
+func (rateLimiterSuite) TestWait(c *gc.C) {
+	lim := NewRateLimiter(Every(time.Hour), 2)
+	ctx := context.Background()
+	c.Assert(lim.Wait(ctx), gc.IsNil)
+	c.Assert(lim.WaitN(ctx, 3), gc.ErrorMatches, `rate: Wait\(n=3\) exceeds limiter's burst 2`)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	c.Assert(lim.WaitN(ctx, 2), gc.ErrorMatches, `rate: Wait\(n=2\) would exceed context deadline`)
+	c.Assert(lim.Tokens(), gc.Equals, float64(1))
+	c.Assert(lim.WaitN(ctx, 1), gc.IsNil)
+
+	cancel()
+	c.Assert(lim.Wait(ctx), gc.Equals, context.Canceled)
+}
+
+func (rateLimiterSuite) TestSetLimitAndBurst(c *gc.C) {
+	lim := NewRateLimiter(10, 2)
+	lim.SetLimit(20)
+	lim.SetBurst(5)
+	c.Assert(isCloseTo(float64(lim.Limit()), 20, rateMargin), gc.Equals, true)
+	c.Assert(lim.Burst(), gc.Equals, 5)
+}
+
+func (rateLimiterSuite) TestPacer(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	p := NewPacer(NewBucketWithClock(100*time.Millisecond, 1, clock))
+	t0 := clock.now
+	c.Assert(p.Take(), gc.Equals, t0)
+	c.Assert(p.Take(), gc.Equals, t0.Add(100*time.Millisecond))
+	c.Assert(p.Take(), gc.Equals, t0.Add(200*time.Millisecond))
+	c.Assert(clock.now, gc.Equals, t0.Add(200*time.Millisecond))
+}
+
+func (rateLimiterSuite) TestGRPCLimiter(c *gc.C) {
+	tb := NewBucket(time.Hour, 3)
+	l := NewGRPCLimiter(tb)
+	ctx := context.Background()
+	c.Assert(l.Limit(ctx), gc.IsNil)
+	l.Cost = 2
+	c.Assert(l.Limit(ctx), gc.IsNil)
+	c.Assert(l.Limit(ctx), gc.Equals, ErrLimited)
+}
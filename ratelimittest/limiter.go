@@ -0,0 +1,166 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+// Package ratelimittest provides a limiter that records the calls
+// made to it and answers them from a script, so that code written
+// against the ratelimit.Allower, Taker and Waiter interfaces can be
+// tested without a real bucket or clock.
+package ratelimittest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+// Call records a single call made to a Limiter.
+type Call struct {
+	// Method holds the name of the method called, such
+	// as "Allow" or "WaitContext".
+	Method string
+
+	// Key holds the key of the Limiter called, as passed
+	// to For, or the empty string.
+	Key string
+
+	// Count holds the number of tokens asked for.
+	Count int64
+
+	// Time holds the time of the call according to the
+	// Limiter's clock.
+	Time time.Time
+}
+
+// Response scripts the answer to a single call.
+type Response struct {
+	// Refuse makes Allow return false and TakeAvailable
+	// take no tokens.
+	Refuse bool
+
+	// Wait is returned by Take.
+	Wait time.Duration
+
+	// Err is returned by WaitContext.
+	Err error
+}
+
+// Limiter implements ratelimit.Allower, ratelimit.Taker and
+// ratelimit.Waiter. Each call is recorded and answered with the
+// next response scripted for the Limiter's key; once the script is
+// used up, every call is allowed at once. A Limiter never blocks:
+// Wait and WaitContext return immediately, which keeps tests
+// deterministic. Methods on Limiter may be called concurrently.
+type Limiter struct {
+	key string
+	s   *state
+}
+
+// state holds the state shared by a Limiter and the
+// Limiters returned by its For method.
+type state struct {
+	clock ratelimit.Clock
+
+	// mu guards the fields below it.
+	mu      sync.Mutex
+	scripts map[string][]Response
+	calls   []Call
+}
+
+var (
+	_ ratelimit.Allower = (*Limiter)(nil)
+	_ ratelimit.Taker   = (*Limiter)(nil)
+	_ ratelimit.Waiter  = (*Limiter)(nil)
+)
+
+// New returns a Limiter with no key that records call times
+// using the given clock. If clock is nil, the system clock
+// is used.
+func New(clock ratelimit.Clock) *Limiter {
+	return &Limiter{
+		s: &state{
+			clock:   clock,
+			scripts: make(map[string][]Response),
+		},
+	}
+}
+
+// For returns a Limiter that shares l's record of calls but
+// records its own calls under the given key and answers them
+// from the script for that key. This suits code that keeps a
+// limiter per user or per host.
+func (l *Limiter) For(key string) *Limiter {
+	return &Limiter{key: key, s: l.s}
+}
+
+// Script appends responses to the script for l's key.
+func (l *Limiter) Script(responses ...Response) {
+	l.s.mu.Lock()
+	defer l.s.mu.Unlock()
+	l.s.scripts[l.key] = append(l.s.scripts[l.key], responses...)
+}
+
+// Calls returns the calls made so far to l and to every Limiter
+// sharing its record, in the order they were made.
+func (l *Limiter) Calls() []Call {
+	l.s.mu.Lock()
+	defer l.s.mu.Unlock()
+	return append([]Call(nil), l.s.calls...)
+}
+
+// call records a call of the given method and returns the
+// response to it.
+func (l *Limiter) call(method string, count int64) Response {
+	now := time.Now()
+	if l.s.clock != nil {
+		now = l.s.clock.Now()
+	}
+	l.s.mu.Lock()
+	defer l.s.mu.Unlock()
+	l.s.calls = append(l.s.calls, Call{
+		Method: method,
+		Key:    l.key,
+		Count:  count,
+		Time:   now,
+	})
+	script := l.s.scripts[l.key]
+	if len(script) == 0 {
+		return Response{}
+	}
+	l.s.scripts[l.key] = script[1:]
+	return script[0]
+}
+
+// Allow implements ratelimit.Allower.Allow.
+func (l *Limiter) Allow(count int64) bool {
+	return !l.call("Allow", count).Refuse
+}
+
+// Take implements ratelimit.Taker.Take.
+func (l *Limiter) Take(count int64) time.Duration {
+	return l.call("Take", count).Wait
+}
+
+// TakeAvailable implements ratelimit.Taker.TakeAvailable.
+func (l *Limiter) TakeAvailable(count int64) int64 {
+	if l.call("TakeAvailable", count).Refuse {
+		return 0
+	}
+	return count
+}
+
+// Wait implements ratelimit.Waiter.Wait.
+func (l *Limiter) Wait(count int64) {
+	l.call("Wait", count)
+}
+
+// WaitContext implements ratelimit.Waiter.WaitContext. It returns
+// the scripted error if there is one, or otherwise ctx.Err().
+func (l *Limiter) WaitContext(ctx context.Context, count int64) error {
+	if err := l.call("WaitContext", count).Err; err != nil {
+		return err
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,80 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimittest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/ratelimit/testclock"
+)
+
+func TestPackage(t *testing.T) {
+	gc.TestingT(t)
+}
+
+type limiterSuite struct{}
+
+var _ = gc.Suite(limiterSuite{})
+
+func (limiterSuite) TestDefaultAllows(c *gc.C) {
+	start := time.Unix(1e9, 0)
+	clock := testclock.NewClock(start)
+	l := New(clock)
+	c.Assert(l.Allow(1), gc.Equals, true)
+	clock.Advance(time.Second)
+	c.Assert(l.Take(2), gc.Equals, time.Duration(0))
+	c.Assert(l.TakeAvailable(3), gc.Equals, int64(3))
+	l.Wait(4)
+	c.Assert(l.WaitContext(context.Background(), 5), gc.IsNil)
+	c.Assert(l.Calls(), gc.DeepEquals, []Call{
+		{Method: "Allow", Count: 1, Time: start},
+		{Method: "Take", Count: 2, Time: start.Add(time.Second)},
+		{Method: "TakeAvailable", Count: 3, Time: start.Add(time.Second)},
+		{Method: "Wait", Count: 4, Time: start.Add(time.Second)},
+		{Method: "WaitContext", Count: 5, Time: start.Add(time.Second)},
+	})
+}
+
+func (limiterSuite) TestScript(c *gc.C) {
+	l := New(nil)
+	errLimited := errors.New("limited")
+	l.Script(
+		Response{Refuse: true},
+		Response{Wait: time.Second},
+		Response{Refuse: true},
+		Response{Err: errLimited},
+	)
+	c.Assert(l.Allow(1), gc.Equals, false)
+	c.Assert(l.Take(1), gc.Equals, time.Second)
+	c.Assert(l.TakeAvailable(1), gc.Equals, int64(0))
+	c.Assert(l.WaitContext(context.Background(), 1), gc.Equals, errLimited)
+	c.Assert(l.Allow(1), gc.Equals, true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Assert(l.WaitContext(ctx, 1), gc.Equals, context.Canceled)
+}
+
+func (limiterSuite) TestFor(c *gc.C) {
+	l := New(nil)
+	alice, bob := l.For("alice"), l.For("bob")
+	alice.Script(Response{Refuse: true})
+	c.Assert(bob.Allow(1), gc.Equals, true)
+	c.Assert(alice.Allow(2), gc.Equals, false)
+	c.Assert(alice.Allow(3), gc.Equals, true)
+	c.Assert(l.Allow(4), gc.Equals, true)
+
+	calls := bob.Calls()
+	c.Assert(calls, gc.HasLen, 4)
+	for i, key := range []string{"bob", "alice", "alice", ""} {
+		c.Check(calls[i].Key, gc.Equals, key)
+		c.Check(calls[i].Count, gc.Equals, int64(i+1))
+	}
+}
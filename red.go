@@ -0,0 +1,108 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"math/rand"
+)
+
+// EarlyRejectParams holds the parameters for NewEarlyRejecter.
+type EarlyRejectParams struct {
+	// Threshold holds the fraction of the bucket's capacity,
+	// between 0 and 1, below which requests start to be
+	// rejected at random. If it is zero, 0.5 is used.
+	Threshold float64
+
+	// MaxProbability holds the probability, between 0 and 1,
+	// with which a request is rejected when the bucket is
+	// empty. Between Threshold and empty, the probability rises
+	// linearly from zero. If it is zero, 0.5 is used.
+	MaxProbability float64
+
+	// Rand, if not nil, is used instead of math/rand to
+	// return random numbers in [0, 1). It must be safe
+	// to call concurrently.
+	Rand func() float64
+}
+
+// EarlyRejecter limits requests with a bucket, as Bucket.Allow
+// does, but starts rejecting requests at random, with increasing
+// probability, as the bucket approaches empty, in the manner of
+// random early detection. Clients that are refused then back off
+// and retry at different times, instead of all being cut off
+// together when the bucket runs out and retrying together when it
+// refills.
+type EarlyRejecter struct {
+	tb     *Bucket
+	params EarlyRejectParams
+}
+
+var _ Allower = (*EarlyRejecter)(nil)
+
+// NewEarlyRejecter returns an EarlyRejecter that limits
+// requests with tb according to p.
+func NewEarlyRejecter(tb *Bucket, p EarlyRejectParams) *EarlyRejecter {
+	if p.Threshold == 0 {
+		p.Threshold = 0.5
+	}
+	if !(p.Threshold > 0 && p.Threshold <= 1) {
+		panic("early rejection threshold is not in (0, 1]")
+	}
+	if p.MaxProbability == 0 {
+		p.MaxProbability = 0.5
+	}
+	if !(p.MaxProbability > 0 && p.MaxProbability <= 1) {
+		panic("early rejection probability is not in (0, 1]")
+	}
+	if p.Rand == nil {
+		p.Rand = rand.Float64
+	}
+	return &EarlyRejecter{
+		tb:     tb,
+		params: p,
+	}
+}
+
+// Bucket returns the bucket that limits the requests.
+func (r *EarlyRejecter) Bucket() *Bucket {
+	return r.tb
+}
+
+// Allow reports whether count tokens were taken from the bucket.
+// It takes them only if they are available and the request is
+// not rejected early.
+func (r *EarlyRejecter) Allow(count int64) bool {
+	tb := r.tb
+	tb.mu.Lock()
+	defer tb.unlock()
+	now := tb.clock.Now()
+	tb.adjust(now)
+	if tb.disabled {
+		return true
+	}
+	if p := r.probability(tb.availableTokens, tb.capacity); p > 0 && r.params.Rand() < p {
+		tb.throttled(now, count, 0, true)
+		if tb.dryRun == nil {
+			return false
+		}
+		tb.wouldLimit(count, 0, true)
+		return true
+	}
+	_, ok := tb.tryTake(now, count)
+	return ok
+}
+
+// probability returns the probability with which a request
+// should be rejected early when the bucket holds avail tokens.
+func (r *EarlyRejecter) probability(avail, capacity int64) float64 {
+	f := float64(avail) / float64(capacity)
+	switch {
+	case f >= r.params.Threshold:
+		return 0
+	case f <= 0:
+		return r.params.MaxProbability
+	}
+	return r.params.MaxProbability * (r.params.Threshold - f) / r.params.Threshold
+}
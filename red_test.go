@@ -0,0 +1,45 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type redSuite struct{}
+
+var _ = gc.Suite(redSuite{})
+
+func (redSuite) TestEarlyRejecter(c *gc.C) {
+	tb := NewBucket(time.Hour, 10)
+	rnd := 0.3
+	r := NewEarlyRejecter(tb, EarlyRejectParams{
+		Threshold:      0.5,
+		MaxProbability: 0.8,
+		Rand:           func() float64 { return rnd },
+	})
+
+	// Above the threshold, nothing is rejected early.
+	c.Assert(r.Allow(5), gc.Equals, true)
+
+	// At 5 of 10 tokens, the probability is still zero; at 4,
+	// it is 0.8*(0.5-0.4)/0.5 = 0.16, at 3 it is 0.32.
+	c.Assert(r.Allow(1), gc.Equals, true)
+	c.Assert(r.Allow(1), gc.Equals, true)
+	c.Assert(r.Allow(1), gc.Equals, false)
+	c.Assert(tb.Available(), gc.Equals, int64(3))
+
+	// Luckier requests are let through until the bucket is
+	// empty, after which none are.
+	rnd = 0.9
+	c.Assert(r.Allow(3), gc.Equals, true)
+	c.Assert(r.Allow(1), gc.Equals, false)
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+
+	c.Assert(r.probability(-5, 10), gc.Equals, 0.8)
+	c.Assert(r.probability(10, 10), gc.Equals, 0.0)
+}
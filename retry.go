@@ -0,0 +1,103 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// RetryPolicy holds the parameters for Do.
+type RetryPolicy struct {
+	// MaxAttempts holds the largest number of times to call the
+	// function. If it is zero, there is no limit other than the
+	// context.
+	MaxAttempts int
+
+	// Backoff describes the interval to wait after each failed
+	// attempt, in addition to the wait for tokens, as for
+	// NewBackoffLimiter. If Backoff.Initial is zero, attempts
+	// are paced by the bucket and by retry hints alone.
+	Backoff BackoffParams
+
+	// Retryable, if not nil, reports whether an error returned
+	// by the function is worth retrying. If it is nil, every
+	// error is.
+	Retryable func(error) bool
+}
+
+// RetryAfterError is an error that carries a hint of how long to
+// wait before retrying, such as from a Retry-After header.
+type RetryAfterError struct {
+	Err   error
+	After time.Duration
+}
+
+// RetryAfter returns an error that wraps err and tells Do
+// to wait at least d before the next attempt.
+func RetryAfter(err error, d time.Duration) error {
+	return &RetryAfterError{Err: err, After: d}
+}
+
+// Error implements error.
+func (e *RetryAfterError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the wrapped error.
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+// Do calls fn until it succeeds, as allowed by the policy p, taking
+// a token from tb before each attempt, so that retries are limited
+// together with first attempts rather than competing with them.
+// After a failed attempt it waits for the policy's backoff interval
+// or, if fn returned an error wrapping a RetryAfterError, for its
+// hint if that is longer.
+//
+// Do gives up, returning the error from the latest attempt, when fn
+// returns an error that is not retryable, when the attempts run out,
+// or when ctx is done or its deadline would pass before the next
+// attempt could be made. If it gives up before any attempt, it
+// returns the error from Bucket.WaitContext.
+func Do(ctx context.Context, tb *Bucket, p RetryPolicy, fn func(context.Context) error) error {
+	if p.MaxAttempts < 0 {
+		panic("retry max attempts is negative")
+	}
+	p.Backoff.setDefaults()
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		if err := tb.WaitContext(ctx, 1); err != nil {
+			if lastErr != nil {
+				return lastErr
+			}
+			return err
+		}
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if attempt == p.MaxAttempts || (p.Retryable != nil && !p.Retryable(err)) {
+			return err
+		}
+		d := p.Backoff.interval(attempt)
+		var hint *RetryAfterError
+		if errors.As(err, &hint) && hint.After > d {
+			d = hint.After
+		}
+		if d <= 0 {
+			continue
+		}
+		if d > maxWaitBefore(ctx, tb.clock.Now()) {
+			return err
+		}
+		if tb.sleepContext(ctx, d) != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type retrySuite struct{}
+
+var _ = gc.Suite(retrySuite{})
+
+func (retrySuite) TestDo(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Second, 1, clock)
+	errBusy := errors.New("busy")
+	var attempts []time.Time
+	err := Do(context.Background(), tb, RetryPolicy{
+		Backoff: BackoffParams{Initial: 2 * time.Second},
+	}, func(context.Context) error {
+		attempts = append(attempts, clock.now)
+		switch len(attempts) {
+		case 1, 2:
+			return errBusy
+		case 3:
+			return RetryAfter(errBusy, 10*time.Second)
+		}
+		return nil
+	})
+	c.Assert(err, gc.IsNil)
+
+	// The attempts wait for the backoff interval of 2s, then
+	// 4s, then the 10s hint, during which the bucket refills.
+	start := time.Unix(1e9, 0)
+	c.Assert(attempts, gc.DeepEquals, []time.Time{
+		start,
+		start.Add(2 * time.Second),
+		start.Add(6 * time.Second),
+		start.Add(16 * time.Second),
+	})
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+}
+
+func (retrySuite) TestDoGivesUp(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Millisecond, 10, clock)
+	errBusy := errors.New("busy")
+	errDenied := errors.New("denied")
+	calls := 0
+	busy := func(context.Context) error {
+		calls++
+		return errBusy
+	}
+
+	err := Do(context.Background(), tb, RetryPolicy{MaxAttempts: 3}, busy)
+	c.Assert(err, gc.Equals, errBusy)
+	c.Assert(calls, gc.Equals, 3)
+
+	calls = 0
+	err = Do(context.Background(), tb, RetryPolicy{
+		Retryable: func(err error) bool { return err != errDenied },
+	}, func(context.Context) error {
+		calls++
+		return errDenied
+	})
+	c.Assert(err, gc.Equals, errDenied)
+	c.Assert(calls, gc.Equals, 1)
+
+	// A hint beyond the deadline ends the retries at once.
+	calls = 0
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err = Do(ctx, NewBucket(time.Millisecond, 10), RetryPolicy{}, func(context.Context) error {
+		calls++
+		return RetryAfter(errBusy, time.Hour)
+	})
+	c.Assert(errors.Is(err, errBusy), gc.Equals, true)
+	c.Assert(calls, gc.Equals, 1)
+}
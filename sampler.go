@@ -0,0 +1,61 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"math/rand"
+)
+
+// SamplerParams holds the parameters for NewSampler.
+type SamplerParams struct {
+	// Probability holds the fraction of events, between 0 and 1,
+	// to let through before the bucket's limit applies.
+	Probability float64
+
+	// Rand, if not nil, is used instead of math/rand to
+	// return random numbers in [0, 1). It must be safe
+	// to call concurrently.
+	Rand func() float64
+}
+
+// Sampler lets through a random sample of events, such as traces
+// or log records, capped at the rate of a bucket: for instance,
+// roughly 1% of events, but never more than 100 a second. Events
+// that are not sampled take no tokens.
+type Sampler struct {
+	tb     *Bucket
+	params SamplerParams
+}
+
+var _ Allower = (*Sampler)(nil)
+
+// NewSampler returns a Sampler that samples events according to
+// p and caps the sampled events with tb.
+func NewSampler(tb *Bucket, p SamplerParams) *Sampler {
+	if !(p.Probability >= 0 && p.Probability <= 1) {
+		panic("sampler probability is not in [0, 1]")
+	}
+	if p.Rand == nil {
+		p.Rand = rand.Float64
+	}
+	return &Sampler{
+		tb:     tb,
+		params: p,
+	}
+}
+
+// Bucket returns the bucket that caps the sampled events.
+func (s *Sampler) Bucket() *Bucket {
+	return s.tb
+}
+
+// Allow reports whether an event costing count tokens is sampled
+// and the tokens were available and taken from the bucket.
+func (s *Sampler) Allow(count int64) bool {
+	if s.params.Rand() >= s.params.Probability {
+		return false
+	}
+	return s.tb.Allow(count)
+}
@@ -0,0 +1,42 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type samplerSuite struct{}
+
+var _ = gc.Suite(samplerSuite{})
+
+func (samplerSuite) TestSampler(c *gc.C) {
+	tb := NewBucket(time.Hour, 2)
+	var n int
+	s := NewSampler(tb, SamplerParams{
+		Probability: 0.25,
+		// Every fourth event is below the probability.
+		Rand: func() float64 {
+			n++
+			return float64(n%4) / 4
+		},
+	})
+
+	var allowed int
+	for i := 0; i < 20; i++ {
+		if s.Allow(1) {
+			allowed++
+		}
+	}
+	// Five events were sampled, but only two were allowed
+	// by the bucket.
+	c.Assert(allowed, gc.Equals, 2)
+	c.Assert(n, gc.Equals, 20)
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+
+	c.Assert(func() { NewSampler(tb, SamplerParams{Probability: 2}) }, gc.PanicMatches, `sampler probability is not in \[0, 1\]`)
+}
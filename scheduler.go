@@ -0,0 +1,305 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrSchedulerStopped is returned by Queue.Wait when
+// the scheduler is stopped before tokens are granted.
+var ErrSchedulerStopped = errors.New("scheduler stopped")
+
+// Scheduler shares the tokens of one bucket between several queues
+// of waiting callers using deficit round robin: the queues are
+// visited in turn, and on each visit a queue may be granted tokens
+// up to its quantum plus whatever it left unused on earlier visits
+// while it had callers waiting. Each queue is thus granted a share
+// of the bucket's rate in proportion to its quantum, however many
+// callers wait on the others, and callers in the same queue are
+// granted tokens in arrival order.
+type Scheduler struct {
+	tb *Bucket
+
+	// ctx is cancelled when the scheduler is stopped.
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// wake is signalled when a caller starts waiting.
+	wake chan struct{}
+
+	// mu guards the fields below it.
+	mu sync.Mutex
+
+	queues []*Queue
+
+	// cur holds the index of the queue being visited and
+	// visited reports whether it has been given its
+	// quantum for this visit.
+	cur     int
+	visited bool
+
+	// pending holds the number of callers waiting
+	// in all the queues.
+	pending int
+}
+
+// Queue holds callers waiting for tokens from a Scheduler.
+type Queue struct {
+	s       *Scheduler
+	quantum int64
+
+	// The fields below are guarded by s.mu.
+
+	// deficit holds the number of tokens the queue may
+	// still be granted on the current visit.
+	deficit int64
+	waiters []*schedWaiter
+}
+
+// schedWaiter represents a caller waiting in a Queue.
+type schedWaiter struct {
+	count int64
+
+	// ready is closed when the tokens have been granted.
+	ready chan struct{}
+
+	// done is closed when the scheduler has finished
+	// with the waiter.
+	done chan struct{}
+
+	// dispatched is set, under s.mu, when the waiter has been
+	// removed from its queue to be granted tokens, and
+	// abandoned when the caller gives up after that.
+	dispatched bool
+	abandoned  bool
+
+	// ctx and cancel are set when the waiter is dispatched;
+	// cancel stops the scheduler waiting for the tokens on
+	// its behalf.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewScheduler returns a scheduler that grants tokens from tb
+// until Stop is called. The scheduler should be the only user of
+// the bucket, as callers that take tokens from it directly are
+// not subject to its fairness.
+func NewScheduler(tb *Bucket) *Scheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Scheduler{
+		tb:     tb,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		wake:   make(chan struct{}, 1),
+	}
+	go s.run()
+	return s
+}
+
+// NewQueue returns a new queue served by the scheduler with
+// the given quantum, which must be positive. The quantum
+// should be at least the number of tokens usually requested.
+func (s *Scheduler) NewQueue(quantum int64) *Queue {
+	if quantum <= 0 {
+		panic("scheduler queue quantum is not > 0")
+	}
+	q := &Queue{
+		s:       s,
+		quantum: quantum,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queues = append(s.queues, q)
+	return q
+}
+
+// Wait waits until the scheduler grants count tokens to the
+// caller, or until ctx is done or the scheduler is stopped, in
+// which case it takes nothing and returns the context's error or
+// ErrSchedulerStopped.
+func (q *Queue) Wait(ctx context.Context, count int64) error {
+	if count <= 0 {
+		return nil
+	}
+	w := &schedWaiter{
+		count: count,
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	s := q.s
+	s.mu.Lock()
+	q.waiters = append(q.waiters, w)
+	s.pending++
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-s.ctx.Done():
+		err = ErrSchedulerStopped
+	}
+	s.mu.Lock()
+	if !w.dispatched {
+		q.remove(w)
+		s.mu.Unlock()
+		return err
+	}
+	// The scheduler is already waiting for the tokens on our
+	// behalf, so stop it and wait for it to return them.
+	w.abandoned = true
+	s.mu.Unlock()
+	w.cancel()
+	<-w.done
+	select {
+	case <-w.ready:
+		// The tokens were granted after all.
+		return nil
+	default:
+	}
+	return err
+}
+
+// remove removes w from the queue. Called with q.s.mu held.
+func (q *Queue) remove(w *schedWaiter) {
+	for i, qw := range q.waiters {
+		if qw == w {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			q.s.pending--
+			break
+		}
+	}
+	if len(q.waiters) == 0 {
+		q.deficit = 0
+	}
+}
+
+func (s *Scheduler) run() {
+	defer close(s.done)
+	for {
+		w := s.next()
+		if w == nil {
+			return
+		}
+		s.tb.mu.Lock()
+		d, taken, ok := s.tb.charge(s.tb.clock.Now(), w.count, infinityDuration)
+		s.tb.unlock()
+		if !ok {
+			// As with Take, the tokens will never be
+			// available, so wait until the waiter gives up.
+			d = infinityDuration
+		}
+		err := s.tb.sleepContext(w.ctx, d)
+		s.mu.Lock()
+		if err != nil || w.abandoned {
+			s.tb.putBack(taken)
+		} else {
+			close(w.ready)
+		}
+		s.mu.Unlock()
+		w.cancel()
+		close(w.done)
+		if s.ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// next waits for a caller to be waiting and returns the
+// next one to be granted tokens, or nil if the scheduler
+// has been stopped.
+func (s *Scheduler) next() *schedWaiter {
+	for {
+		s.mu.Lock()
+		w := s.pick()
+		s.mu.Unlock()
+		if w != nil {
+			return w
+		}
+		select {
+		case <-s.wake:
+		case <-s.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// pick removes and returns the next waiter to be granted tokens,
+// or nil if there are none. Called with s.mu held.
+func (s *Scheduler) pick() *schedWaiter {
+	if s.pending == 0 {
+		return nil
+	}
+	for {
+		for range s.queues {
+			q := s.queues[s.cur]
+			if len(q.waiters) > 0 {
+				if !s.visited {
+					q.deficit += q.quantum
+					s.visited = true
+				}
+				if w := q.waiters[0]; w.count <= q.deficit {
+					q.deficit -= w.count
+					w.dispatched = true
+					w.ctx, w.cancel = context.WithCancel(s.ctx)
+					q.remove(w)
+					return w
+				}
+			}
+			s.cur = (s.cur + 1) % len(s.queues)
+			s.visited = false
+		}
+		// A whole round went by without a grant, so
+		// skip the rounds that would grant nothing too.
+		s.skipRounds()
+	}
+}
+
+// skipRounds credits the queues with waiters with the quanta
+// of every round before the next one in which a waiter can be
+// granted its tokens, so that a waiter asking for many times its
+// queue's quantum does not make pick go round once per quantum.
+// Called with s.mu held, at the start of a round.
+func (s *Scheduler) skipRounds() {
+	rounds := int64(-1)
+	for _, q := range s.queues {
+		if len(q.waiters) == 0 {
+			continue
+		}
+		missing := q.waiters[0].count - q.deficit
+		if r := (missing-1)/q.quantum + 1; rounds < 0 || r < rounds {
+			rounds = r
+		}
+	}
+	if rounds <= 1 {
+		return
+	}
+	// No queue can be granted its tokens in the skipped rounds,
+	// so no deficit reaches its head waiter's count, and none
+	// can overflow.
+	for _, q := range s.queues {
+		if len(q.waiters) > 0 {
+			q.deficit += (rounds - 1) * q.quantum
+		}
+	}
+}
+
+// Stop stops the scheduler. Callers still waiting
+// return ErrSchedulerStopped.
+func (s *Scheduler) Stop() {
+	s.cancel()
+	<-s.done
+}
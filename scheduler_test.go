@@ -0,0 +1,101 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type schedulerSuite struct{}
+
+var _ = gc.Suite(schedulerSuite{})
+
+func (schedulerSuite) TestPick(c *gc.C) {
+	// Use a scheduler that is not running so that
+	// waiters can be picked one at a time.
+	s := &Scheduler{ctx: context.Background()}
+	a, b, idle := s.NewQueue(3), s.NewQueue(2), s.NewQueue(5)
+	names := make(map[*schedWaiter]string)
+	add := func(q *Queue, name string, count int64) {
+		w := &schedWaiter{count: count}
+		names[w] = name
+		q.waiters = append(q.waiters, w)
+		s.pending++
+	}
+	for i := 0; i < 6; i++ {
+		add(a, "a", 1)
+	}
+	add(b, "b1", 1)
+	add(b, "b3", 3)
+	add(b, "b1", 1)
+	var order []string
+	for w := s.pick(); w != nil; w = s.pick() {
+		order = append(order, names[w])
+	}
+	c.Assert(order, gc.DeepEquals, []string{
+		"a", "a", "a", "b1",
+		"a", "a", "a", "b3",
+		"b1",
+	})
+	c.Assert(idle.deficit, gc.Equals, int64(0))
+}
+
+func (schedulerSuite) TestPickLargeCount(c *gc.C) {
+	s := &Scheduler{ctx: context.Background()}
+	a, b := s.NewQueue(1), s.NewQueue(2)
+	huge := &schedWaiter{count: math.MaxInt64}
+	a.waiters = append(a.waiters, huge)
+	large := &schedWaiter{count: 7}
+	b.waiters = append(b.waiters, large)
+	s.pending = 2
+
+	// Rounds that grant nothing are skipped, with the same
+	// result as going through them one at a time.
+	c.Assert(s.pick(), gc.Equals, large)
+	c.Assert(a.deficit, gc.Equals, int64(4))
+	c.Assert(b.deficit, gc.Equals, int64(0))
+	c.Assert(s.pick(), gc.Equals, huge)
+	c.Assert(a.deficit, gc.Equals, int64(0))
+	c.Assert(s.pick(), gc.IsNil)
+}
+
+func (schedulerSuite) TestWait(c *gc.C) {
+	tb := NewBucket(time.Millisecond, 1)
+	s := NewScheduler(tb)
+	defer s.Stop()
+	a, b := s.NewQueue(1), s.NewQueue(1)
+
+	var wg sync.WaitGroup
+	for _, q := range []*Queue{a, b, a, b} {
+		wg.Add(1)
+		go func(q *Queue) {
+			defer wg.Done()
+			c.Check(q.Wait(context.Background(), 1), gc.IsNil)
+		}(q)
+	}
+	wg.Wait()
+
+	// A caller that gives up takes nothing.
+	tb.TakeAvailable(1)
+	tb.SetRate(0.001)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	c.Assert(a.Wait(ctx, 1), gc.Equals, context.DeadlineExceeded)
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+
+	done := make(chan error)
+	go func() {
+		done <- b.Wait(context.Background(), 1)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	s.Stop()
+	c.Assert(<-done, gc.Equals, ErrSchedulerStopped)
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+}
@@ -0,0 +1,236 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServerLimit holds the limits that a server advertises in
+// the headers of its responses.
+type ServerLimit struct {
+	// Limit holds the number of requests allowed in each
+	// window, or zero if it was not given.
+	Limit int64
+
+	// Remaining holds the number of requests remaining in the
+	// current window, or -1 if it was not given.
+	Remaining int64
+
+	// Reset holds the time until the current window ends,
+	// or zero if it was not given.
+	Reset time.Duration
+
+	// RetryAfter holds the time to wait before retrying, from
+	// a Retry-After header, or zero if there was none.
+	RetryAfter time.Duration
+}
+
+// ParseServerLimit parses the rate limit headers in h, as of the
+// given time, and reports whether there were any. It understands
+// Retry-After, in seconds or as a date; the X-RateLimit-Limit,
+// X-RateLimit-Remaining and X-RateLimit-Reset headers used by many
+// APIs; the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset
+// headers of the IETF draft; and the combined RateLimit header of
+// later drafts, such as "limit=100, remaining=50, reset=30" or
+// `"default";r=50;t=30`. Where more than one form is present, the
+// later ones take precedence. A reset value large enough to be a
+// Unix time, as some APIs send, is taken to be one.
+func ParseServerLimit(h http.Header, now time.Time) (ServerLimit, bool) {
+	l := ServerLimit{Remaining: -1}
+	found := false
+	for _, prefix := range []string{"X-RateLimit-", "RateLimit-"} {
+		if v, ok := headerInt(h, prefix+"Limit"); ok {
+			l.Limit, found = v, true
+		}
+		if v, ok := headerInt(h, prefix+"Remaining"); ok {
+			l.Remaining, found = v, true
+		}
+		if v, ok := headerInt(h, prefix+"Reset"); ok {
+			l.Reset, found = resetDuration(v, now), true
+		}
+	}
+	if v := h.Get("RateLimit"); v != "" {
+		for _, item := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ';' }) {
+			key, val, ok := strings.Cut(strings.TrimSpace(item), "=")
+			if !ok {
+				continue
+			}
+			n, err := strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+			if err != nil || n < 0 {
+				continue
+			}
+			switch strings.TrimSpace(key) {
+			case "limit":
+				l.Limit, found = n, true
+			case "remaining", "r":
+				l.Remaining, found = n, true
+			case "reset", "t":
+				l.Reset, found = resetDuration(n, now), true
+			}
+		}
+	}
+	if v := strings.TrimSpace(h.Get("Retry-After")); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n >= 0 {
+			l.RetryAfter, found = mulDuration(n, time.Second), true
+		} else if t, err := http.ParseTime(v); err == nil {
+			l.RetryAfter, found = max(t.Sub(now), 0), true
+		}
+	}
+	return l, found
+}
+
+// headerInt returns the value of the named header
+// as a non-negative integer, if it has one.
+func headerInt(h http.Header, name string) (int64, bool) {
+	v := h.Get(name)
+	if v == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// resetDuration returns the time until a window reset given as
+// v seconds, or as a Unix time if v is large enough to be one.
+func resetDuration(v int64, now time.Time) time.Duration {
+	if v >= 1e9 {
+		return max(time.Unix(v, 0).Sub(now), 0)
+	}
+	return mulDuration(v, time.Second)
+}
+
+// ServerPacedTransport is an http.RoundTripper that paces requests
+// to a server with a bucket, and adjusts the bucket's rate to match
+// the budget the server advertises in its responses, as parsed by
+// ParseServerLimit, so that clients need not hard-code the limits
+// of third-party APIs. After each response that gives the number of
+// requests remaining and the time until the window resets, the rate
+// is set to spread the remaining requests over that time, and any
+// tokens the bucket holds beyond the number remaining are removed,
+// so that a full bucket cannot burst past the server's budget. Once none
+// remain, or after a Retry-After header, requests are held back
+// until the server says they may be made again. So that a
+// misbehaving server cannot stall the client indefinitely, holds
+// and windows longer than maxServerHold are taken to be that long.
+type ServerPacedTransport struct {
+	tb   *Bucket
+	next http.RoundTripper
+
+	// mu guards the fields below it.
+	mu sync.Mutex
+
+	// until holds the time before which no
+	// requests may be made.
+	until time.Time
+}
+
+// maxServerHold holds the longest time for which a server's
+// headers may hold back requests.
+const maxServerHold = 24 * time.Hour
+
+// NewServerPacedTransport returns a transport that paces requests
+// with tb before passing them to next, or to http.DefaultTransport
+// if next is nil. The bucket's rate and capacity at the start
+// apply until the server advertises its limits.
+func NewServerPacedTransport(tb *Bucket, next http.RoundTripper) *ServerPacedTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &ServerPacedTransport{
+		tb:   tb,
+		next: next,
+	}
+}
+
+// Bucket returns the bucket that paces the requests.
+func (t *ServerPacedTransport) Bucket() *Bucket {
+	return t.tb
+}
+
+// RoundTrip implements http.RoundTripper. If the request's context
+// is done first, or its deadline is too soon, the request fails
+// with the error from Bucket.WaitContext without being sent.
+func (t *ServerPacedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.wait(req); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err == nil {
+		t.update(resp.Header)
+	}
+	return resp, err
+}
+
+// wait waits until the request may be sent.
+func (t *ServerPacedTransport) wait(req *http.Request) error {
+	ctx := req.Context()
+	t.mu.Lock()
+	until := t.until
+	t.mu.Unlock()
+	if d := until.Sub(t.tb.clock.Now()); d > 0 {
+		if deadline, ok := ctx.Deadline(); ok && deadline.Before(until) {
+			return ErrDeadline
+		}
+		if err := t.tb.sleepContext(ctx, d); err != nil {
+			return err
+		}
+	}
+	return t.tb.WaitContext(ctx, 1)
+}
+
+// update adjusts the pacing to the limits
+// advertised in a response's headers.
+func (t *ServerPacedTransport) update(h http.Header) {
+	now := t.tb.clock.Now()
+	l, ok := ParseServerLimit(h, now)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if l.RetryAfter > 0 {
+		t.holdUntil(now.Add(min(l.RetryAfter, maxServerHold)))
+	}
+	if l.Remaining < 0 || l.Reset <= 0 {
+		return
+	}
+	reset := min(l.Reset, maxServerHold)
+	if l.Remaining == 0 {
+		t.holdUntil(now.Add(reset))
+		return
+	}
+	rate := float64(l.Remaining) / reset.Seconds()
+	t.tb.SetRate(min(max(rate, minRate), maxRate))
+	t.tb.limitAvailable(l.Remaining)
+}
+
+// limitAvailable removes any tokens beyond count from the bucket.
+func (tb *Bucket) limitAvailable(count int64) {
+	tb.mu.Lock()
+	defer tb.unlock()
+	tb.adjust(tb.clock.Now())
+	if tb.availableTokens > count {
+		tb.availableTokens = count
+	}
+}
+
+// holdUntil holds back requests until at least the given time.
+// It must be called with t.mu held.
+func (t *ServerPacedTransport) holdUntil(until time.Time) {
+	if until.After(t.until) {
+		t.until = until
+	}
+}
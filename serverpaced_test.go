@@ -0,0 +1,188 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type serverPacedSuite struct{}
+
+var _ = gc.Suite(serverPacedSuite{})
+
+var parseServerLimitTests = []struct {
+	about  string
+	header http.Header
+	expect ServerLimit
+	found  bool
+}{{
+	about:  "no headers",
+	header: http.Header{},
+	expect: ServerLimit{Remaining: -1},
+}, {
+	about: "x-ratelimit headers with a unix reset time",
+	header: http.Header{
+		"X-Ratelimit-Limit":     {"5000"},
+		"X-Ratelimit-Remaining": {"4999"},
+		"X-Ratelimit-Reset":     {"1000000060"},
+	},
+	expect: ServerLimit{Limit: 5000, Remaining: 4999, Reset: time.Minute},
+	found:  true,
+}, {
+	about: "draft headers take precedence",
+	header: http.Header{
+		"X-Ratelimit-Remaining": {"10"},
+		"Ratelimit-Remaining":   {"7"},
+		"Ratelimit-Reset":       {"30"},
+	},
+	expect: ServerLimit{Remaining: 7, Reset: 30 * time.Second},
+	found:  true,
+}, {
+	about:  "combined header",
+	header: http.Header{"Ratelimit": {"limit=100, remaining=50, reset=5"}},
+	expect: ServerLimit{Limit: 100, Remaining: 50, Reset: 5 * time.Second},
+	found:  true,
+}, {
+	about:  "structured combined header",
+	header: http.Header{"Ratelimit": {`"default";r=0;t=12`}},
+	expect: ServerLimit{Remaining: 0, Reset: 12 * time.Second},
+	found:  true,
+}, {
+	about:  "retry-after seconds",
+	header: http.Header{"Retry-After": {"120"}},
+	expect: ServerLimit{Remaining: -1, RetryAfter: 2 * time.Minute},
+	found:  true,
+}, {
+	about:  "retry-after date",
+	header: http.Header{"Retry-After": {"Sun, 09 Sep 2001 01:47:10 GMT"}},
+	expect: ServerLimit{Remaining: -1, RetryAfter: 30 * time.Second},
+	found:  true,
+}, {
+	about:  "huge values",
+	header: http.Header{"Retry-After": {"9223372036854775807"}, "Ratelimit-Reset": {"999999999"}},
+	expect: ServerLimit{Remaining: -1, Reset: 999999999 * time.Second, RetryAfter: infinityDuration},
+	found:  true,
+}, {
+	about:  "invalid values",
+	header: http.Header{"X-Ratelimit-Remaining": {"-1"}, "Retry-After": {"soon"}},
+	expect: ServerLimit{Remaining: -1},
+}}
+
+func (serverPacedSuite) TestParseServerLimit(c *gc.C) {
+	now := time.Unix(1e9, 0)
+	for i, test := range parseServerLimitTests {
+		c.Logf("test %d: %s", i, test.about)
+		l, found := ParseServerLimit(test.header, now)
+		c.Assert(found, gc.Equals, test.found)
+		c.Assert(l, gc.Equals, test.expect)
+	}
+}
+
+func (serverPacedSuite) TestServerPacedTransport(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Millisecond, 1, clock)
+	header := http.Header{}
+	var sent []time.Time
+	rt := NewServerPacedTransport(tb, roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		sent = append(sent, clock.now)
+		return &http.Response{StatusCode: http.StatusOK, Header: header}, nil
+	}))
+	get := func() error {
+		req, err := http.NewRequest("GET", "https://api.example.com/", nil)
+		c.Assert(err, gc.IsNil)
+		_, err = rt.RoundTrip(req)
+		return err
+	}
+
+	// Ten requests remain in the next 20 seconds, so they
+	// are paced at one every two seconds.
+	header.Set("RateLimit", "remaining=10, reset=20")
+	c.Assert(get(), gc.IsNil)
+	c.Assert(get(), gc.IsNil)
+	c.Assert(sent[1].Sub(sent[0]), gc.Equals, 2*time.Second)
+	c.Assert(isCloseTo(tb.Rate(), 0.5, rateMargin), gc.Equals, true)
+
+	// None remain, so the next request waits for the reset.
+	header.Set("RateLimit", "remaining=0, reset=20")
+	c.Assert(get(), gc.IsNil)
+	c.Assert(get(), gc.IsNil)
+	c.Assert(sent[3].Sub(sent[2]), gc.Equals, 20*time.Second)
+
+	// A request that cannot wait that long is not sent.
+	header = http.Header{"Retry-After": {"3600"}}
+	c.Assert(get(), gc.IsNil)
+	ctx, cancel := context.WithDeadline(context.Background(), clock.now.Add(time.Minute))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://api.example.com/", nil)
+	c.Assert(err, gc.IsNil)
+	_, err = rt.RoundTrip(req)
+	c.Assert(err, gc.Equals, ErrDeadline)
+	c.Assert(sent, gc.HasLen, 5)
+}
+
+func (serverPacedSuite) TestServerPacedTransportRemaining(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Millisecond, 100, clock)
+	header := http.Header{}
+	var sent []time.Time
+	rt := NewServerPacedTransport(tb, roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		sent = append(sent, clock.now)
+		return &http.Response{StatusCode: http.StatusOK, Header: header}, nil
+	}))
+	get := func() {
+		req, err := http.NewRequest("GET", "https://api.example.com/", nil)
+		c.Assert(err, gc.IsNil)
+		_, err = rt.RoundTrip(req)
+		c.Assert(err, gc.IsNil)
+	}
+
+	// The bucket holds more tokens than the server has requests
+	// left, so the excess is removed rather than sent as a burst.
+	header.Set("RateLimit", "remaining=3, reset=30")
+	get()
+	c.Assert(tb.Available(), gc.Equals, int64(3))
+	for i := 0; i < 4; i++ {
+		get()
+	}
+	c.Assert(sent[3].Sub(sent[0]), gc.Equals, time.Duration(0))
+	c.Assert(sent[4].Sub(sent[3]), gc.Equals, 10*time.Second)
+}
+
+func (serverPacedSuite) TestServerPacedTransportHostileHeaders(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Millisecond, 1, clock)
+	header := http.Header{}
+	rt := NewServerPacedTransport(tb, roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Header: header}, nil
+	}))
+	get := func() {
+		req, err := http.NewRequest("GET", "https://api.example.com/", nil)
+		c.Assert(err, gc.IsNil)
+		_, err = rt.RoundTrip(req)
+		c.Assert(err, gc.IsNil)
+	}
+
+	// Rates out of range are clamped rather than panicking.
+	header.Set("X-RateLimit-Remaining", "1")
+	header.Set("X-RateLimit-Reset", "999999999")
+	get()
+	c.Assert(isCloseTo(tb.Rate(), 1/maxServerHold.Seconds(), rateMargin), gc.Equals, true)
+	header.Set("X-RateLimit-Remaining", "9223372036854775807")
+	header.Set("X-RateLimit-Reset", "1")
+	get()
+	c.Assert(isCloseTo(tb.Rate(), maxRate, rateMargin), gc.Equals, true)
+
+	// Holds are capped.
+	header = http.Header{"Retry-After": {"9223372036854775807"}}
+	start := clock.now
+	get()
+	get()
+	held := clock.now.Sub(start)
+	c.Assert(held >= maxServerHold && held < maxServerHold+time.Second, gc.Equals, true, gc.Commentf("held for %v", held))
+}
@@ -0,0 +1,210 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"math"
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"time"
+)
+
+// ShedSignal describes a measure of process load that a Shedder
+// reacts to.
+type ShedSignal struct {
+	// Probe returns the current value of the measure.
+	Probe func() float64
+
+	// Threshold holds the value above which the rate
+	// starts to be reduced.
+	Threshold float64
+
+	// Limit holds the value, greater than Threshold, at and
+	// above which the rate is reduced to its minimum. Between
+	// Threshold and Limit, the rate is reduced linearly.
+	Limit float64
+}
+
+// ShedderParams holds the parameters for NewShedder.
+type ShedderParams struct {
+	// Signals holds the load measures to react to. The rate
+	// is scaled by the smallest factor any of them calls for.
+	Signals []ShedSignal
+
+	// MinFactor holds the smallest factor, between 0 and 1,
+	// by which the rate may be scaled. If it is zero, 0.1
+	// is used.
+	MinFactor float64
+
+	// Interval holds how often the signals are sampled.
+	// It must be positive.
+	Interval time.Duration
+}
+
+// Shedder scales down the rate of a bucket while the process is
+// overloaded, so that load shedding starts even if the bucket's
+// configured rate is too high for the capacity currently
+// available. The rate the bucket had when the Shedder was created
+// is restored as the load subsides.
+type Shedder struct {
+	tb       *Bucket
+	params   ShedderParams
+	baseRate float64
+
+	// mu guards factor.
+	mu     sync.Mutex
+	factor float64
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewShedder returns a shedder that adjusts the rate of tb
+// according to p, sampling the signals every p.Interval until
+// Stop is called.
+func NewShedder(tb *Bucket, p ShedderParams) *Shedder {
+	if p.Interval <= 0 {
+		panic("shedder interval is not > 0")
+	}
+	if p.MinFactor == 0 {
+		p.MinFactor = 0.1
+	}
+	if !(p.MinFactor > 0 && p.MinFactor <= 1) {
+		panic("shedder minimum factor is not in (0, 1]")
+	}
+	for _, sig := range p.Signals {
+		if !(sig.Limit > sig.Threshold) {
+			panic("shed signal limit is not > threshold")
+		}
+	}
+	s := &Shedder{
+		tb:       tb,
+		params:   p,
+		baseRate: tb.Rate(),
+		factor:   1,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *Shedder) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.params.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Update()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Update samples the signals and adjusts the bucket's rate
+// immediately, without waiting for the next interval.
+func (s *Shedder) Update() {
+	factor := 1.0
+	for _, sig := range s.params.Signals {
+		factor = math.Min(factor, s.signalFactor(sig, sig.Probe()))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if factor == s.factor {
+		return
+	}
+	// Avoid needless work for small changes, but always
+	// restore the base rate exactly.
+	if math.Abs(factor-s.factor)/s.factor > rateMargin || factor == 1 {
+		s.tb.SetRate(s.baseRate * factor)
+		s.factor = factor
+	}
+}
+
+// signalFactor returns the factor by which the
+// rate should be scaled for the value v of sig.
+func (s *Shedder) signalFactor(sig ShedSignal, v float64) float64 {
+	switch {
+	case v <= sig.Threshold:
+		return 1
+	case v >= sig.Limit:
+		return s.params.MinFactor
+	}
+	return 1 - (1-s.params.MinFactor)*(v-sig.Threshold)/(sig.Limit-sig.Threshold)
+}
+
+// Factor returns the factor by which the bucket's
+// rate is currently scaled.
+func (s *Shedder) Factor() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.factor
+}
+
+// Stop stops the shedder and restores the bucket's base rate.
+func (s *Shedder) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.factor != 1 {
+			s.tb.SetRate(s.baseRate)
+			s.factor = 1
+		}
+	})
+}
+
+// GoroutineProbe returns a probe that reports
+// the number of goroutines.
+func GoroutineProbe() func() float64 {
+	return func() float64 {
+		return float64(runtime.NumGoroutine())
+	}
+}
+
+// HeapProbe returns a probe that reports the number
+// of bytes occupied by live and unswept heap objects.
+func HeapProbe() func() float64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	var mu sync.Mutex
+	return func() float64 {
+		mu.Lock()
+		defer mu.Unlock()
+		metrics.Read(sample)
+		return float64(sample[0].Value.Uint64())
+	}
+}
+
+// CPUProbe returns a probe that reports the fraction, from 0 to 1,
+// of the CPU time available to the Go runtime that was used since
+// the previous call, as estimated by the runtime. The first call
+// reports the fraction since the process started.
+func CPUProbe() func() float64 {
+	sample := []metrics.Sample{
+		{Name: "/cpu/classes/idle:cpu-seconds"},
+		{Name: "/cpu/classes/total:cpu-seconds"},
+	}
+	var (
+		mu                  sync.Mutex
+		prevIdle, prevTotal float64
+	)
+	return func() float64 {
+		mu.Lock()
+		defer mu.Unlock()
+		metrics.Read(sample)
+		idle, total := sample[0].Value.Float64(), sample[1].Value.Float64()
+		dIdle, dTotal := idle-prevIdle, total-prevTotal
+		prevIdle, prevTotal = idle, total
+		if dTotal <= 0 {
+			return 0
+		}
+		return math.Max(0, math.Min(1, 1-dIdle/dTotal))
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type shedderSuite struct{}
+
+var _ = gc.Suite(shedderSuite{})
+
+func (shedderSuite) TestShedder(c *gc.C) {
+	var load1, load2 float64
+	tb := NewBucketWithRate(100, 1)
+	s := NewShedder(tb, ShedderParams{
+		Signals: []ShedSignal{{
+			Probe:     func() float64 { return load1 },
+			Threshold: 10,
+			Limit:     20,
+		}, {
+			Probe:     func() float64 { return load2 },
+			Threshold: 0.5,
+			Limit:     1,
+		}},
+		MinFactor: 0.2,
+		Interval:  time.Hour,
+	})
+	defer s.Stop()
+
+	s.Update()
+	c.Assert(s.Factor(), gc.Equals, 1.0)
+
+	load1 = 15
+	s.Update()
+	c.Assert(s.Factor(), gc.Equals, 0.6)
+	c.Assert(isCloseTo(tb.Rate(), 60, rateMargin), gc.Equals, true)
+
+	// The most restrictive signal wins.
+	load2 = 2
+	s.Update()
+	c.Assert(s.Factor(), gc.Equals, 0.2)
+	c.Assert(isCloseTo(tb.Rate(), 20, rateMargin), gc.Equals, true)
+
+	load1, load2 = 0, 0
+	s.Update()
+	c.Assert(s.Factor(), gc.Equals, 1.0)
+	c.Assert(isCloseTo(tb.Rate(), 100, rateMargin), gc.Equals, true)
+
+	// Stopping restores the base rate.
+	load1 = 100
+	s.Update()
+	s.Stop()
+	c.Assert(isCloseTo(tb.Rate(), 100, rateMargin), gc.Equals, true)
+}
+
+func (shedderSuite) TestProbes(c *gc.C) {
+	if n := GoroutineProbe()(); n < 1 {
+		c.Errorf("goroutine probe returned %v", n)
+	}
+	if n := HeapProbe()(); n <= 0 {
+		c.Errorf("heap probe returned %v", n)
+	}
+	cpu := CPUProbe()
+	for i := 0; i < 2; i++ {
+		if n := cpu(); n < 0 || n > 1 {
+			c.Errorf("cpu probe returned %v", n)
+		}
+	}
+}
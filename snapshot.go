@@ -0,0 +1,211 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Snapshot records the number of tokens in a bucket at a moment in
+// time, so that a bucket can be restored to the same state later,
+// possibly in a different process.
+type Snapshot struct {
+	// Time holds the wall clock time of the bucket's latest
+	// tick when the snapshot was taken. Keeping the time of the
+	// tick rather than of the snapshot means that refill
+	// part way through a tick is not lost on restore.
+	Time time.Time `json:"time"`
+
+	// Available holds the number of available tokens at Time.
+	// It is negative if the bucket was in debt.
+	Available int64 `json:"available"`
+}
+
+// snapshotVersion holds the version of the binary encoding
+// of Snapshot written by MarshalBinary.
+const snapshotVersion = 1
+
+// MarshalBinary implements encoding.BinaryMarshaler. The encoding
+// is a version byte followed by the time, in nanoseconds since the
+// Unix epoch, and the number of available tokens, each as a signed
+// varint, which makes a typical snapshot around a dozen bytes.
+// Times outside the range of time.Time.UnixNano cannot be encoded
+// faithfully.
+func (s Snapshot) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 1, 1+2*binary.MaxVarintLen64)
+	data[0] = snapshotVersion
+	data = binary.AppendVarint(data, s.Time.UnixNano())
+	data = binary.AppendVarint(data, s.Available)
+	return data, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (s *Snapshot) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("empty snapshot")
+	}
+	if data[0] != snapshotVersion {
+		return fmt.Errorf("unknown snapshot version %d", data[0])
+	}
+	data = data[1:]
+	t, n := binary.Varint(data)
+	if n <= 0 {
+		return errors.New("snapshot time truncated")
+	}
+	data = data[n:]
+	avail, n := binary.Varint(data)
+	if n <= 0 {
+		return errors.New("snapshot token count truncated")
+	}
+	if n != len(data) {
+		return errors.New("unexpected data after snapshot")
+	}
+	*s = Snapshot{
+		Time:      time.Unix(0, t),
+		Available: avail,
+	}
+	return nil
+}
+
+// Snapshot returns a snapshot of the current state of the bucket.
+func (tb *Bucket) Snapshot() Snapshot {
+	tb.mu.Lock()
+	defer tb.unlock()
+	tb.adjust(tb.clock.Now())
+	latest := tb.startTime.Add(time.Duration(tb.latestTick) * tb.fillInterval)
+	return Snapshot{
+		// Strip the monotonic clock reading, which is
+		// meaningless outside this process.
+		Time:      latest.Round(0),
+		Available: tb.availableTokens,
+	}
+}
+
+// Restore sets the state of the bucket from the given snapshot.
+// The bucket is credited with refill, at its current rate, for the
+// time that has elapsed since the snapshot was taken, so a process
+// that restores a snapshot after being down for a while is not
+// penalised for the downtime, but does not regain tokens it spent
+// before the snapshot either. Time part way through a tick is kept
+// too, so that a process saving and restoring its bucket more
+// often than the fill interval still sees it refill. The result is
+// limited to the bucket's current capacity.
+func (tb *Bucket) Restore(s Snapshot) {
+	tb.mu.Lock()
+	defer tb.unlock()
+	tb.restore(tb.clock.Now(), s)
+}
+
+// restore is the internal version of Restore - it takes the
+// current time as an argument to enable easy testing.
+func (tb *Bucket) restore(now time.Time, s Snapshot) {
+	tb.adjust(now)
+	tb.availableTokens = s.Available
+	if tb.availableTokens > tb.capacity {
+		tb.availableTokens = tb.capacity
+	}
+	// Compare wall clock times, as s.Time has no
+	// monotonic clock reading.
+	elapsed := now.Round(0).Sub(s.Time)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	tb.refill(int64(elapsed / tb.fillInterval))
+	// Carry the time since the last whole tick over into the
+	// bucket's tick origin, so that the next tick comes when it
+	// would have had the bucket never been saved.
+	tb.startTime = now.Add(-(elapsed % tb.fillInterval))
+	tb.latestTick = 0
+}
+
+// SaveFile writes a snapshot of the bucket to the named file, in
+// the encoding produced by Snapshot.MarshalBinary, replacing it
+// atomically so that a crash during the write never leaves a partial
+// snapshot behind.
+func (tb *Bucket) SaveFile(path string) error {
+	return tb.saveFile(path, false)
+}
+
+// saveFile is the internal version of SaveFile. If sync is true,
+// the snapshot is flushed to stable storage.
+func (tb *Bucket) saveFile(path string, sync bool) error {
+	data, err := tb.Snapshot().MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, sync)
+}
+
+// LoadFile restores the bucket from a snapshot previously written
+// to the named file by SaveFile. Snapshots encoded as JSON are also
+// accepted. See Restore for how the time since the snapshot is
+// accounted for. If the file does not exist, the
+// returned error satisfies errors.Is(err, fs.ErrNotExist) and the
+// bucket is left unchanged.
+func (tb *Bucket) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var s Snapshot
+	if len(data) > 0 && data[0] == '{' {
+		err = json.Unmarshal(data, &s)
+	} else {
+		err = s.UnmarshalBinary(data)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot parse bucket snapshot %q: %w", path, err)
+	}
+	tb.Restore(s)
+	return nil
+}
+
+// writeFileAtomic writes data to the named file by writing it to
+// a temporary file in the same directory and renaming that over
+// the target. If sync is true, the data and the rename are flushed
+// to stable storage before it returns, so the new contents also
+// survive a crash of the whole machine.
+func writeFileAtomic(path string, data []byte, sync bool) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if !sync {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
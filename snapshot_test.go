@@ -0,0 +1,188 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"errors"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type snapshotSuite struct{}
+
+var _ = gc.Suite(snapshotSuite{})
+
+func (snapshotSuite) TestRestore(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Second, 10, clock)
+	tb.TakeAvailable(7)
+	s := tb.Snapshot()
+	c.Assert(s, gc.Equals, Snapshot{Time: clock.now, Available: 3})
+
+	// Downtime is credited at the bucket's rate.
+	clock.Sleep(time.Hour + 2*time.Second)
+	tb = NewBucketWithClock(time.Second, 10, clock)
+	tb.Restore(Snapshot{Time: clock.now.Add(-2 * time.Second), Available: 3})
+	c.Assert(tb.Available(), gc.Equals, int64(5))
+
+	// Debt is restored too, and so is its repayment.
+	tb.Restore(Snapshot{Time: clock.now.Add(-2 * time.Second), Available: -5})
+	c.Assert(tb.Available(), gc.Equals, int64(-3))
+
+	// The result never exceeds the bucket's capacity, and
+	// snapshots from the future are not credited.
+	tb.Restore(Snapshot{Time: clock.now.Add(-time.Hour), Available: 3})
+	c.Assert(tb.Available(), gc.Equals, int64(10))
+	tb.Restore(Snapshot{Time: clock.now.Add(time.Hour), Available: 3})
+	c.Assert(tb.Available(), gc.Equals, int64(3))
+}
+
+func (snapshotSuite) TestRestoreKeepsPartialTicks(c *gc.C) {
+	// A short-lived process restores a daily budget, spends what
+	// it can and saves it again every six hours.
+	path := filepath.Join(c.MkDir(), "bucket.snapshot")
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	total := int64(0)
+	for i := 0; i < 12; i++ {
+		tb := NewBucketWithQuantumAndClock(24*time.Hour, 100, 100, clock)
+		if i > 0 {
+			c.Assert(tb.LoadFile(path), gc.IsNil)
+		}
+		total += tb.TakeAvailable(100)
+		c.Assert(tb.SaveFile(path), gc.IsNil)
+		clock.Sleep(6 * time.Hour)
+	}
+	// The first run spends the initial 100, and the runs after
+	// the 24h and 48h ticks spend the 100 each tick adds.
+	c.Assert(total, gc.Equals, int64(300))
+}
+
+func (snapshotSuite) TestMarshalBinary(c *gc.C) {
+	for _, s := range []Snapshot{
+		{Time: time.Unix(1e9, 123), Available: 3},
+		{Time: time.Unix(0, 0), Available: -1 << 62},
+		{Time: time.Unix(-1e9, 0), Available: math.MaxInt64},
+	} {
+		data, err := s.MarshalBinary()
+		c.Assert(err, gc.IsNil)
+		var s1 Snapshot
+		c.Assert(s1.UnmarshalBinary(data), gc.IsNil)
+		c.Assert(s1.Time.Equal(s.Time), gc.Equals, true)
+		c.Assert(s1.Available, gc.Equals, s.Available)
+	}
+
+	data, err := Snapshot{Time: time.Unix(1e9, 0), Available: 3}.MarshalBinary()
+	c.Assert(err, gc.IsNil)
+	c.Assert(data, gc.HasLen, 11)
+	var s Snapshot
+	for _, test := range []struct {
+		data   []byte
+		expect string
+	}{{
+		data:   nil,
+		expect: "empty snapshot",
+	}, {
+		data:   []byte{2},
+		expect: "unknown snapshot version 2",
+	}, {
+		data:   data[:1],
+		expect: "snapshot time truncated",
+	}, {
+		data:   data[:len(data)-1],
+		expect: "snapshot token count truncated",
+	}, {
+		data:   append(data, 0),
+		expect: "unexpected data after snapshot",
+	}} {
+		c.Assert(s.UnmarshalBinary(test.data), gc.ErrorMatches, test.expect)
+	}
+}
+
+func (snapshotSuite) TestLoadJSONFile(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "bucket.json")
+	err := os.WriteFile(path, []byte(`{"time":"2001-09-09T01:46:40Z","available":4}`), 0666)
+	c.Assert(err, gc.IsNil)
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Minute, 100, clock)
+	c.Assert(tb.LoadFile(path), gc.IsNil)
+	c.Assert(tb.Available(), gc.Equals, int64(4))
+}
+
+func (snapshotSuite) TestSaveLoadFile(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "bucket.snapshot")
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Minute, 100, clock)
+
+	err := tb.LoadFile(path)
+	c.Assert(errors.Is(err, fs.ErrNotExist), gc.Equals, true)
+	c.Assert(tb.Available(), gc.Equals, int64(100))
+
+	tb.TakeAvailable(60)
+	c.Assert(tb.SaveFile(path), gc.IsNil)
+
+	clock.Sleep(10 * time.Minute)
+	tb = NewBucketWithClock(time.Minute, 100, clock)
+	c.Assert(tb.LoadFile(path), gc.IsNil)
+	c.Assert(tb.Available(), gc.Equals, int64(50))
+
+	err = os.WriteFile(path, []byte("garbage"), 0666)
+	c.Assert(err, gc.IsNil)
+	err = tb.LoadFile(path)
+	c.Assert(err, gc.ErrorMatches, `cannot parse bucket snapshot ".*": unknown snapshot version 103`)
+}
+
+func (snapshotSuite) TestSnapshotter(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "bucket.snapshot")
+	tb := NewBucket(time.Hour, 100)
+	s, err := NewSnapshotter(tb, SnapshotterParams{
+		Path:     path,
+		Interval: 10 * time.Millisecond,
+		Sync:     true,
+	})
+	c.Assert(err, gc.IsNil)
+	tb.TakeAvailable(30)
+
+	// Wait for a periodic snapshot to be written.
+	for a := 0; ; a++ {
+		if a > 500 {
+			c.Fatalf("no snapshot written")
+		}
+		tb1 := NewBucket(time.Hour, 100)
+		if err := tb1.LoadFile(path); err == nil && tb1.Available() == 70 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tb.TakeAvailable(30)
+	c.Assert(s.Stop(), gc.IsNil)
+	c.Assert(s.Stop(), gc.IsNil)
+
+	// A new snapshotter recovers the final state.
+	tb = NewBucket(time.Hour, 100)
+	s, err = NewSnapshotter(tb, SnapshotterParams{
+		Path:     path,
+		Interval: time.Hour,
+	})
+	c.Assert(err, gc.IsNil)
+	defer s.Stop()
+	c.Assert(tb.Available(), gc.Equals, int64(40))
+}
+
+func (snapshotSuite) TestSnapshotterBadFile(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "bucket.json")
+	err := os.WriteFile(path, []byte("garbage"), 0666)
+	c.Assert(err, gc.IsNil)
+	_, err = NewSnapshotter(NewBucket(time.Hour, 100), SnapshotterParams{
+		Path:     path,
+		Interval: time.Hour,
+	})
+	c.Assert(err, gc.ErrorMatches, `cannot parse bucket snapshot .*`)
+}
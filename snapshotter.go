@@ -0,0 +1,93 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"errors"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// SnapshotterParams holds the parameters for NewSnapshotter.
+type SnapshotterParams struct {
+	// Path holds the name of the file that snapshots
+	// are written to.
+	Path string
+
+	// Interval holds how often a snapshot is written.
+	// It must be positive.
+	Interval time.Duration
+
+	// Sync specifies whether each snapshot is flushed to
+	// stable storage before the next one is started. Without
+	// it, a crash of the machine (as opposed to the process)
+	// may lose more than one interval.
+	Sync bool
+
+	// OnError, if not nil, is called with the error from
+	// any snapshot that cannot be written.
+	OnError func(error)
+}
+
+// Snapshotter periodically writes snapshots of a bucket to a file,
+// so that if the process stops, at most one interval's worth of
+// token accounting is lost.
+type Snapshotter struct {
+	bucket *Bucket
+	params SnapshotterParams
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+	err      error
+}
+
+// NewSnapshotter restores the bucket from the snapshot file named
+// by p.Path, if there is one, and then starts writing snapshots of
+// the bucket to that file every p.Interval until Stop is called.
+func NewSnapshotter(bucket *Bucket, p SnapshotterParams) (*Snapshotter, error) {
+	if p.Interval <= 0 {
+		panic("snapshot interval is not > 0")
+	}
+	if err := bucket.LoadFile(p.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	s := &Snapshotter{
+		bucket: bucket,
+		params: p,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *Snapshotter) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.params.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.bucket.saveFile(s.params.Path, s.params.Sync); err != nil && s.params.OnError != nil {
+				s.params.OnError(err)
+			}
+		case <-s.stop:
+			s.err = s.bucket.saveFile(s.params.Path, s.params.Sync)
+			return
+		}
+	}
+}
+
+// Stop stops the snapshotter after writing a final snapshot,
+// and returns any error from writing it.
+func (s *Snapshotter) Stop() error {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+	return s.err
+}
@@ -0,0 +1,44 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"runtime"
+	"time"
+)
+
+// SpinClock is a Clock that trades CPU time for sleep precision.
+// The final Threshold of every sleep is spent polling the time and
+// yielding the processor rather than in time.Sleep, whose resolution
+// and scheduling latency are too coarse for pacing at microsecond
+// scale. Sleeps no longer than Threshold never park the goroutine
+// at all.
+//
+// A zero Threshold behaves like the system clock, and a very large
+// Threshold spins for every sleep, so SpinClock covers sleeping,
+// spinning and hybrid strategies.
+type SpinClock struct {
+	Threshold time.Duration
+}
+
+// Now implements Clock.Now by calling time.Now.
+func (SpinClock) Now() time.Time {
+	return time.Now()
+}
+
+// Sleep implements Clock.Sleep by sleeping for all but the
+// last Threshold of d and spinning for the rest.
+func (c SpinClock) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	deadline := time.Now().Add(d)
+	if park := d - c.Threshold; park > 0 {
+		time.Sleep(park)
+	}
+	for time.Now().Before(deadline) {
+		runtime.Gosched()
+	}
+}
@@ -0,0 +1,328 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+// Package sqllimit wraps a database/sql driver so that the queries
+// made through it are rate limited, protecting a database from the
+// services that use it without changing the code that makes the
+// queries. For example:
+//
+//	connector, err := d.(driver.DriverContext).OpenConnector(dsn)
+//	if err != nil {
+//		return err
+//	}
+//	db := sql.OpenDB(sqllimit.NewConnector(connector, sqllimit.Params{
+//		Read:  ratelimit.NewBucketWithRate(500, 50),
+//		Write: ratelimit.NewBucketWithRate(50, 5),
+//	}))
+package sqllimit
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+
+	"github.com/juju/ratelimit"
+)
+
+// Params holds the buckets charged for the operations made through
+// a wrapped connector. Each operation waits for one token from its
+// bucket, or fails with the error from Bucket.WaitContext. Any of
+// the buckets may be nil, in which case the corresponding
+// operations are not limited.
+type Params struct {
+	// Read is charged for each query that returns rows.
+	Read *ratelimit.Bucket
+
+	// Write is charged for each statement that does not return
+	// rows, such as an INSERT or UPDATE.
+	Write *ratelimit.Bucket
+
+	// Tx is charged for each transaction begun, in addition to
+	// the statements made within it.
+	Tx *ratelimit.Bucket
+}
+
+// NewConnector returns a connector whose connections are those of
+// c, but limited according to p.
+func NewConnector(c driver.Connector, p Params) driver.Connector {
+	return &connector{
+		c:      c,
+		params: p,
+	}
+}
+
+type connector struct {
+	c      driver.Connector
+	params Params
+}
+
+// Connect implements driver.Connector.
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	dc, err := c.c.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{
+		c:      dc,
+		params: &c.params,
+	}, nil
+}
+
+// Driver implements driver.Connector.
+func (c *connector) Driver() driver.Driver {
+	return c.c.Driver()
+}
+
+// charge waits for a token from tb, if it is not nil.
+func charge(ctx context.Context, tb *ratelimit.Bucket) error {
+	if tb == nil {
+		return nil
+	}
+	return tb.WaitContext(ctx, 1)
+}
+
+// conn wraps a driver connection. Like the connection itself, it
+// is used by only one goroutine at a time.
+type conn struct {
+	c      driver.Conn
+	params *Params
+
+	// prepaid holds the bucket already charged for a query that
+	// the driver declined to run directly with driver.ErrSkip, in
+	// which case database/sql runs the query again as a prepared
+	// statement, which must not be charged a second time.
+	prepaid *ratelimit.Bucket
+}
+
+var (
+	_ driver.Conn               = (*conn)(nil)
+	_ driver.ConnBeginTx        = (*conn)(nil)
+	_ driver.ConnPrepareContext = (*conn)(nil)
+	_ driver.QueryerContext     = (*conn)(nil)
+	_ driver.ExecerContext      = (*conn)(nil)
+	_ driver.Pinger             = (*conn)(nil)
+	_ driver.SessionResetter    = (*conn)(nil)
+	_ driver.Validator          = (*conn)(nil)
+	_ driver.NamedValueChecker  = (*conn)(nil)
+)
+
+// Prepare implements driver.Conn.
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+// PrepareContext implements driver.ConnPrepareContext.
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var (
+		s   driver.Stmt
+		err error
+	)
+	if pc, ok := c.c.(driver.ConnPrepareContext); ok {
+		s, err = pc.PrepareContext(ctx, query)
+	} else {
+		s, err = c.c.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &stmt{
+		s:    s,
+		conn: c,
+	}, nil
+}
+
+// Close implements driver.Conn.
+func (c *conn) Close() error {
+	return c.c.Close()
+}
+
+// Begin implements driver.Conn.
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx implements driver.ConnBeginTx.
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if bc, ok := c.c.(driver.ConnBeginTx); ok {
+		if err := charge(ctx, c.params.Tx); err != nil {
+			return nil, err
+		}
+		return bc.BeginTx(ctx, opts)
+	}
+	if opts != (driver.TxOptions{}) {
+		return nil, errors.New("sqllimit: driver does not support transaction options")
+	}
+	if err := charge(ctx, c.params.Tx); err != nil {
+		return nil, err
+	}
+	return c.c.Begin()
+}
+
+// QueryContext implements driver.QueryerContext.
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	qc, ok := c.c.(driver.QueryerContext)
+	if !ok {
+		// Let database/sql prepare a statement instead.
+		return nil, driver.ErrSkip
+	}
+	if err := charge(ctx, c.params.Read); err != nil {
+		return nil, err
+	}
+	rows, err := qc.QueryContext(ctx, query, args)
+	if err == driver.ErrSkip {
+		c.prepaid = c.params.Read
+	}
+	return rows, err
+}
+
+// ExecContext implements driver.ExecerContext.
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	ec, ok := c.c.(driver.ExecerContext)
+	if !ok {
+		// Let database/sql prepare a statement instead.
+		return nil, driver.ErrSkip
+	}
+	if err := charge(ctx, c.params.Write); err != nil {
+		return nil, err
+	}
+	res, err := ec.ExecContext(ctx, query, args)
+	if err == driver.ErrSkip {
+		c.prepaid = c.params.Write
+	}
+	return res, err
+}
+
+// chargeStmt charges tb for a statement run on the
+// connection, unless it has already been paid for.
+func (c *conn) chargeStmt(ctx context.Context, tb *ratelimit.Bucket) error {
+	prepaid := c.prepaid
+	c.prepaid = nil
+	if prepaid != nil && prepaid == tb {
+		return nil
+	}
+	return charge(ctx, tb)
+}
+
+// Ping implements driver.Pinger.
+func (c *conn) Ping(ctx context.Context) error {
+	if p, ok := c.c.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// ResetSession implements driver.SessionResetter.
+func (c *conn) ResetSession(ctx context.Context) error {
+	c.prepaid = nil
+	if r, ok := c.c.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+// IsValid implements driver.Validator.
+func (c *conn) IsValid() bool {
+	if v, ok := c.c.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+// CheckNamedValue implements driver.NamedValueChecker.
+func (c *conn) CheckNamedValue(nv *driver.NamedValue) error {
+	if nc, ok := c.c.(driver.NamedValueChecker); ok {
+		return nc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// stmt wraps a prepared statement.
+type stmt struct {
+	s    driver.Stmt
+	conn *conn
+}
+
+var (
+	_ driver.Stmt              = (*stmt)(nil)
+	_ driver.StmtQueryContext  = (*stmt)(nil)
+	_ driver.StmtExecContext   = (*stmt)(nil)
+	_ driver.NamedValueChecker = (*stmt)(nil)
+)
+
+// Close implements driver.Stmt.
+func (s *stmt) Close() error {
+	return s.s.Close()
+}
+
+// NumInput implements driver.Stmt.
+func (s *stmt) NumInput() int {
+	return s.s.NumInput()
+}
+
+// Exec implements driver.Stmt.
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	if err := s.conn.chargeStmt(context.Background(), s.conn.params.Write); err != nil {
+		return nil, err
+	}
+	return s.s.Exec(args)
+}
+
+// Query implements driver.Stmt.
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	if err := s.conn.chargeStmt(context.Background(), s.conn.params.Read); err != nil {
+		return nil, err
+	}
+	return s.s.Query(args)
+}
+
+// ExecContext implements driver.StmtExecContext.
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if err := s.conn.chargeStmt(ctx, s.conn.params.Write); err != nil {
+		return nil, err
+	}
+	if ec, ok := s.s.(driver.StmtExecContext); ok {
+		return ec.ExecContext(ctx, args)
+	}
+	values, err := namedValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.s.Exec(values)
+}
+
+// QueryContext implements driver.StmtQueryContext.
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if err := s.conn.chargeStmt(ctx, s.conn.params.Read); err != nil {
+		return nil, err
+	}
+	if qc, ok := s.s.(driver.StmtQueryContext); ok {
+		return qc.QueryContext(ctx, args)
+	}
+	values, err := namedValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.s.Query(values)
+}
+
+// CheckNamedValue implements driver.NamedValueChecker.
+func (s *stmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if nc, ok := s.s.(driver.NamedValueChecker); ok {
+		return nc.CheckNamedValue(nv)
+	}
+	return s.conn.CheckNamedValue(nv)
+}
+
+// namedValues converts args for a driver that
+// does not support named parameters.
+func namedValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("sqllimit: driver does not support the use of named parameters")
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package sqllimit_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/ratelimit"
+	"github.com/juju/ratelimit/sqllimit"
+)
+
+func TestPackage(t *testing.T) {
+	gc.TestingT(t)
+}
+
+type sqlSuite struct{}
+
+var _ = gc.Suite(sqlSuite{})
+
+func (sqlSuite) TestLimits(c *gc.C) {
+	read := ratelimit.NewBucket(time.Hour, 10)
+	write := ratelimit.NewBucket(time.Hour, 2)
+	tx := ratelimit.NewBucket(time.Hour, 10)
+	db := sql.OpenDB(sqllimit.NewConnector(fakeConnector{}, sqllimit.Params{
+		Read:  read,
+		Write: write,
+		Tx:    tx,
+	}))
+	defer db.Close()
+
+	rows, err := db.Query("SELECT 1")
+	c.Assert(err, gc.IsNil)
+	c.Assert(rows.Close(), gc.IsNil)
+	c.Assert(read.Available(), gc.Equals, int64(9))
+
+	// The fake driver declines to run statements directly, so
+	// database/sql prepares them, but they are charged only once.
+	_, err = db.Exec("UPDATE t SET x = ?", 1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(write.Available(), gc.Equals, int64(1))
+
+	t, err := db.Begin()
+	c.Assert(err, gc.IsNil)
+	_, err = t.Exec("INSERT INTO t VALUES (1)")
+	c.Assert(err, gc.IsNil)
+	c.Assert(t.Commit(), gc.IsNil)
+	c.Assert(tx.Available(), gc.Equals, int64(9))
+	c.Assert(write.Available(), gc.Equals, int64(0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = db.ExecContext(ctx, "DELETE FROM t")
+	c.Assert(err, gc.Equals, ratelimit.ErrDeadline)
+	c.Assert(read.Available(), gc.Equals, int64(9))
+}
+
+type fakeConnector struct{}
+
+func (fakeConnector) Connect(context.Context) (driver.Conn, error) {
+	return fakeConn{}, nil
+}
+
+func (fakeConnector) Driver() driver.Driver {
+	return nil
+}
+
+// fakeConn implements a connection that runs all statements
+// as prepared statements and produces no rows.
+type fakeConn struct{}
+
+func (fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt{}, nil
+}
+
+func (fakeConn) Close() error {
+	return nil
+}
+
+func (fakeConn) Begin() (driver.Tx, error) {
+	return fakeTx{}, nil
+}
+
+func (fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return nil, driver.ErrSkip
+}
+
+type fakeStmt struct{}
+
+func (fakeStmt) Close() error {
+	return nil
+}
+
+func (fakeStmt) NumInput() int {
+	return -1
+}
+
+func (fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+
+func (fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return fakeRows{}, nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error {
+	return nil
+}
+
+func (fakeTx) Rollback() error {
+	return nil
+}
+
+type fakeRows struct{}
+
+func (fakeRows) Columns() []string {
+	return []string{"x"}
+}
+
+func (fakeRows) Close() error {
+	return nil
+}
+
+func (fakeRows) Next(dest []driver.Value) error {
+	return io.EOF
+}
@@ -0,0 +1,106 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+// Package testclock provides a clock that satisfies ratelimit.Clock
+// and only moves when told to, so that rate limited code can be
+// tested deterministically without real sleeps.
+package testclock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a fake clock. Its time only changes when Advance is
+// called, and calls to Sleep block until the clock has been
+// advanced past the end of the sleep. Methods on Clock may be
+// called concurrently.
+type Clock struct {
+	// mu guards the fields below it.
+	mu sync.Mutex
+
+	// changed is signalled whenever the set of
+	// waiters changes.
+	changed *sync.Cond
+
+	// now holds the current time of the clock.
+	now time.Time
+
+	// waiters holds the goroutines blocked in Sleep.
+	waiters []waiter
+}
+
+// waiter represents a goroutine blocked in Sleep.
+type waiter struct {
+	until time.Time
+	done  chan struct{}
+}
+
+// NewClock returns a clock whose time starts at now.
+func NewClock(now time.Time) *Clock {
+	c := &Clock{now: now}
+	c.changed = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now implements ratelimit.Clock.Now by returning
+// the current time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Sleep implements ratelimit.Clock.Sleep by blocking
+// until the clock has been advanced by at least d.
+func (c *Clock) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	c.mu.Lock()
+	w := waiter{
+		until: c.now.Add(d),
+		done:  make(chan struct{}),
+	}
+	c.waiters = append(c.waiters, w)
+	c.changed.Broadcast()
+	c.mu.Unlock()
+	<-w.done
+}
+
+// Advance moves the time of the clock forward by d and wakes
+// every sleeper whose sleep has ended.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.until.After(c.now) {
+			waiters = append(waiters, w)
+		} else {
+			close(w.done)
+		}
+	}
+	c.waiters = waiters
+	c.changed.Broadcast()
+}
+
+// Waiters returns the number of goroutines currently
+// blocked in Sleep.
+func (c *Clock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+// BlockUntilWaiters blocks until at least n goroutines
+// are blocked in Sleep.
+func (c *Clock) BlockUntilWaiters(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.waiters) < n {
+		c.changed.Wait()
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package testclock
+
+import (
+	"testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+func TestPackage(t *testing.T) {
+	gc.TestingT(t)
+}
+
+type clockSuite struct{}
+
+var _ = gc.Suite(clockSuite{})
+
+func (clockSuite) TestNow(c *gc.C) {
+	start := time.Unix(1e9, 0)
+	clock := NewClock(start)
+	c.Assert(clock.Now(), gc.Equals, start)
+	clock.Advance(time.Second)
+	c.Assert(clock.Now(), gc.Equals, start.Add(time.Second))
+}
+
+func (clockSuite) TestSleep(c *gc.C) {
+	clock := NewClock(time.Unix(1e9, 0))
+	clock.Sleep(0)
+
+	done := make(chan time.Duration, 2)
+	for _, d := range []time.Duration{time.Second, 3 * time.Second} {
+		d := d
+		go func() {
+			clock.Sleep(d)
+			done <- d
+		}()
+	}
+	clock.BlockUntilWaiters(2)
+
+	clock.Advance(500 * time.Millisecond)
+	assertNotDone(c, done)
+	clock.Advance(500 * time.Millisecond)
+	c.Assert(<-done, gc.Equals, time.Second)
+	assertNotDone(c, done)
+	c.Assert(clock.Waiters(), gc.Equals, 1)
+
+	clock.Advance(time.Hour)
+	c.Assert(<-done, gc.Equals, 3*time.Second)
+	c.Assert(clock.Waiters(), gc.Equals, 0)
+}
+
+func assertNotDone(c *gc.C, done <-chan time.Duration) {
+	select {
+	case d := <-done:
+		c.Fatalf("sleep of %v finished early", d)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
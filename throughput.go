@@ -0,0 +1,53 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import "context"
+
+// ThroughputLimiter limits both the rate of requests and the
+// rate of bytes they carry, such as for an ingest API with caps
+// on both. Each request is charged a token from one bucket and a
+// token per byte from another, and either both are charged or
+// neither is, so that a request refused by one bucket does not
+// use up the other's tokens.
+type ThroughputLimiter struct {
+	requests *Bucket
+	bytes    *Bucket
+}
+
+// NewThroughputLimiter returns a limiter that charges requests a
+// token per request and bytes a token per byte. Either bucket may
+// be nil, in which case that measure is not limited.
+func NewThroughputLimiter(requests, bytes *Bucket) *ThroughputLimiter {
+	return &ThroughputLimiter{
+		requests: requests,
+		bytes:    bytes,
+	}
+}
+
+// Allow takes the tokens for a request of size bytes if they are
+// all available immediately, and reports whether it did. If
+// either bucket lacks the tokens, none are taken from either.
+// Allow implements Allower, treating the count as the size.
+func (l *ThroughputLimiter) Allow(size int64) bool {
+	takes := make([]BucketCount, 0, 2)
+	if l.requests != nil {
+		takes = append(takes, BucketCount{l.requests, 1})
+	}
+	if l.bytes != nil {
+		takes = append(takes, BucketCount{l.bytes, size})
+	}
+	_, ok := MultiTake(takes, 0)
+	return ok
+}
+
+// Acquire waits until a request of size bytes may be made, waiting
+// for the tokens from both buckets at once. If ctx is done first,
+// or has a deadline before which the tokens would not become
+// available, Acquire returns an error as Bucket.WaitContext does,
+// and no tokens remain taken from either bucket.
+func (l *ThroughputLimiter) Acquire(ctx context.Context, size int64) error {
+	return waitBoth(ctx, l.requests, 1, l.bytes, size)
+}
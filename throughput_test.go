@@ -0,0 +1,58 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type throughputSuite struct{}
+
+var _ = gc.Suite(throughputSuite{})
+
+func (throughputSuite) TestAllow(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	requests := NewBucketWithClock(time.Second, 2, clock)
+	bytes := NewBucketWithClock(time.Millisecond, 1000, clock)
+	l := NewThroughputLimiter(requests, bytes)
+
+	c.Assert(l.Allow(600), gc.Equals, true)
+
+	// Refused for lack of bytes: no request token is used.
+	c.Assert(l.Allow(600), gc.Equals, false)
+	c.Assert(requests.Available(), gc.Equals, int64(1))
+
+	c.Assert(l.Allow(400), gc.Equals, true)
+
+	// Refused for lack of requests: no bytes are used.
+	clock.Sleep(500 * time.Millisecond)
+	c.Assert(l.Allow(100), gc.Equals, false)
+	c.Assert(bytes.Available(), gc.Equals, int64(500))
+
+	c.Assert(NewThroughputLimiter(nil, nil).Allow(1e9), gc.Equals, true)
+}
+
+func (throughputSuite) TestAcquire(c *gc.C) {
+	requests := NewBucket(time.Hour, 10)
+	bytes := NewBucket(time.Millisecond, 100)
+	l := NewThroughputLimiter(requests, bytes)
+	ctx := context.Background()
+
+	start := time.Now()
+	c.Assert(l.Acquire(ctx, 120), gc.IsNil)
+	if d := time.Since(start); d < 20*time.Millisecond {
+		c.Errorf("request allowed after %v, want at least 20ms", d)
+	}
+	c.Assert(requests.Available(), gc.Equals, int64(9))
+
+	// A request that cannot be allowed in time takes nothing.
+	tctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	c.Assert(l.Acquire(tctx, 1e9), gc.Equals, ErrDeadline)
+	c.Assert(requests.Available(), gc.Equals, int64(9))
+}
@@ -0,0 +1,88 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// WheelClock is a Clock that coalesces sleeps. Time is divided
+// into slots of a fixed resolution, and every Sleep that ends
+// within the same slot is woken by a single shared timer at the
+// end of that slot. When many goroutines wait on a bucket at
+// once, this uses one runtime timer per slot instead of one
+// per waiter, at the cost of each sleep lasting up to one
+// resolution longer than requested.
+type WheelClock struct {
+	resolution time.Duration
+
+	// base holds the time the clock was created.
+	// Slot n ends at base + n*resolution.
+	base time.Time
+
+	// mu guards the fields below it.
+	mu sync.Mutex
+
+	// slots holds the channel closed at the end of each
+	// slot that currently has sleepers.
+	slots map[int64]chan struct{}
+}
+
+// NewWheelClock returns a clock whose sleeps are coalesced
+// into slots of the given resolution, which must be positive.
+func NewWheelClock(resolution time.Duration) *WheelClock {
+	if resolution <= 0 {
+		panic("wheel clock resolution is not > 0")
+	}
+	return &WheelClock{
+		resolution: resolution,
+		base:       time.Now(),
+		slots:      make(map[int64]chan struct{}),
+	}
+}
+
+// Now implements Clock.Now by calling time.Now.
+func (c *WheelClock) Now() time.Time {
+	return time.Now()
+}
+
+// Sleep implements Clock.Sleep by waiting until the end of
+// the slot containing the end of the sleep. A sleep too long
+// to be represented, such as one of the longest possible
+// duration, never ends.
+func (c *WheelClock) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	<-c.slot(time.Now().Add(d))
+}
+
+// slot returns the channel that will be closed at the end
+// of the slot containing t, starting its timer if needed. It
+// returns nil, which is never closed, if the end of the slot
+// is too far from the clock's base time to be represented.
+func (c *WheelClock) slot(t time.Time) <-chan struct{} {
+	since := t.Sub(c.base)
+	if since > infinityDuration-c.resolution {
+		return nil
+	}
+	n := int64((since + c.resolution - 1) / c.resolution)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ch, ok := c.slots[n]; ok {
+		return ch
+	}
+	ch := make(chan struct{})
+	c.slots[n] = ch
+	end := c.base.Add(time.Duration(n) * c.resolution)
+	time.AfterFunc(time.Until(end), func() {
+		c.mu.Lock()
+		delete(c.slots, n)
+		c.mu.Unlock()
+		close(ch)
+	})
+	return ch
+}
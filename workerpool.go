@@ -0,0 +1,167 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrPoolClosed is returned by WorkerPool.Submit once
+// the pool has been shut down.
+var ErrPoolClosed = errors.New("worker pool closed")
+
+// workerPoolRetryInterval holds how long a worker waits before
+// asking the pool's bucket for a token again after it refused.
+const workerPoolRetryInterval = 100 * time.Millisecond
+
+// WorkerPoolParams holds the parameters for NewWorkerPool.
+type WorkerPoolParams struct {
+	// Rate, if not nil, limits the rate at which jobs are
+	// started. Each job takes one token. While the bucket
+	// refuses to let callers wait, as it does when paused,
+	// workers keep asking it again until it gives them a
+	// token, so no submitted job is dropped.
+	Rate *Bucket
+
+	// Workers holds the number of jobs that may run
+	// at once. It must be positive.
+	Workers int
+
+	// QueueSize holds the number of submitted jobs that may
+	// wait for a worker before Submit blocks.
+	QueueSize int
+}
+
+// WorkerPool runs submitted jobs on a fixed number of workers,
+// starting them no faster than the pool's rate.
+type WorkerPool struct {
+	rate *Bucket
+	jobs chan func(context.Context)
+
+	// ctx is passed to the jobs and cancelled if Shutdown
+	// gives up waiting for them.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// quit is closed when Shutdown is called.
+	quit chan struct{}
+
+	// mu guards closed, and is held for reading
+	// while a job is submitted.
+	mu     sync.RWMutex
+	closed bool
+
+	wg           sync.WaitGroup
+	shutdownOnce sync.Once
+}
+
+// NewWorkerPool returns a pool configured by p, with
+// its workers running.
+func NewWorkerPool(p WorkerPoolParams) *WorkerPool {
+	if p.Workers <= 0 {
+		panic("worker pool workers is not > 0")
+	}
+	if p.QueueSize < 0 {
+		panic("worker pool queue size is not >= 0")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	wp := &WorkerPool{
+		rate:   p.Rate,
+		jobs:   make(chan func(context.Context), p.QueueSize),
+		ctx:    ctx,
+		cancel: cancel,
+		quit:   make(chan struct{}),
+	}
+	wp.wg.Add(p.Workers)
+	for i := 0; i < p.Workers; i++ {
+		go wp.work()
+	}
+	return wp
+}
+
+func (wp *WorkerPool) work() {
+	defer wp.wg.Done()
+	for job := range wp.jobs {
+		if !wp.waitRate() || wp.ctx.Err() != nil {
+			// The pool is being shut down forcibly,
+			// so drop the job.
+			continue
+		}
+		job(wp.ctx)
+	}
+}
+
+// waitRate waits for a token from the pool's bucket, if it has
+// one, asking again every workerPoolRetryInterval while the bucket
+// refuses. It returns false if the pool is shut down forcibly
+// first.
+func (wp *WorkerPool) waitRate() bool {
+	if wp.rate == nil {
+		return true
+	}
+	for {
+		err := wp.rate.WaitContext(wp.ctx, 1)
+		if err == nil {
+			return true
+		}
+		if wp.ctx.Err() != nil {
+			return false
+		}
+		if wp.rate.sleepContext(wp.ctx, workerPoolRetryInterval) != nil {
+			return false
+		}
+	}
+}
+
+// Submit queues job to be run by the pool, waiting for room in the
+// queue if necessary. It returns the context's error if ctx is done
+// first, and ErrPoolClosed if the pool has been shut down. The job
+// is passed a context that is cancelled if Shutdown gives up
+// waiting for the pool's jobs to finish.
+func (wp *WorkerPool) Submit(ctx context.Context, job func(context.Context)) error {
+	wp.mu.RLock()
+	defer wp.mu.RUnlock()
+	if wp.closed {
+		return ErrPoolClosed
+	}
+	select {
+	case wp.jobs <- job:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-wp.quit:
+		return ErrPoolClosed
+	}
+}
+
+// Shutdown stops the pool accepting jobs and waits for the jobs
+// already submitted to finish. If ctx is done first, it cancels the
+// context passed to the jobs, drops those that have not started,
+// and returns the context's error without waiting further.
+func (wp *WorkerPool) Shutdown(ctx context.Context) error {
+	wp.shutdownOnce.Do(func() {
+		close(wp.quit)
+		wp.mu.Lock()
+		wp.closed = true
+		close(wp.jobs)
+		wp.mu.Unlock()
+	})
+	done := make(chan struct{})
+	go func() {
+		wp.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		wp.cancel()
+		return nil
+	case <-ctx.Done():
+		wp.cancel()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the LGPLv3 with static-linking exception.
+// See LICENCE file for details.
+
+package ratelimit
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type workerPoolSuite struct{}
+
+var _ = gc.Suite(workerPoolSuite{})
+
+func (workerPoolSuite) TestWorkerPool(c *gc.C) {
+	wp := NewWorkerPool(WorkerPoolParams{
+		Rate:      NewBucket(5*time.Millisecond, 1),
+		Workers:   2,
+		QueueSize: 10,
+	})
+	ctx := context.Background()
+	var ran, running, maxRunning atomic.Int64
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		err := wp.Submit(ctx, func(context.Context) {
+			n := running.Add(1)
+			for {
+				m := maxRunning.Load()
+				if n <= m || maxRunning.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			running.Add(-1)
+			ran.Add(1)
+		})
+		c.Assert(err, gc.IsNil)
+	}
+	c.Assert(wp.Shutdown(ctx), gc.IsNil)
+	c.Assert(ran.Load(), gc.Equals, int64(6))
+	if n := maxRunning.Load(); n > 2 {
+		c.Errorf("%d jobs ran at once, want at most 2", n)
+	}
+	if d := time.Since(start); d < 25*time.Millisecond {
+		c.Errorf("jobs finished after %v, want at least 25ms", d)
+	}
+	c.Assert(wp.Submit(ctx, func(context.Context) {}), gc.Equals, ErrPoolClosed)
+}
+
+func (workerPoolSuite) TestWorkerPoolPaused(c *gc.C) {
+	rate := NewBucket(time.Millisecond, 1)
+	rate.Pause()
+	wp := NewWorkerPool(WorkerPoolParams{
+		Rate:      rate,
+		Workers:   2,
+		QueueSize: 5,
+	})
+	ctx := context.Background()
+	var ran atomic.Int64
+	for i := 0; i < 5; i++ {
+		c.Assert(wp.Submit(ctx, func(context.Context) {
+			ran.Add(1)
+		}), gc.IsNil)
+	}
+	time.Sleep(150 * time.Millisecond)
+	c.Assert(ran.Load(), gc.Equals, int64(0))
+
+	// The jobs run once the bucket is resumed.
+	rate.Resume()
+	c.Assert(wp.Shutdown(ctx), gc.IsNil)
+	c.Assert(ran.Load(), gc.Equals, int64(5))
+}
+
+func (workerPoolSuite) TestWorkerPoolForcedShutdown(c *gc.C) {
+	for _, rate := range []*Bucket{NewBucket(time.Hour, 1), nil} {
+		c.Logf("rate limited: %v", rate != nil)
+		testWorkerPoolForcedShutdown(c, rate)
+	}
+}
+
+func testWorkerPoolForcedShutdown(c *gc.C, rate *Bucket) {
+	wp := NewWorkerPool(WorkerPoolParams{
+		Rate:      rate,
+		Workers:   1,
+		QueueSize: 1,
+	})
+	ctx := context.Background()
+	cancelled := make(chan struct{})
+	c.Assert(wp.Submit(ctx, func(ctx context.Context) {
+		<-ctx.Done()
+		close(cancelled)
+	}), gc.IsNil)
+	var ran atomic.Bool
+	c.Assert(wp.Submit(ctx, func(context.Context) {
+		ran.Store(true)
+	}), gc.IsNil)
+
+	// The queue is full, so submitting waits.
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	c.Assert(wp.Submit(tctx, func(context.Context) {}), gc.Equals, context.DeadlineExceeded)
+
+	tctx, cancel = context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	c.Assert(wp.Shutdown(tctx), gc.Equals, context.DeadlineExceeded)
+	<-cancelled
+	c.Assert(wp.Shutdown(ctx), gc.IsNil)
+	c.Assert(ran.Load(), gc.Equals, false)
+}